@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/takutakahashi/kommon/pkg/agent"
+)
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "Cancel the execution running for a session",
+	Long: `Cancel the agent execution started by "kommon run" for a session.
+The webhook server runs this inside agent containers to stop an execution.
+For example:
+  kommon cancel --session-id 123`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sessionID := viper.GetString("session_id")
+		if sessionID == "" {
+			return fmt.Errorf("session ID is required")
+		}
+
+		err := agent.CancelExecution(viper.GetString("agent_work_dir"), sessionID)
+		if errors.Is(err, agent.ErrNoExecution) {
+			fmt.Println("No execution is running")
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to cancel execution: %w", err)
+		}
+
+		fmt.Println("Execution canceled")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+}
@@ -9,25 +9,41 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/go-github/v57/github"
+	"github.com/mitchellh/mapstructure"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/authz"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/dedup"
+	"github.com/takutakahashi/kommon/pkg/executor"
+	"github.com/takutakahashi/kommon/pkg/progress"
+	"github.com/takutakahashi/kommon/pkg/queue"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+	"github.com/takutakahashi/kommon/pkg/session"
+	"github.com/takutakahashi/kommon/pkg/thread"
+	corev1 "k8s.io/api/core/v1"
 )
 
 var (
 	githubCmd = &cobra.Command{
 		Use:   "github",
 		Short: "GitHub App webhook server commands",
-		Long:  `GitHub App webhook server that handles various GitHub events`,
-		RunE:  runServe,
+		Long: `GitHub App webhook server that handles various GitHub events.
+
+The agents need the API key of the AI service, set with --api-key,
+KOMMON_API_KEY or OPENROUTER_API_KEY; the server doesn't start without it.`,
+		RunE: runServe,
 	}
 )
 
@@ -41,6 +57,40 @@ func init() {
 	githubCmd.Flags().Int64("app-id", 0, "GitHub App ID")
 	githubCmd.Flags().String("private-key-file", "", "Path to GitHub App private key file")
 	githubCmd.Flags().String("webhook-secret", "", "GitHub webhook secret for request validation")
+	githubCmd.Flags().String("session-store", string(session.StoreTypeFile), "Where sessions are persisted (memory, file or configmap)")
+	githubCmd.Flags().String("session-store-path", "", "Session file for the file store (default is <data-dir>/sessions.json)")
+	githubCmd.Flags().String("session-store-namespace", "", "Namespace of the session configmap")
+	githubCmd.Flags().String("session-store-name", "", "Name of the session configmap (default is kommon-sessions)")
+	githubCmd.Flags().Int("delivery-cache-size", dedup.DefaultSize, "Number of webhook delivery IDs remembered to skip redeliveries")
+	githubCmd.Flags().Duration("delivery-cache-ttl", dedup.DefaultTTL, "How long webhook delivery IDs are remembered")
+	githubCmd.Flags().Int("max-concurrency", 2, "Maximum number of executions running at the same time")
+	githubCmd.Flags().Int("max-concurrency-per-repo", 1, "Maximum number of executions running at the same time per repository")
+	githubCmd.Flags().Bool("merge-queued-comments", false, "Merge comments waiting for the same issue into a single execution")
+	githubCmd.Flags().String("queue-path", "", "File persisting queued executions (default is <data-dir>/queue.json)")
+	githubCmd.Flags().Duration("status-update-interval", progress.DefaultInterval, "Minimum time between two edits of a status comment")
+	githubCmd.Flags().Int("status-lines", progress.DefaultLines, "Number of output lines shown in a status comment while running")
+	githubCmd.Flags().Duration("execution-timeout", 0, "Maximum wall-clock time of an execution (0 means no limit)")
+	githubCmd.Flags().Int64("max-output-bytes", 0, "Maximum output of an execution in bytes (0 means no limit)")
+	githubCmd.Flags().Int64("max-tokens", 0, "Maximum LLM tokens used by an execution (0 means no limit)")
+	githubCmd.Flags().Float64("max-cost", 0, "Maximum estimated cost of an execution in USD (0 means no limit)")
+	githubCmd.Flags().Float64("cost-per-million-tokens", 0, "Price in USD per million tokens used to estimate the cost")
+	githubCmd.Flags().Int("context-max-tokens", thread.DefaultMaxTokens, "Approximate tokens of the issue or pull request conversation given to the agent (0 disables it)")
+	githubCmd.Flags().String("authz-min-permission", string(authz.DefaultPermission), "Repository permission needed to invoke kommon (none, read, triage, write, maintain or admin)")
+	githubCmd.Flags().StringSlice("authz-orgs", nil, "Organizations whose members may invoke kommon (default is anyone with the permission)")
+	githubCmd.Flags().StringSlice("authz-teams", nil, "Teams (org/team-slug) whose members may invoke kommon (default is anyone with the permission)")
+	githubCmd.Flags().StringSlice("authz-allow", nil, "Users who may always invoke kommon")
+	githubCmd.Flags().StringSlice("authz-deny", nil, "Users who may never invoke kommon")
+	githubCmd.Flags().String("executor", string(executor.ExecutorTypeLocal), "Executor type for agents (local, docker or kubernetes)")
+	githubCmd.Flags().String("executor-config-dir", "", "Config directory for the local executor")
+	githubCmd.Flags().String("executor-namespace", "", "Kubernetes namespace for agent pods")
+	githubCmd.Flags().String("executor-image", "", "Container image for docker and kubernetes agents")
+	githubCmd.Flags().String("executor-cpu-limit", "", "CPU limit for each agent (e.g. 1.0)")
+	githubCmd.Flags().String("executor-memory-limit", "", "Memory limit for each agent (e.g. 1Gi)")
+	githubCmd.Flags().String("executor-orphan-policy", string(executor.OrphanPolicyAdopt), "What to do with agents left by a previous run whose session is unknown (adopt or delete)")
+	githubCmd.Flags().String("executor-kubernetes-mode", string(executor.KubernetesModePod), "How kubernetes agents run (pod or job)")
+	githubCmd.Flags().String("executor-service-account", "", "Service account for kubernetes agent pods")
+	githubCmd.Flags().StringToString("executor-node-selector", nil, "Node selector for kubernetes agent pods (e.g. pool=agents)")
+	githubCmd.Flags().StringSlice("executor-image-pull-secrets", nil, "Image pull secrets for kubernetes agent pods")
 
 	if err := viper.BindPFlag("github.port", githubCmd.Flags().Lookup("port")); err != nil {
 		cobra.CheckErr(err)
@@ -57,12 +107,123 @@ func init() {
 	if err := viper.BindPFlag("github.webhook_secret", githubCmd.Flags().Lookup("webhook-secret")); err != nil {
 		cobra.CheckErr(err)
 	}
+	if err := viper.BindPFlag("github.session_store.type", githubCmd.Flags().Lookup("session-store")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.session_store.path", githubCmd.Flags().Lookup("session-store-path")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.session_store.namespace", githubCmd.Flags().Lookup("session-store-namespace")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.session_store.name", githubCmd.Flags().Lookup("session-store-name")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.delivery_cache.size", githubCmd.Flags().Lookup("delivery-cache-size")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.delivery_cache.ttl", githubCmd.Flags().Lookup("delivery-cache-ttl")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.queue.max_concurrency", githubCmd.Flags().Lookup("max-concurrency")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.queue.max_per_repo", githubCmd.Flags().Lookup("max-concurrency-per-repo")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.queue.merge_pending", githubCmd.Flags().Lookup("merge-queued-comments")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.queue.path", githubCmd.Flags().Lookup("queue-path")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.status.update_interval", githubCmd.Flags().Lookup("status-update-interval")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.status.lines", githubCmd.Flags().Lookup("status-lines")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.limits.timeout", githubCmd.Flags().Lookup("execution-timeout")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.limits.max_output_bytes", githubCmd.Flags().Lookup("max-output-bytes")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.limits.max_tokens", githubCmd.Flags().Lookup("max-tokens")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.limits.max_cost", githubCmd.Flags().Lookup("max-cost")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.limits.cost_per_million_tokens", githubCmd.Flags().Lookup("cost-per-million-tokens")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.context.max_tokens", githubCmd.Flags().Lookup("context-max-tokens")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.authz.min_permission", githubCmd.Flags().Lookup("authz-min-permission")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.authz.orgs", githubCmd.Flags().Lookup("authz-orgs")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.authz.teams", githubCmd.Flags().Lookup("authz-teams")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.authz.allow", githubCmd.Flags().Lookup("authz-allow")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.authz.deny", githubCmd.Flags().Lookup("authz-deny")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.type", githubCmd.Flags().Lookup("executor")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.config_dir", githubCmd.Flags().Lookup("executor-config-dir")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.namespace", githubCmd.Flags().Lookup("executor-namespace")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.image", githubCmd.Flags().Lookup("executor-image")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.cpu_limit", githubCmd.Flags().Lookup("executor-cpu-limit")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.memory_limit", githubCmd.Flags().Lookup("executor-memory-limit")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.orphan_policy", githubCmd.Flags().Lookup("executor-orphan-policy")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.kubernetes.mode", githubCmd.Flags().Lookup("executor-kubernetes-mode")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.kubernetes.service_account_name", githubCmd.Flags().Lookup("executor-service-account")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.kubernetes.node_selector", githubCmd.Flags().Lookup("executor-node-selector")); err != nil {
+		cobra.CheckErr(err)
+	}
+	if err := viper.BindPFlag("github.executor.kubernetes.image_pull_secrets", githubCmd.Flags().Lookup("executor-image-pull-secrets")); err != nil {
+		cobra.CheckErr(err)
+	}
 
 	viper.SetDefault("github.port", "8080")
 	viper.SetDefault("github.shutdown_timeout", 30*time.Second)
 	viper.SetDefault("github.app_id", 0)
 	viper.SetDefault("github.private_key_file", "")
 	viper.SetDefault("github.webhook_secret", "")
+	viper.SetDefault("github.session_store.type", string(session.StoreTypeFile))
+	viper.SetDefault("github.delivery_cache.size", dedup.DefaultSize)
+	viper.SetDefault("github.delivery_cache.ttl", dedup.DefaultTTL)
+	viper.SetDefault("github.queue.max_concurrency", 2)
+	viper.SetDefault("github.queue.max_per_repo", 1)
+	viper.SetDefault("github.status.update_interval", progress.DefaultInterval)
+	viper.SetDefault("github.status.lines", progress.DefaultLines)
+	viper.SetDefault("github.authz.min_permission", string(authz.DefaultPermission))
+	viper.SetDefault("github.executor.type", string(executor.ExecutorTypeLocal))
 }
 
 func init() {
@@ -92,8 +253,18 @@ type WebhookServer struct {
 	appID         int64
 	privateKey    *rsa.PrivateKey
 	webhookSecret string
+	apiKey        string // エージェントが LLM に接続するための API キー
 	appSlug       string // GitHub App のスラグ名（@mention で使用される名前）
-	agents        map[string]agent.Agent
+	executor      executor.Executor
+	sessions      session.Store
+	queue         *queue.Queue
+	deliveries    *dedup.Cache // 処理済みの X-GitHub-Delivery
+	status        progress.Options
+	limits        LimitsConfig
+	contextTokens int // 会話の文脈の上限（0 なら渡さない）
+	authz         AuthzConfig
+	agents        map[string]agent.Agent // keyed by session ID
+	agentsMu      sync.Mutex
 }
 
 type Config struct {
@@ -101,7 +272,36 @@ type Config struct {
 	WebhookSecret   string
 	AppID           int64
 	PrivateKeyFile  string
+	APIKey          string // API key of the agents, required
 	ShutdownTimeout time.Duration
+	Executor        executor.ExecutorOptions
+	SessionStore    session.StoreOptions
+	Queue           queue.Options
+	DeliveryCache   DeliveryCacheConfig
+	Status          progress.Options
+	Limits          LimitsConfig
+	ContextTokens   int
+	Authz           AuthzConfig
+}
+
+// LimitsConfig holds the limits of executions and their overrides
+type LimitsConfig struct {
+	Default  agent.Limits
+	Commands map[string]agent.Limits // Keyed by subcommand, e.g. review
+	Repos    map[string]agent.Limits // Keyed by repository full name (owner/name)
+}
+
+// For returns the limits of a command run on the repository. Repository
+// overrides take precedence over command overrides.
+func (c LimitsConfig) For(repoFullName, command string) agent.Limits {
+	// viper lowercases the keys of the config file
+	return c.Default.Merge(c.Commands[command]).Merge(c.Repos[strings.ToLower(repoFullName)])
+}
+
+// DeliveryCacheConfig configures how webhook redeliveries are detected
+type DeliveryCacheConfig struct {
+	Size int
+	TTL  time.Duration
 }
 
 // generateJWT generates a JWT for GitHub App authentication
@@ -145,6 +345,11 @@ func NewWebhookServer(cfg Config) (*WebhookServer, error) {
 	log := logrus.New()
 	log.SetFormatter(&logrus.JSONFormatter{})
 
+	// 起動後にすべての実行が失敗しないよう、ここで確認する
+	if cfg.APIKey == "" {
+		return nil, fmt.Errorf("API key is required: set --api-key, KOMMON_API_KEY or OPENROUTER_API_KEY")
+	}
+
 	// Read private key
 	privateKeyBytes, err := os.ReadFile(cfg.PrivateKeyFile)
 	if err != nil {
@@ -161,17 +366,58 @@ func NewWebhookServer(cfg Config) (*WebhookServer, error) {
 		return nil, fmt.Errorf("failed to parse private key: %v", err)
 	}
 
+	sessions, err := session.NewStore(cfg.SessionStore)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s session store: %v", cfg.SessionStore.Type, err)
+	}
+	knownSessions, err := loadKnownSessions(context.Background(), sessions)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Executor.IsKnownSession = func(id string) bool {
+		return knownSessions[id]
+	}
+
+	agentExecutor, err := executor.NewExecutor(cfg.Executor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s executor: %v", cfg.Executor.Type, err)
+	}
+	if err := agentExecutor.Initialize(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to initialize %s executor: %v", cfg.Executor.Type, err)
+	}
+
 	ws := &WebhookServer{
 		log:           log,
 		appID:         cfg.AppID,
 		privateKey:    privateKey,
 		webhookSecret: cfg.WebhookSecret,
+		apiKey:        cfg.APIKey,
 		server: &http.Server{
 			Addr:              ":" + cfg.Port,
 			Handler:           nil, // 後で設定
 			ReadHeaderTimeout: 10 * time.Second,
 		},
-		agents: make(map[string]agent.Agent),
+		executor:      agentExecutor,
+		sessions:      sessions,
+		deliveries:    dedup.NewCache(cfg.DeliveryCache.Size, cfg.DeliveryCache.TTL),
+		status:        cfg.Status,
+		limits:        cfg.Limits,
+		contextTokens: cfg.ContextTokens,
+		authz:         cfg.Authz,
+		agents:        make(map[string]agent.Agent),
+	}
+
+	if err := ws.rehydrateSessions(context.Background()); err != nil {
+		return nil, err
+	}
+
+	// 再起動前に残っていたジョブもここで読み込まれ、Start 時に再開される
+	ws.queue, err = queue.New(cfg.Queue, ws.runJob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job queue: %v", err)
+	}
+	if jobs := ws.queue.Jobs(); len(jobs) > 0 {
+		log.Infof("Resuming %d queued jobs", len(jobs))
 	}
 
 	// GitHub App の情報を取得
@@ -212,9 +458,18 @@ func (ws *WebhookServer) Start() error {
 		if err := ws.server.Shutdown(ctx); err != nil {
 			ws.log.Fatalf("Could not gracefully shutdown the server: %v\n", err)
 		}
+		// 実行中のジョブは中断され、次回起動時に再開される
+		ws.queue.Stop()
+		if closer, ok := ws.executor.(interface{ Close() error }); ok {
+			if err := closer.Close(); err != nil {
+				ws.log.Errorf("Failed to close executor: %v", err)
+			}
+		}
 		close(done)
 	}()
 
+	ws.queue.Start()
+
 	ws.log.Infof("Server is starting on port%s", ws.server.Addr)
 	if err := ws.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		return fmt.Errorf("could not listen on %s: %v", ws.server.Addr, err)
@@ -238,6 +493,18 @@ func (ws *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// タイムアウトによる再送は処理済みとして 200 を返す。処理に失敗した配信は
+	// 再送で処理できるよう、処理を終えてから記録する
+	deliveryID := github.DeliveryID(r)
+	if deliveryID != "" && ws.deliveries.Contains(deliveryID) {
+		ws.log.WithFields(logrus.Fields{
+			"delivery_id": deliveryID,
+			"event_type":  github.WebHookType(r),
+		}).Info("Skipping duplicate webhook delivery")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	event, err := github.ParseWebHook(github.WebHookType(r), payload)
 	if err != nil {
 		ws.log.Errorf("Error parsing webhook: %v", err)
@@ -257,12 +524,27 @@ func (ws *WebhookServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
 	case *github.IssueCommentEvent:
 		installationID = e.GetInstallation().GetID()
 		ws.handleIssueCommentEvent(r.Context(), e, installationID)
+	case *github.IssuesEvent:
+		ws.handleIssuesEvent(r.Context(), e)
+	case *github.PullRequestReviewCommentEvent:
+		ws.handleReviewCommentEvent(r.Context(), e)
+	case *github.PullRequestReviewEvent:
+		ws.handleReviewEvent(r.Context(), e)
+	case *github.CheckRunEvent:
+		ws.handleCheckRunEvent(r.Context(), e)
+	case *github.WorkflowRunEvent:
+		ws.handleWorkflowRunEvent(r.Context(), e)
+	case *github.CheckSuiteEvent:
+		ws.handleCheckSuiteEvent(r.Context(), e)
 	default:
 		ws.log.WithFields(logrus.Fields{
 			"event_type": github.WebHookType(r),
 		}).Info("Received unhandled event type")
 	}
 
+	if deliveryID != "" {
+		ws.deliveries.Add(deliveryID)
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -293,156 +575,164 @@ func (ws *WebhookServer) handlePushEvent(ctx context.Context, event *github.Push
 	}).Info("Repository details")
 }
 
+// handlePullRequestEvent reviews pull requests when they are opened or
+// updated, if the repository opted in with the pull_request event
 func (ws *WebhookServer) handlePullRequestEvent(ctx context.Context, event *github.PullRequestEvent, installationID int64) {
+	action := event.GetAction()
+	if action != "opened" && action != "synchronize" {
+		return
+	}
+	pr := event.GetPullRequest()
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":      event.GetRepo().GetFullName(),
+		"pr_number": pr.GetNumber(),
+		"action":    action,
+		"sender":    event.GetSender().GetLogin(),
+	})
+	if pr.GetDraft() {
+		log.Info("Skipping review of draft pull request")
+		return
+	}
+
 	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
 	if err != nil {
 		ws.log.Errorf("Failed to get installation client: %v", err)
 		return
 	}
 
-	ws.log.WithFields(logrus.Fields{
-		"repo":      event.GetRepo().GetFullName(),
-		"pr_number": event.GetPullRequest().GetNumber(),
-		"action":    event.GetAction(),
-		"title":     event.GetPullRequest().GetTitle(),
-	}).Info("Received pull request event")
-
-	// Example: Add a comment to the PR
-	if event.GetAction() == "opened" {
-		comment := &github.IssueComment{
-			Body: github.String("Thank you for your contribution! 🎉"),
-		}
-		_, _, err := client.Issues.CreateComment(
-			ctx,
-			event.GetRepo().GetOwner().GetLogin(),
-			event.GetRepo().GetName(),
-			event.GetPullRequest().GetNumber(),
-			comment,
-		)
-		if err != nil {
-			ws.log.Errorf("Failed to create comment: %v", err)
-		}
+	req := commandRequest{
+		repo:           event.GetRepo().GetFullName(),
+		owner:          event.GetRepo().GetOwner().GetLogin(),
+		name:           event.GetRepo().GetName(),
+		issue:          pr.GetNumber(),
+		pullRequest:    true,
+		installationID: installationID,
+		sender:         event.GetSender().GetLogin(),
 	}
-}
 
-func (ws *WebhookServer) kommonCommand(text string) bool {
-
-	// メンションの確認 (@{app-slug} の形式)
-	mentionText := "@" + ws.appSlug
+	// 自動レビューでは Push のたびに投稿しないよう、設定の誤りはログにだけ残す
+	repoCfg, err := loadRepoConfig(ctx, client, req.owner, req.name)
+	if err != nil {
+		log.Errorf("Failed to load repository config: %v", err)
+		return
+	}
+	if !repoCfg.Triggers(repoconfig.EventPullRequest) || !repoCfg.Allows(command.NameReview) {
+		return
+	}
 
-	return strings.HasPrefix(text, "/kommon") || strings.HasPrefix(text, mentionText)
-}
+	// 権限のないユーザーが開いた、または更新したプルリクエストはレビューしない
+	decision, err := ws.checkAuthorization(ctx, client, req)
+	if err != nil || !decision.Allowed {
+		log.Infof("Skipping review of pull request from unauthorized sender: %v %s", err, decision.Reason)
+		return
+	}
 
-func (ws *WebhookServer) handleIssueCommentEvent(ctx context.Context, event *github.IssueCommentEvent, installationID int64) {
-	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	job, err := commandJob(req, &command.Command{Name: command.NameReview})
 	if err != nil {
-		ws.log.Errorf("Failed to get installation client: %v", err)
+		log.Errorf("Failed to build job: %v", err)
 		return
 	}
+	log.Info("Requesting review of pull request")
+	if err := ws.enqueueJob(ctx, client, job, true); err != nil {
+		log.Errorf("Failed to enqueue job: %v", err)
+	}
+}
 
+func (ws *WebhookServer) handleIssueCommentEvent(ctx context.Context, event *github.IssueCommentEvent, installationID int64) {
 	comment := event.GetComment()
 	if comment == nil {
 		return
 	}
 
-	if !ws.kommonCommand(comment.GetBody()) {
+	switch event.GetAction() {
+	case "created":
+	case "deleted":
+		// リクエストしたコメントが削除されたら実行をキャンセルする
+		ws.handleDeletedComment(ctx, event, installationID)
+		return
+	default:
+		// 編集されたコメントでは再実行しない
 		return
 	}
 
-	ws.log.WithFields(logrus.Fields{
-		"repo":       event.GetRepo().GetFullName(),
-		"issue":      event.GetIssue().GetNumber(),
-		"comment_id": comment.GetID(),
-		"comment_by": event.GetSender().GetLogin(),
-		"mentioned":  "@" + ws.appSlug,
-		"comment":    comment.GetBody(),
-	}).Info("Received mention in issue comment")
-
-	// コメントを作成
-	newComment := &github.IssueComment{
-		Body: github.String("実行中です。少々お待ちください..."),
+	// /kommon または @{app-slug} で始まるコメントだけを扱う
+	cmd, ok, parseErr := command.Parse(comment.GetBody(), ws.appSlug)
+	if !ok {
+		return
 	}
 
-	// コメントを投稿
-	_, _, err = client.Issues.CreateComment(
-		ctx,
-		event.GetRepo().GetOwner().GetLogin(),
-		event.GetRepo().GetName(),
-		event.GetIssue().GetNumber(),
-		newComment,
-	)
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
 	if err != nil {
-		ws.log.Errorf("コメントの投稿に失敗しました: %v", err)
+		ws.log.Errorf("Failed to get installation client: %v", err)
 		return
 	}
 
-	// 非同期実行用の新しいコンテキストを作成
-	bgCtx := context.Background()
-
-	go func() {
-		// 非同期処理用の新しいクライアントを作成
-		asyncClient, asyncToken, err := ws.getInstallationClientAndToken(bgCtx, installationID)
-		if err != nil {
-			ws.log.Errorf("Failed to create async client: %v", err)
-			return
-		}
-
-		// エージェントを取得
-		agent := ws.GetAgent(event.GetRepo().GetFullName(), event.GetIssue().GetNumber(), asyncToken)
+	req := commandRequest{
+		repo:           event.GetRepo().GetFullName(),
+		owner:          event.GetRepo().GetOwner().GetLogin(),
+		name:           event.GetRepo().GetName(),
+		issue:          event.GetIssue().GetNumber(),
+		pullRequest:    event.GetIssue().IsPullRequest(),
+		installationID: installationID,
+		commentID:      comment.GetID(),
+		sender:         event.GetSender().GetLogin(),
+	}
 
-		// コマンドを実行
-		output, err := agent.Execute(bgCtx, comment.GetBody())
+	// 権限のないユーザーのリクエストは実行しない
+	if !ws.authorize(ctx, client, req) {
+		return
+	}
 
-		// 結果に応じてコメントを作成
-		var resultComment *github.IssueComment
-		if err != nil {
-			ws.log.Errorf("Failed to execute prompt: %v", err)
-			resultComment = &github.IssueComment{
-				Body: github.String(fmt.Sprintf("コマンドの実行中にエラーが発生しました: %v", err)),
-			}
-		} else {
-			resultComment = &github.IssueComment{
-				Body: github.String(fmt.Sprintf("実行が完了しました:\n```\n%s\n```", output)),
-			}
-		}
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":       req.repo,
+		"issue":      req.issue,
+		"comment_id": req.commentID,
+		"comment_by": req.sender,
+		"mentioned":  "@" + ws.appSlug,
+		"comment":    comment.GetBody(),
+	})
 
-		// 結果をコメントとして投稿
-		_, _, commentErr := asyncClient.Issues.CreateComment(
-			bgCtx,
-			event.GetRepo().GetOwner().GetLogin(),
-			event.GetRepo().GetName(),
-			event.GetIssue().GetNumber(),
-			resultComment,
-		)
-		if commentErr != nil {
-			ws.log.Errorf("実行結果のコメント投稿に失敗しました: %v", commentErr)
-			return
-		}
+	repoCfg, err := loadRepoConfig(ctx, client, req.owner, req.name)
+	if err != nil {
+		log.Errorf("Failed to load repository config: %v", err)
+		ws.reply(ctx, client, req, repoConfigErrorReply(err))
+		return
+	}
+	if !repoCfg.Triggers(repoconfig.EventIssueComment) {
+		log.Info("Issue comments don't trigger kommon in this repository")
+		return
+	}
 
-		ws.log.Info("Successfully executed command and posted results")
-	}()
+	if parseErr != nil {
+		log.Infof("Failed to parse command: %v", parseErr)
+		ws.reply(ctx, client, req, ws.parseErrorReply(parseErr))
+		return
+	}
+	log.WithField("command", cmd.Name).Info("Received command in issue comment")
 
-	ws.log.Info("Started async command execution")
+	ws.handleCommand(ctx, client, req, cmd, repoCfg)
 }
 
-func sessionID(repoFullName string, issueNumber int) string {
-	return fmt.Sprintf("%s-%d", repoFullName, issueNumber)
-}
+func (ws *WebhookServer) handleIssuesEvent(ctx context.Context, event *github.IssuesEvent) {
+	switch event.GetAction() {
+	case "labeled", "assigned":
+		ws.handleIssueTrigger(ctx, event)
+		return
+	case "closed":
+	default:
+		return
+	}
 
-func (ws *WebhookServer) GetAgent(repoFullName string, issueNumber int, installationToken string) agent.Agent {
-	if _, ok := ws.agents[sessionID(repoFullName, issueNumber)]; !ok {
-		ws.agents[sessionID(repoFullName, issueNumber)] = &agent.GooseAgent{
-			Opts: agent.GooseOptions{
-				SessionID:   sessionID(repoFullName, issueNumber),
-				APIType:     agent.GooseAPITypeOpenRouter,
-				APIKey:      installationToken,
-				Instruction: "You are a helpful assistant that can answer questions and help with tasks.",
-			},
-			Repo:              repoFullName,
-			InstallationToken: installationToken,
-		}
+	// Issue がクローズされたらセッションのエージェントを破棄する
+	if err := ws.DestroyAgent(ctx, event.GetRepo().GetFullName(), event.GetIssue().GetNumber()); err != nil {
+		ws.log.Errorf("Failed to destroy agent: %v", err)
+		return
 	}
-	return ws.agents[sessionID(repoFullName, issueNumber)]
+
+	ws.log.WithFields(logrus.Fields{
+		"repo":  event.GetRepo().GetFullName(),
+		"issue": event.GetIssue().GetNumber(),
+	}).Info("Destroyed agent for closed issue")
 }
 
 func runServe(cmd *cobra.Command, args []string) error {
@@ -452,7 +742,111 @@ func runServe(cmd *cobra.Command, args []string) error {
 		WebhookSecret:   viper.GetString("github.webhook_secret"),
 		AppID:           viper.GetInt64("github.app_id"),
 		PrivateKeyFile:  viper.GetString("github.private_key_file"),
+		APIKey:          viper.GetString("api_key"),
 		ShutdownTimeout: viper.GetDuration("github.shutdown_timeout"),
+		Executor: executor.ExecutorOptions{
+			Type:         executor.ExecutorType(viper.GetString("github.executor.type")),
+			ConfigDir:    viper.GetString("github.executor.config_dir"),
+			Namespace:    viper.GetString("github.executor.namespace"),
+			OrphanPolicy: executor.OrphanPolicy(viper.GetString("github.executor.orphan_policy")),
+			Resources: &executor.ResourceRequirements{
+				Image:       viper.GetString("github.executor.image"),
+				CPULimit:    viper.GetString("github.executor.cpu_limit"),
+				MemoryLimit: viper.GetString("github.executor.memory_limit"),
+			},
+		},
+	}
+
+	cfg.SessionStore = session.StoreOptions{
+		Type:      session.StoreType(viper.GetString("github.session_store.type")),
+		Path:      viper.GetString("github.session_store.path"),
+		Namespace: viper.GetString("github.session_store.namespace"),
+		Name:      viper.GetString("github.session_store.name"),
+	}
+	if cfg.SessionStore.Path == "" && viper.GetString("data_dir") != "" {
+		cfg.SessionStore.Path = filepath.Join(viper.GetString("data_dir"), "sessions.json")
+	}
+
+	cfg.DeliveryCache = DeliveryCacheConfig{
+		Size: viper.GetInt("github.delivery_cache.size"),
+		TTL:  viper.GetDuration("github.delivery_cache.ttl"),
+	}
+
+	cfg.Status = progress.Options{
+		Interval: viper.GetDuration("github.status.update_interval"),
+		Lines:    viper.GetInt("github.status.lines"),
+	}
+
+	cfg.Queue = queue.Options{
+		MaxConcurrency: viper.GetInt("github.queue.max_concurrency"),
+		MaxPerRepo:     viper.GetInt("github.queue.max_per_repo"),
+		Path:           viper.GetString("github.queue.path"),
+		MergePending:   viper.GetBool("github.queue.merge_pending"),
+	}
+	if cfg.Queue.Path == "" && viper.GetString("data_dir") != "" {
+		cfg.Queue.Path = filepath.Join(viper.GetString("data_dir"), "queue.json")
+	}
+
+	cfg.Limits = LimitsConfig{
+		Default: agent.Limits{
+			Timeout:        viper.GetDuration("github.limits.timeout"),
+			MaxOutputBytes: viper.GetInt64("github.limits.max_output_bytes"),
+			MaxTokens:      viper.GetInt64("github.limits.max_tokens"),
+			MaxCost:        viper.GetFloat64("github.limits.max_cost"),
+			CostPerMTokens: viper.GetFloat64("github.limits.cost_per_million_tokens"),
+		},
+	}
+	// Overrides per command and per repository can only be set from the config file
+	useJSONTags := func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "json"
+	}
+	if err := viper.UnmarshalKey("github.limits.commands", &cfg.Limits.Commands, useJSONTags); err != nil {
+		return fmt.Errorf("failed to parse command limits: %v", err)
+	}
+	if err := viper.UnmarshalKey("github.limits.repos", &cfg.Limits.Repos, useJSONTags); err != nil {
+		return fmt.Errorf("failed to parse repository limits: %v", err)
+	}
+
+	cfg.ContextTokens = viper.GetInt("github.context.max_tokens")
+
+	cfg.Authz = AuthzConfig{
+		Default: authz.Policy{
+			MinPermission: authz.Permission(viper.GetString("github.authz.min_permission")),
+			Orgs:          viper.GetStringSlice("github.authz.orgs"),
+			Teams:         viper.GetStringSlice("github.authz.teams"),
+			Allow:         viper.GetStringSlice("github.authz.allow"),
+			Deny:          viper.GetStringSlice("github.authz.deny"),
+		},
+	}
+	// Overrides per repository can only be set from the config file
+	if err := viper.UnmarshalKey("github.authz.repos", &cfg.Authz.Repos, useJSONTags); err != nil {
+		return fmt.Errorf("failed to parse repository authorization policies: %v", err)
+	}
+	if err := cfg.Authz.Validate(); err != nil {
+		return fmt.Errorf("invalid authorization policy: %v", err)
+	}
+
+	// Tolerations can only be set from the config file
+	var tolerations []corev1.Toleration
+	if err := viper.UnmarshalKey("github.executor.kubernetes.tolerations", &tolerations); err != nil {
+		return fmt.Errorf("failed to parse executor tolerations: %v", err)
+	}
+	var jobOptions *executor.JobOptions
+	if viper.IsSet("github.executor.kubernetes.job") {
+		jobOptions = &executor.JobOptions{}
+		if err := viper.UnmarshalKey("github.executor.kubernetes.job", jobOptions, func(dc *mapstructure.DecoderConfig) {
+			dc.TagName = "json"
+		}); err != nil {
+			return fmt.Errorf("failed to parse executor job options: %v", err)
+		}
+	}
+	cfg.Executor.Kubernetes = &executor.KubernetesOptions{
+		Mode:               executor.KubernetesMode(viper.GetString("github.executor.kubernetes.mode")),
+		Job:                jobOptions,
+		ServiceAccountName: viper.GetString("github.executor.kubernetes.service_account_name"),
+		NodeSelector:       viper.GetStringMapString("github.executor.kubernetes.node_selector"),
+		Tolerations:        tolerations,
+		ImagePullSecrets:   viper.GetStringSlice("github.executor.kubernetes.image_pull_secrets"),
 	}
 
 	// If values are not set, try to get them from root-level environment variables
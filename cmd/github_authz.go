@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/authz"
+)
+
+// AuthzConfig holds who may invoke kommon and the overrides per repository
+type AuthzConfig struct {
+	Default authz.Policy
+	Repos   map[string]authz.Policy // Keyed by repository full name (owner/name)
+}
+
+// For returns the policy of the repository
+func (c AuthzConfig) For(repoFullName string) authz.Policy {
+	// viper lowercases the keys of the config file
+	return c.Default.Merge(c.Repos[strings.ToLower(repoFullName)])
+}
+
+// Validate checks the default policy and every override
+func (c AuthzConfig) Validate() error {
+	if err := c.Default.Validate(); err != nil {
+		return err
+	}
+	for repo, policy := range c.Repos {
+		if err := policy.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", repo, err)
+		}
+	}
+	return nil
+}
+
+// githubDirectory looks up users with an installation client
+type githubDirectory struct {
+	client *github.Client
+}
+
+// Permission returns the role of the user on the repository. The permission
+// field of the API only knows admin, write and read, so role_name is used to
+// tell maintain and triage apart.
+func (d githubDirectory) Permission(ctx context.Context, owner, repo, user string) (authz.Permission, error) {
+	req, err := d.client.NewRequest(http.MethodGet, fmt.Sprintf("repos/%s/%s/collaborators/%s/permission", owner, repo, user), nil)
+	if err != nil {
+		return "", err
+	}
+	var level struct {
+		Permission string `json:"permission"`
+		RoleName   string `json:"role_name"`
+	}
+	if _, err := d.client.Do(ctx, req, &level); err != nil {
+		return "", err
+	}
+	if permission, err := authz.ParsePermission(level.RoleName); err == nil {
+		return permission, nil
+	}
+	// Custom roles are based on one of the permissions
+	return authz.Permission(level.Permission), nil
+}
+
+func (d githubDirectory) IsOrgMember(ctx context.Context, org, user string) (bool, error) {
+	member, _, err := d.client.Organizations.IsMember(ctx, org, user)
+	return member, err
+}
+
+func (d githubDirectory) IsTeamMember(ctx context.Context, org, team, user string) (bool, error) {
+	membership, resp, err := d.client.Teams.GetTeamMembershipBySlug(ctx, org, team, user)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return membership.GetState() == "active", nil
+}
+
+// checkAuthorization applies the policy of the repository to the sender of
+// the request
+func (ws *WebhookServer) checkAuthorization(ctx context.Context, client *github.Client, req commandRequest) (authz.Decision, error) {
+	return ws.authz.For(req.repo).Authorize(ctx, githubDirectory{client: client}, req.owner, req.name, req.sender)
+}
+
+// authorize reports whether the sender of the request may invoke kommon.
+// Refused requests get a reaction and a reply explaining it.
+func (ws *WebhookServer) authorize(ctx context.Context, client *github.Client, req commandRequest) bool {
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":   req.repo,
+		"issue":  req.issue,
+		"sender": req.sender,
+	})
+
+	decision, err := ws.checkAuthorization(ctx, client, req)
+	if err != nil {
+		// 確認できない場合は実行しない
+		log.Errorf("Failed to authorize sender: %v", err)
+		decision = authz.Decision{Reason: err.Error()}
+	}
+	if decision.Allowed {
+		log.Debugf("Authorized sender: %s", decision.Reason)
+		return true
+	}
+	log.Warnf("Refused request from unauthorized sender: %s", decision.Reason)
+
+	var reactionErr error
+	switch {
+	case req.commentID != 0:
+		_, _, reactionErr = client.Reactions.CreateIssueCommentReaction(ctx, req.owner, req.name, req.commentID, "-1")
+	case req.reviewCommentID != 0:
+		_, _, reactionErr = client.Reactions.CreatePullRequestCommentReaction(ctx, req.owner, req.name, req.reviewCommentID, "-1")
+	}
+	if reactionErr != nil {
+		log.Errorf("Failed to add reaction: %v", reactionErr)
+	}
+	if err != nil {
+		ws.reply(ctx, client, req, fmt.Sprintf("申し訳ありません、@%s さんの権限を確認できなかったため実行しませんでした。しばらくしてからもう一度お試しください。", req.sender))
+	} else {
+		ws.reply(ctx, client, req, fmt.Sprintf("申し訳ありません、@%s さんにはこのリポジトリで kommon を実行する権限がありません。必要な場合はリポジトリの管理者にご相談ください。", req.sender))
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/takutakahashi/kommon/pkg/queue"
+)
+
+// workBranch is the branch a job commits to
+type workBranch struct {
+	name        string
+	headRepo    string // Fork (owner/name) the branch belongs to, if any
+	pullRequest bool   // The branch is the head of the pull request the job runs on
+}
+
+// resolveWorkBranch decides where the job commits. A job on a pull request
+// works on its head branch, including the branch of a fork that allows
+// edits from maintainers. A job on an issue works on the branch of its
+// session, so that follow-up requests update the same pull request. A
+// branch requested with --branch always wins.
+func (ws *WebhookServer) resolveWorkBranch(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job) (*workBranch, error) {
+	if job.Branch != "" {
+		return &workBranch{name: job.Branch}, nil
+	}
+
+	issue, _, err := client.Issues.Get(ctx, owner, repo, job.Issue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issue: %v", err)
+	}
+	if !issue.IsPullRequest() {
+		generation, err := ws.sessionGeneration(ctx, job.Repo, job.Issue)
+		if err != nil {
+			return nil, err
+		}
+		return &workBranch{name: sessionBranch(job.Issue, generation)}, nil
+	}
+
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, job.Issue)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pull request: %v", err)
+	}
+	head := pr.GetHead()
+	branch := &workBranch{name: head.GetRef(), pullRequest: true}
+	if head.GetRepo() == nil {
+		return nil, fmt.Errorf("プルリクエストのフォーク %s が削除されているため、ブランチ %s に Push できません", head.GetLabel(), head.GetRef())
+	}
+	if headRepo := head.GetRepo().GetFullName(); !strings.EqualFold(headRepo, job.Repo) {
+		// フォークには「Allow edits by maintainers」が有効な場合だけ Push できる
+		if !pr.GetMaintainerCanModify() {
+			return nil, fmt.Errorf("フォーク %s のブランチ %s への編集が許可されていないため Push できません（プルリクエストの「Allow edits by maintainers」を有効にしてください）", headRepo, head.GetRef())
+		}
+		branch.headRepo = headRepo
+	}
+	return branch, nil
+}
+
+// instructions tells the agent where to commit and whether to open a pull
+// request. baseBranch is the branch pull requests target, if configured.
+func (b *workBranch) instructions(baseBranch string) string {
+	if b.pullRequest {
+		text := fmt.Sprintf("このプルリクエストのブランチ `%s` をチェックアウトしています。変更はこのブランチにコミットして Push してください。新しいブランチやプルリクエストは作成しないでください。", b.name)
+		if b.headRepo != "" {
+			owner, _, _ := strings.Cut(b.headRepo, "/")
+			text += fmt.Sprintf("\nこのブランチはフォーク `%s` のもので、ローカルでは `%s/%s` としてチェックアウトしています。`git push` でフォークに Push されます。", b.headRepo, owner, b.name)
+		}
+		return text
+	}
+
+	target := ""
+	if baseBranch != "" {
+		target = fmt.Sprintf("`%s` ブランチに向けて", baseBranch)
+	}
+	return fmt.Sprintf("ブランチ `%s` をチェックアウトしています。変更はこのブランチにコミットして Push してください。このブランチのプルリクエストがまだない場合は%s作成し、既にある場合は新しいプルリクエストを作成せずに Push だけしてください。", b.name, target)
+}
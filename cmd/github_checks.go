@@ -0,0 +1,267 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/progress"
+	"github.com/takutakahashi/kommon/pkg/queue"
+)
+
+const (
+	checkRunName = "kommon"
+
+	checkActionRerun  = "rerun"
+	checkActionCancel = "cancel"
+
+	// GitHub rejects check run output text longer than 65535 characters
+	maxCheckRunText = 60000
+)
+
+var (
+	rerunAction = &github.CheckRunAction{
+		Label:       "Re-run",
+		Description: "同じリクエストを再実行します",
+		Identifier:  checkActionRerun,
+	}
+	cancelAction = &github.CheckRunAction{
+		Label:       "Cancel",
+		Description: "実行をキャンセルします",
+		Identifier:  checkActionCancel,
+	}
+)
+
+// checkRunExternalID identifies the job and the comment that requested it,
+// so that the run can be canceled or started again from the check run
+func checkRunExternalID(job *queue.Job) string {
+	return fmt.Sprintf("%s:%d:%d", job.ID, job.Issue, job.CommentID)
+}
+
+func parseCheckRunExternalID(externalID string) (jobID string, issue int, commentID int64, err error) {
+	parts := strings.Split(externalID, ":")
+	if len(parts) != 3 {
+		return "", 0, 0, fmt.Errorf("invalid check run external ID: %s", externalID)
+	}
+	if issue, err = strconv.Atoi(parts[1]); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid issue in check run external ID %s: %v", externalID, err)
+	}
+	if commentID, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+		return "", 0, 0, fmt.Errorf("invalid comment in check run external ID %s: %v", externalID, err)
+	}
+	return parts[0], issue, commentID, nil
+}
+
+// createCheckRun creates a queued check run on the head commit of the pull request
+func (ws *WebhookServer) createCheckRun(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job) (int64, error) {
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, job.Issue)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get pull request: %v", err)
+	}
+
+	checkRun, _, err := client.Checks.CreateCheckRun(ctx, owner, repo, github.CreateCheckRunOptions{
+		Name:       checkRunName,
+		HeadSHA:    pr.GetHead().GetSHA(),
+		ExternalID: github.String(checkRunExternalID(job)),
+		Status:     github.String("queued"),
+		Output: &github.CheckRunOutput{
+			Title:   github.String("実行待ち"),
+			Summary: github.String(checkRunSummary(job, "")),
+		},
+		Actions: []*github.CheckRunAction{cancelAction},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create check run: %v", err)
+	}
+	return checkRun.GetID(), nil
+}
+
+// startCheckRun moves the check run of the job to in_progress
+func (ws *WebhookServer) startCheckRun(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job) error {
+	_, _, err := client.Checks.UpdateCheckRun(ctx, owner, repo, job.CheckRunID, github.UpdateCheckRunOptions{
+		Name:   checkRunName,
+		Status: github.String("in_progress"),
+		Output: &github.CheckRunOutput{
+			Title:   github.String("実行中"),
+			Summary: github.String(checkRunSummary(job, "")),
+		},
+		Actions: []*github.CheckRunAction{cancelAction},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update check run: %v", err)
+	}
+	return nil
+}
+
+// completeCheckRun completes the check run of the job with the conclusion
+// matching the phase and the end of the output as logs
+func (ws *WebhookServer) completeCheckRun(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job, phase progress.Phase, output string, execErr error) error {
+	conclusion, title := "success", "完了"
+	switch phase {
+	case progress.PhaseFailed:
+		conclusion, title = "failure", "失敗"
+	case progress.PhaseCanceled:
+		conclusion, title = "cancelled", "キャンセル"
+	case progress.PhaseLimitExceeded:
+		conclusion, title = "failure", "上限超過"
+		var limitErr *agent.LimitError
+		if errors.As(execErr, &limitErr) && limitErr.Limit == agent.LimitTimeout {
+			conclusion = "timed_out"
+		}
+	}
+
+	detail := ""
+	if execErr != nil {
+		detail = fmt.Sprintf("**エラー**: %v", execErr)
+	}
+
+	opts := github.UpdateCheckRunOptions{
+		Name:        checkRunName,
+		Status:      github.String("completed"),
+		Conclusion:  github.String(conclusion),
+		CompletedAt: &github.Timestamp{Time: time.Now()},
+		Output: &github.CheckRunOutput{
+			Title:   github.String(title),
+			Summary: github.String(checkRunSummary(job, detail)),
+		},
+	}
+	// 再実行はリクエストした Issue コメントを読み直すため、コメントがない場合は出さない
+	if job.CommentID != 0 {
+		opts.Actions = []*github.CheckRunAction{rerunAction}
+	}
+	if output != "" {
+		opts.Output.Text = github.String(progress.CodeBlock("", progress.Truncate(output, maxCheckRunText)))
+	}
+
+	if _, _, err := client.Checks.UpdateCheckRun(ctx, owner, repo, job.CheckRunID, opts); err != nil {
+		return fmt.Errorf("failed to update check run: %v", err)
+	}
+	return nil
+}
+
+// checkRunSummary describes the request in the check run output
+func checkRunSummary(job *queue.Job, detail string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "@%s のリクエスト (#%d)\n\n", job.Sender, job.Issue)
+	for _, line := range strings.Split(progress.Truncate(job.Prompt, 2000), "\n") {
+		fmt.Fprintf(&b, "> %s\n", line)
+	}
+	if detail != "" {
+		fmt.Fprintf(&b, "\n%s\n", detail)
+	}
+	return b.String()
+}
+
+// handleCheckRunEvent handles the Re-run and Cancel buttons of kommon check runs
+func (ws *WebhookServer) handleCheckRunEvent(ctx context.Context, event *github.CheckRunEvent) {
+	if event.GetAction() != "requested_action" || event.GetCheckRun().GetName() != checkRunName {
+		return
+	}
+
+	jobID, issue, commentID, err := parseCheckRunExternalID(event.GetCheckRun().GetExternalID())
+	if err != nil {
+		ws.log.Errorf("Failed to handle check run action: %v", err)
+		return
+	}
+
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":         event.GetRepo().GetFullName(),
+		"issue":        issue,
+		"job_id":       jobID,
+		"check_run_id": event.GetCheckRun().GetID(),
+		"action":       event.GetRequestedAction().Identifier,
+		"requested_by": event.GetSender().GetLogin(),
+	})
+	log.Info("Received check run action")
+
+	installationID := event.GetInstallation().GetID()
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	if err != nil {
+		log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	owner := event.GetRepo().GetOwner().GetLogin()
+	repo := event.GetRepo().GetName()
+	req := commandRequest{
+		repo:           event.GetRepo().GetFullName(),
+		owner:          owner,
+		name:           repo,
+		issue:          issue,
+		pullRequest:    true,
+		installationID: installationID,
+		sender:         event.GetSender().GetLogin(),
+	}
+	// ボタンを押したユーザーの権限を確認する（元のコメントにはリアクションしない）
+	if !ws.authorize(ctx, client, req) {
+		return
+	}
+
+	switch event.GetRequestedAction().Identifier {
+	case checkActionCancel:
+		err := ws.cancelJob(ctx, client, jobID)
+		switch {
+		case errors.Is(err, queue.ErrNotFound):
+			log.Info("Job already finished")
+		case err != nil:
+			log.Errorf("Failed to cancel job: %v", err)
+		}
+	case checkActionRerun:
+		// リクエストしたコメントの最新の内容で再実行する
+		comment, _, err := client.Issues.GetComment(ctx, owner, repo, commentID)
+		if err != nil {
+			log.Errorf("Failed to get the requesting comment: %v", err)
+			return
+		}
+
+		cmd, ok, err := command.Parse(comment.GetBody(), ws.appSlug)
+		if !ok || err != nil {
+			log.Errorf("Failed to parse the requesting comment: %v", err)
+			return
+		}
+		req.commentID = commentID
+
+		repoCfg, err := loadRepoConfig(ctx, client, owner, repo)
+		if err != nil {
+			log.Errorf("Failed to load repository config: %v", err)
+			ws.reply(ctx, client, req, repoConfigErrorReply(err))
+			return
+		}
+		ws.handleCommand(ctx, client, req, cmd, repoCfg)
+	}
+}
+
+// cancelJob cancels the job. A queued job is reported as canceled right
+// away; a running job reports it once the agent stops. It returns
+// queue.ErrNotFound when the job already finished.
+func (ws *WebhookServer) cancelJob(ctx context.Context, client *github.Client, jobID string) error {
+	job, err := ws.queue.Cancel(jobID)
+	if err != nil {
+		return err
+	}
+	if job.Status == queue.StatusRunning {
+		return nil
+	}
+
+	owner, repo, err := splitRepoFullName(job.Repo)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	body := progress.Render(progress.State{Phase: progress.PhaseCanceled, StartedAt: now, FinishedAt: now}, now)
+	if err := editStatusComment(ctx, client, owner, repo, job, job.StatusCommentID, body); err != nil {
+		return err
+	}
+	if job.CheckRunID != 0 {
+		return ws.completeCheckRun(ctx, client, owner, repo, job, progress.PhaseCanceled, "", nil)
+	}
+	return nil
+}
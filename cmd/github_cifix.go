@@ -0,0 +1,293 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/cifix"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+)
+
+const (
+	// maxJobLogDownload bounds the part of a job log that is read; only its
+	// end is given to the agent
+	maxJobLogDownload = 10 << 20
+	// maxCIFailures is the number of failed jobs whose logs are fetched
+	maxCIFailures = 5
+)
+
+// ciFailure is a failed workflow run or check suite of a commit
+type ciFailure struct {
+	event          repoconfig.Event
+	repo           *github.Repository
+	installationID int64
+	headSHA        string
+	pullRequests   []*github.PullRequest
+	workflowRunID  int64 // Failed workflow run, for workflow_run
+	checkSuiteID   int64 // Failed check suite, for check_suite
+	actions        bool  // The check suite belongs to GitHub Actions, whose job logs can be downloaded
+}
+
+// failedConclusions are the conclusions of CI that kommon tries to fix
+var failedConclusions = map[string]bool{"failure": true, "timed_out": true}
+
+// handleWorkflowRunEvent starts a fix when a workflow fails on a pull request
+// opened by kommon
+func (ws *WebhookServer) handleWorkflowRunEvent(ctx context.Context, event *github.WorkflowRunEvent) {
+	run := event.GetWorkflowRun()
+	if event.GetAction() != "completed" || !failedConclusions[run.GetConclusion()] {
+		return
+	}
+	ws.handleCIFailure(ctx, ciFailure{
+		event:          repoconfig.EventWorkflowRun,
+		repo:           event.GetRepo(),
+		installationID: event.GetInstallation().GetID(),
+		headSHA:        run.GetHeadSHA(),
+		pullRequests:   run.PullRequests,
+		workflowRunID:  run.GetID(),
+	})
+}
+
+// handleCheckSuiteEvent starts a fix when a check suite fails on a pull
+// request opened by kommon
+func (ws *WebhookServer) handleCheckSuiteEvent(ctx context.Context, event *github.CheckSuiteEvent) {
+	suite := event.GetCheckSuite()
+	if event.GetAction() != "completed" || !failedConclusions[suite.GetConclusion()] {
+		return
+	}
+	// kommon 自身の Check Run の失敗では修正しない
+	if suite.GetApp().GetSlug() == ws.appSlug {
+		return
+	}
+	ws.handleCIFailure(ctx, ciFailure{
+		event:          repoconfig.EventCheckSuite,
+		repo:           event.GetRepo(),
+		installationID: event.GetInstallation().GetID(),
+		headSHA:        suite.GetHeadSHA(),
+		pullRequests:   suite.PullRequests,
+		checkSuiteID:   suite.GetID(),
+		actions:        suite.GetApp().GetSlug() == "github-actions",
+	})
+}
+
+// handleCIFailure enqueues a fix of the failure with the failed job logs, or
+// posts a summary once the pull request ran out of attempts. Only pull
+// requests opened by kommon in repositories that opted in are fixed.
+func (ws *WebhookServer) handleCIFailure(ctx context.Context, failure ciFailure) {
+	if len(failure.pullRequests) == 0 {
+		return
+	}
+	owner, name := failure.repo.GetOwner().GetLogin(), failure.repo.GetName()
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":     failure.repo.GetFullName(),
+		"event":    failure.event,
+		"head_sha": failure.headSHA,
+	})
+
+	client, _, err := ws.getInstallationClientAndToken(ctx, failure.installationID)
+	if err != nil {
+		log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	// 自動修正では失敗のたびに投稿しないよう、設定の誤りはログにだけ残す
+	repoCfg, err := loadRepoConfig(ctx, client, owner, name)
+	if err != nil {
+		log.Errorf("Failed to load repository config: %v", err)
+		return
+	}
+	if !repoCfg.Triggers(failure.event) || !repoCfg.Allows(command.NameRun) {
+		return
+	}
+
+	for _, ref := range failure.pullRequests {
+		pr, _, err := client.PullRequests.Get(ctx, owner, name, ref.GetNumber())
+		if err != nil {
+			log.Errorf("Failed to get pull request #%d: %v", ref.GetNumber(), err)
+			continue
+		}
+		// 古いコミットの CI や、kommon が作成していないプルリクエストは対象外
+		if pr.GetState() != "open" || pr.GetHead().GetSHA() != failure.headSHA || !ws.isAppBot(pr.GetUser().GetLogin()) {
+			continue
+		}
+		ws.fixCI(ctx, log.WithField("pr_number", pr.GetNumber()), client, failure, pr, repoCfg)
+	}
+}
+
+// fixCI enqueues the next fix of the failed CI of the pull request
+func (ws *WebhookServer) fixCI(ctx context.Context, log *logrus.Entry, client *github.Client, failure ciFailure, pr *github.PullRequest, repoCfg *repoconfig.Config) {
+	owner, name := failure.repo.GetOwner().GetLogin(), failure.repo.GetName()
+	req := commandRequest{
+		repo:           failure.repo.GetFullName(),
+		owner:          owner,
+		name:           name,
+		issue:          pr.GetNumber(),
+		pullRequest:    true,
+		installationID: failure.installationID,
+		sender:         ws.appSlug + "[bot]",
+	}
+
+	// 試行回数はセッションに記録するため、最初の修正の前にセッションを作成する
+	if err := ws.createSession(ctx, req.repo, req.issue, req.installationID); err != nil {
+		log.Errorf("Failed to create session: %v", err)
+		return
+	}
+	attempt, err := ws.recordCIFixAttempt(ctx, req.repo, req.issue, failure.headSHA)
+	if err != nil {
+		log.Errorf("Failed to record CI fix attempt: %v", err)
+		return
+	}
+	maxAttempts := repoCfg.MaxCIFixAttempts()
+	switch {
+	case attempt == 0:
+		log.Info("A fix of the failed CI of this commit was already started")
+		return
+	case attempt > maxAttempts+1:
+		log.Info("Gave up fixing the failed CI of the pull request")
+		return
+	}
+
+	failures, err := ws.collectCIFailures(ctx, client, owner, name, failure)
+	if err != nil {
+		// ログがなくても修正は試みる
+		log.Warnf("Failed to collect the failed jobs: %v", err)
+	}
+
+	if attempt > maxAttempts {
+		log.Infof("Stopping CI fixes after %d attempts", maxAttempts)
+		ws.reply(ctx, client, req, cifix.Summary(maxAttempts, failures))
+		return
+	}
+
+	job, err := commandJob(req, &command.Command{
+		Name:   command.NameRun,
+		Prompt: cifix.Prompt(failure.headSHA, attempt, maxAttempts, failures, cifix.DefaultMaxLogBytes),
+	})
+	if err != nil {
+		log.Errorf("Failed to build job: %v", err)
+		return
+	}
+	log.Infof("Requesting fix %d/%d of the failed CI", attempt, maxAttempts)
+	if err := ws.enqueueJob(ctx, client, job, true); err != nil {
+		log.Errorf("Failed to enqueue job: %v", err)
+	}
+}
+
+// collectCIFailures returns the failed jobs of the failure with their logs.
+// Check suites of other CI services give the output of their check runs.
+func (ws *WebhookServer) collectCIFailures(ctx context.Context, client *github.Client, owner, repo string, failure ciFailure) ([]cifix.Failure, error) {
+	runIDs := []int64{failure.workflowRunID}
+	if failure.checkSuiteID != 0 {
+		if !failure.actions {
+			return checkSuiteFailures(ctx, client, owner, repo, failure.checkSuiteID)
+		}
+		runs, _, err := client.Actions.ListRepositoryWorkflowRuns(ctx, owner, repo, &github.ListWorkflowRunsOptions{
+			CheckSuiteID: failure.checkSuiteID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list workflow runs: %v", err)
+		}
+		runIDs = runIDs[:0]
+		for _, run := range runs.WorkflowRuns {
+			runIDs = append(runIDs, run.GetID())
+		}
+	}
+
+	var failures []cifix.Failure
+	for _, runID := range runIDs {
+		jobs, _, err := client.Actions.ListWorkflowJobs(ctx, owner, repo, runID, &github.ListWorkflowJobsOptions{
+			Filter:      "latest",
+			ListOptions: github.ListOptions{PerPage: 100},
+		})
+		if err != nil {
+			return failures, fmt.Errorf("failed to list workflow jobs: %v", err)
+		}
+		for _, job := range jobs.Jobs {
+			if !failedConclusions[job.GetConclusion()] || len(failures) >= maxCIFailures {
+				continue
+			}
+			f := cifix.Failure{Name: job.GetName(), URL: job.GetHTMLURL()}
+			if workflow := job.GetWorkflowName(); workflow != "" {
+				f.Name = workflow + " / " + f.Name
+			}
+			for _, step := range job.Steps {
+				if failedConclusions[step.GetConclusion()] {
+					f.Steps = append(f.Steps, step.GetName())
+				}
+			}
+			// ログが取得できない場合も、ジョブとステップの名前は渡す
+			f.Log, _ = downloadJobLog(ctx, client, owner, repo, job.GetID())
+			failures = append(failures, f)
+		}
+	}
+	return failures, nil
+}
+
+// checkSuiteFailures returns the failed check runs of the suite with their
+// output
+func checkSuiteFailures(ctx context.Context, client *github.Client, owner, repo string, suiteID int64) ([]cifix.Failure, error) {
+	runs, _, err := client.Checks.ListCheckRunsCheckSuite(ctx, owner, repo, suiteID, &github.ListCheckRunsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list check runs: %v", err)
+	}
+	var failures []cifix.Failure
+	for _, run := range runs.CheckRuns {
+		if !failedConclusions[run.GetConclusion()] || len(failures) >= maxCIFailures {
+			continue
+		}
+		output := run.GetOutput()
+		var parts []string
+		for _, part := range []string{output.GetTitle(), output.GetSummary(), output.GetText()} {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
+		}
+		failures = append(failures, cifix.Failure{
+			Name: run.GetName(),
+			URL:  run.GetHTMLURL(),
+			Log:  strings.Join(parts, "\n\n"),
+		})
+	}
+	return failures, nil
+}
+
+// downloadJobLog reads the log of the workflow job. The log is served from a
+// temporary URL, which must not get the installation token.
+func downloadJobLog(ctx context.Context, client *github.Client, owner, repo string, jobID int64) (string, error) {
+	logURL, _, err := client.Actions.GetWorkflowJobLogs(ctx, owner, repo, jobID, 1)
+	if err != nil {
+		return "", fmt.Errorf("failed to get job log URL: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, logURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download job log: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download job log: %s", resp.Status)
+	}
+
+	// 末尾だけを使うため、大きなログは読み飛ばす
+	if resp.ContentLength > maxJobLogDownload {
+		if _, err := io.CopyN(io.Discard, resp.Body, resp.ContentLength-maxJobLogDownload); err != nil {
+			return "", fmt.Errorf("failed to download job log: %v", err)
+		}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJobLogDownload))
+	if err != nil {
+		return "", fmt.Errorf("failed to download job log: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/queue"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+	"github.com/takutakahashi/kommon/pkg/session"
+)
+
+// commandRequest is an issue comment addressed to kommon
+type commandRequest struct {
+	repo            string // owner/name
+	owner           string
+	name            string
+	issue           int
+	pullRequest     bool
+	installationID  int64
+	commentID       int64
+	reviewCommentID int64 // Inline review comment addressed to kommon, instead of an issue comment
+	reviewThreadID  int64 // First comment of the review thread kommon replies in
+	sender          string
+}
+
+// reply posts a comment on the issue of the request, or in its review thread
+func (ws *WebhookServer) reply(ctx context.Context, client *github.Client, req commandRequest, body string) {
+	if req.reviewThreadID != 0 {
+		if _, _, err := client.PullRequests.CreateCommentInReplyTo(ctx, req.owner, req.name, req.issue, body, req.reviewThreadID); err != nil {
+			ws.log.Errorf("レビューコメントへの返信に失敗しました: %v", err)
+		}
+		return
+	}
+	if _, _, err := client.Issues.CreateComment(ctx, req.owner, req.name, req.issue, &github.IssueComment{
+		Body: github.String(body),
+	}); err != nil {
+		ws.log.Errorf("コメントの投稿に失敗しました: %v", err)
+	}
+}
+
+// handleCommand runs a parsed kommon command
+func (ws *WebhookServer) handleCommand(ctx context.Context, client *github.Client, req commandRequest, cmd *command.Command, repoCfg *repoconfig.Config) {
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":    req.repo,
+		"issue":   req.issue,
+		"command": cmd.Name,
+	})
+
+	if !repoCfg.Allows(cmd.Name) {
+		log.Info("Subcommand is not allowed in this repository")
+		ws.reply(ctx, client, req, fmt.Sprintf("このリポジトリでは `%s %s` は許可されていません（`%s` の commands を確認してください）。", command.Prefix, cmd.Name, repoconfig.Path))
+		return
+	}
+
+	switch cmd.Name {
+	case command.NameRun, command.NameReview:
+		job, err := commandJob(req, cmd)
+		if err != nil {
+			ws.reply(ctx, client, req, fmt.Sprintf("コマンドを実行できません: %v", err))
+			return
+		}
+		// 実行はキューに積み、同時実行数の上限内で順番に処理する
+		// 同じ Issue の実行は同じワークスペースを使うため、1 件ずつ順番に実行される
+		if err := ws.enqueueJob(ctx, client, job, req.pullRequest); err != nil {
+			log.Errorf("Failed to enqueue job: %v", err)
+		}
+
+	case command.NameStatus:
+		ws.reply(ctx, client, req, ws.sessionSummary(ctx, req.repo, req.issue))
+
+	case command.NameCancel:
+		canceled, err := ws.cancelSessionJobs(ctx, client, req.repo, req.issue)
+		switch {
+		case err != nil:
+			log.Errorf("Failed to cancel jobs: %v", err)
+			ws.reply(ctx, client, req, fmt.Sprintf("キャンセルに失敗しました: %v", err))
+		case canceled == 0:
+			ws.reply(ctx, client, req, "キャンセルできる実行はありません。")
+		default:
+			ws.reply(ctx, client, req, fmt.Sprintf("🛑 @%s のリクエストにより %d 件の実行をキャンセルしました。", req.sender, canceled))
+		}
+
+	case command.NameReset:
+		if _, err := ws.cancelSessionJobs(ctx, client, req.repo, req.issue); err != nil {
+			log.Errorf("Failed to cancel jobs: %v", err)
+		}
+		if err := ws.ResetSession(ctx, req.repo, req.issue); err != nil {
+			log.Errorf("Failed to reset session: %v", err)
+			ws.reply(ctx, client, req, fmt.Sprintf("セッションのリセットに失敗しました: %v", err))
+			return
+		}
+		ws.reply(ctx, client, req, "セッションをリセットしました。次の実行は新しいセッションとワークスペースで開始します。")
+
+	case command.NameHelp:
+		ws.reply(ctx, client, req, command.Help(ws.appSlug))
+	}
+}
+
+// commandJob builds the job running a run or review command
+func commandJob(req commandRequest, cmd *command.Command) (*queue.Job, error) {
+	if err := (agent.ExecuteOptions{Model: cmd.Model, Branch: cmd.Branch}).Validate(); err != nil {
+		return nil, err
+	}
+
+	// review の Prompt は追加の指示で、差分とあわせて実行時にプロンプトを組み立てる
+	if cmd.Name == command.NameReview && !req.pullRequest {
+		return nil, errors.New("review はプルリクエストでのみ使えます")
+	}
+
+	return &queue.Job{
+		SessionKey:     session.Key(req.repo, req.issue),
+		Repo:           req.repo,
+		Issue:          req.issue,
+		InstallationID: req.installationID,
+		CommentID:      req.commentID,
+		ReviewThreadID: req.reviewThreadID,
+		Sender:         req.sender,
+		Command:        string(cmd.Name),
+		Prompt:         cmd.Prompt,
+		Model:          cmd.Model,
+		Branch:         cmd.Branch,
+	}, nil
+}
+
+// parseErrorReply explains why the comment could not be parsed
+func (ws *WebhookServer) parseErrorReply(err error) string {
+	var parseErr *command.ParseError
+	switch {
+	case errors.As(err, &parseErr) && errors.Is(err, command.ErrUnknownCommand):
+		return fmt.Sprintf("不明なサブコマンドです: `%s`\n\n%s", parseErr.Input, command.Help(ws.appSlug))
+	case errors.As(err, &parseErr):
+		return fmt.Sprintf("コマンドを解釈できませんでした: %v\n\n%s", parseErr.Err, command.Help(ws.appSlug))
+	default:
+		return fmt.Sprintf("コマンドを解釈できませんでした: %v\n\n%s", err, command.Help(ws.appSlug))
+	}
+}
+
+// sessionJobs returns the queued and running jobs of the issue
+func (ws *WebhookServer) sessionJobs(repoFullName string, issueNumber int) []queue.Job {
+	key := session.Key(repoFullName, issueNumber)
+	var jobs []queue.Job
+	for _, job := range ws.queue.Jobs() {
+		if job.SessionKey == key {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs
+}
+
+// cancelSessionJobs cancels the queued and running jobs of the issue and
+// returns how many were canceled
+func (ws *WebhookServer) cancelSessionJobs(ctx context.Context, client *github.Client, repoFullName string, issueNumber int) (int, error) {
+	var errs []error
+	canceled := 0
+	for _, job := range ws.sessionJobs(repoFullName, issueNumber) {
+		err := ws.cancelJob(ctx, client, job.ID)
+		if errors.Is(err, queue.ErrNotFound) {
+			// 一覧を取得した後に終了した
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		canceled++
+	}
+	return canceled, errors.Join(errs...)
+}
+
+// handleDeletedComment cancels the jobs requested by a deleted comment
+func (ws *WebhookServer) handleDeletedComment(ctx context.Context, event *github.IssueCommentEvent, installationID int64) {
+	commentID := event.GetComment().GetID()
+	var jobIDs []string
+	for _, job := range ws.queue.Jobs() {
+		if job.CommentID == commentID {
+			jobIDs = append(jobIDs, job.ID)
+		}
+	}
+	if len(jobIDs) == 0 {
+		return
+	}
+
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	if err != nil {
+		ws.log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	req := commandRequest{
+		repo:  event.GetRepo().GetFullName(),
+		owner: event.GetRepo().GetOwner().GetLogin(),
+		name:  event.GetRepo().GetName(),
+		issue: event.GetIssue().GetNumber(),
+	}
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":       req.repo,
+		"issue":      req.issue,
+		"comment_id": commentID,
+	})
+
+	canceled := 0
+	for _, id := range jobIDs {
+		err := ws.cancelJob(ctx, client, id)
+		if errors.Is(err, queue.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.WithField("job_id", id).Errorf("Failed to cancel job: %v", err)
+			continue
+		}
+		canceled++
+	}
+	if canceled > 0 {
+		log.Infof("Canceled %d jobs of the deleted comment", canceled)
+		ws.reply(ctx, client, req, "🛑 リクエストのコメントが削除されたため、実行をキャンセルしました。")
+	}
+}
+
+// sessionSummary describes the session of the issue and its jobs
+func (ws *WebhookServer) sessionSummary(ctx context.Context, repoFullName string, issueNumber int) string {
+	var b strings.Builder
+
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	switch {
+	case errors.Is(err, session.ErrNotFound) || (err == nil && sess.Status == session.StatusClosed):
+		b.WriteString("セッション: なし（次の実行で作成されます）\n")
+	case err != nil:
+		ws.log.Errorf("Failed to get session %s: %v", key, err)
+		b.WriteString("セッション: 取得できませんでした\n")
+	default:
+		fmt.Fprintf(&b, "セッション: `%s`（%s、最終実行 %s）\n", sess.ID, sess.Status, sess.LastUsedAt.Format("2006-01-02 15:04:05 MST"))
+	}
+
+	jobs := ws.sessionJobs(repoFullName, issueNumber)
+	if len(jobs) == 0 {
+		b.WriteString("実行中・実行待ちのリクエストはありません。\n")
+		return b.String()
+	}
+
+	b.WriteString("\n| 状態 | リクエスト | 待ち順 |\n| --- | --- | --- |\n")
+	for _, job := range jobs {
+		state, position := "実行中", "-"
+		if job.Status == queue.StatusPending {
+			state = "実行待ち"
+			position = fmt.Sprintf("%d 番目", ws.queue.Position(job.ID))
+		}
+		fmt.Fprintf(&b, "| %s | @%s (%s) | %s |\n", state, job.Sender, job.EnqueuedAt.Format("15:04:05"), position)
+	}
+	return b.String()
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+)
+
+// handleIssueTrigger starts an execution when an issue gets the trigger
+// label of the repository or is assigned to the bot of the app. The issue
+// title and body are the prompt.
+func (ws *WebhookServer) handleIssueTrigger(ctx context.Context, event *github.IssuesEvent) {
+	issue := event.GetIssue()
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":   event.GetRepo().GetFullName(),
+		"issue":  issue.GetNumber(),
+		"action": event.GetAction(),
+		"sender": event.GetSender().GetLogin(),
+	})
+
+	// ラベルは設定を読むまで判定できないため、割り当ては先に絞り込む
+	if event.GetAction() == "assigned" && !ws.isAppBot(event.GetAssignee().GetLogin()) {
+		return
+	}
+	if issue.GetState() == "closed" {
+		return
+	}
+
+	installationID := event.GetInstallation().GetID()
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	if err != nil {
+		log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	req := commandRequest{
+		repo:           event.GetRepo().GetFullName(),
+		owner:          event.GetRepo().GetOwner().GetLogin(),
+		name:           event.GetRepo().GetName(),
+		issue:          issue.GetNumber(),
+		installationID: installationID,
+		sender:         event.GetSender().GetLogin(),
+	}
+
+	repoCfg, err := loadRepoConfig(ctx, client, req.owner, req.name)
+	if err != nil {
+		if event.GetAction() == "labeled" && !isTriggerLabel(event.GetLabel().GetName(), repoconfig.DefaultLabel) {
+			// kommon と関係のないラベルでは設定の誤りを報告しない
+			return
+		}
+		log.Errorf("Failed to load repository config: %v", err)
+		ws.reply(ctx, client, req, repoConfigErrorReply(err))
+		return
+	}
+	if event.GetAction() == "labeled" && !isTriggerLabel(event.GetLabel().GetName(), repoCfg.TriggerLabel()) {
+		return
+	}
+	if !repoCfg.Triggers(repoconfig.EventIssues) {
+		log.Info("Issue events don't trigger kommon in this repository")
+		return
+	}
+
+	if !ws.authorize(ctx, client, req) {
+		return
+	}
+	log.Info("Received issue trigger")
+
+	ws.handleCommand(ctx, client, req, &command.Command{
+		Name:   command.NameRun,
+		Prompt: issuePrompt(issue),
+	}, repoCfg)
+}
+
+// isAppBot reports whether the login is the bot user of the app
+func (ws *WebhookServer) isAppBot(login string) bool {
+	return ws.appSlug != "" && strings.EqualFold(login, ws.appSlug+"[bot]")
+}
+
+// isTriggerLabel compares label names like GitHub does, ignoring case
+func isTriggerLabel(name, label string) bool {
+	return strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(label))
+}
+
+// issuePrompt asks the agent to work on the issue
+func issuePrompt(issue *github.Issue) string {
+	prompt := fmt.Sprintf("次の Issue #%d に対応してください。\n\n# %s", issue.GetNumber(), issue.GetTitle())
+	if body := strings.TrimSpace(issue.GetBody()); body != "" {
+		prompt += "\n\n" + body
+	}
+	return prompt
+}
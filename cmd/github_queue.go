@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/progress"
+	"github.com/takutakahashi/kommon/pkg/queue"
+	"github.com/takutakahashi/kommon/pkg/session"
+)
+
+// splitRepoFullName splits owner/name into its parts
+func splitRepoFullName(fullName string) (string, string, error) {
+	parts := strings.SplitN(fullName, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid repository name: %s", fullName)
+	}
+	return parts[0], parts[1], nil
+}
+
+// enqueueJob posts the status comment of the job, creates its check run when
+// it runs on a pull request and queues it. A job merged into a pending one
+// gets neither and is reported on the status comment of that job.
+func (ws *WebhookServer) enqueueJob(ctx context.Context, client *github.Client, job *queue.Job, pullRequest bool) error {
+	owner, repo, err := splitRepoFullName(job.Repo)
+	if err != nil {
+		return err
+	}
+
+	// 実行待ちのリクエストにまとめられる場合は、新しいコメントや Check Run を作らず
+	// まとめた先のステータスコメントで知らせる
+	pending, err := ws.queue.Merge(job)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		if pending.StatusCommentID != 0 {
+			body := fmt.Sprintf("実行待ちのリクエストに追加の指示をまとめました。待ち順: %d 番目", ws.queue.Position(pending.ID))
+			if err := editStatusComment(ctx, client, owner, repo, pending, pending.StatusCommentID, body); err != nil {
+				ws.log.Error(err)
+			}
+		}
+		ws.log.WithField("job_id", job.ID).Info("Merged command execution into the pending job")
+		return nil
+	}
+
+	// 進捗はこのステータスコメントを編集して知らせる
+	job.StatusCommentID, err = postStatusComment(ctx, client, owner, repo, job, progress.Render(progress.State{Phase: progress.PhaseQueued}, time.Now()))
+	if err != nil {
+		return err
+	}
+
+	// キューに積む前に ID を決めて、Check Run から参照できるようにする
+	if job.ID, err = queue.NewJobID(); err != nil {
+		return err
+	}
+	if pullRequest {
+		// Check Run の作成に失敗しても（権限不足など）実行は続ける
+		if job.CheckRunID, err = ws.createCheckRun(ctx, client, owner, repo, job); err != nil {
+			ws.log.Errorf("Failed to create check run: %v", err)
+		}
+	}
+
+	if err := ws.queue.Add(job); err != nil {
+		return err
+	}
+
+	// 待ち順をコメントで知らせる
+	if position := ws.queue.Position(job.ID); position > 0 {
+		body := progress.Render(progress.State{Phase: progress.PhaseQueued, Position: position}, time.Now())
+		if err := editStatusComment(ctx, client, owner, repo, job, job.StatusCommentID, body); err != nil {
+			ws.log.Error(err)
+		}
+	}
+
+	ws.log.WithField("job_id", job.ID).Info("Queued command execution")
+	return nil
+}
+
+// postStatusComment posts the status comment of the job, in the review
+// thread it was requested from if any, and returns its ID
+func postStatusComment(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job, body string) (int64, error) {
+	if job.ReviewThreadID != 0 {
+		comment, _, err := client.PullRequests.CreateCommentInReplyTo(ctx, owner, repo, job.Issue, body, job.ReviewThreadID)
+		if err != nil {
+			return 0, fmt.Errorf("レビューコメントへの返信に失敗しました: %v", err)
+		}
+		return comment.GetID(), nil
+	}
+	comment, _, err := client.Issues.CreateComment(ctx, owner, repo, job.Issue, &github.IssueComment{
+		Body: github.String(body),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("コメントの投稿に失敗しました: %v", err)
+	}
+	return comment.GetID(), nil
+}
+
+// editStatusComment replaces the body of the status comment of the job
+func editStatusComment(ctx context.Context, client *github.Client, owner, repo string, job *queue.Job, commentID int64, body string) error {
+	var err error
+	if job.ReviewThreadID != 0 {
+		_, _, err = client.PullRequests.EditComment(ctx, owner, repo, commentID, &github.PullRequestComment{
+			Body: github.String(body),
+		})
+	} else {
+		_, _, err = client.Issues.EditComment(ctx, owner, repo, commentID, &github.IssueComment{
+			Body: github.String(body),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("コメントの更新に失敗しました: %v", err)
+	}
+	return nil
+}
+
+// runJob executes a queued comment with the session agent and reports its
+// progress by editing the status comment
+func (ws *WebhookServer) runJob(ctx context.Context, job *queue.Job) error {
+	log := ws.log.WithFields(logrus.Fields{
+		"job_id":   job.ID,
+		"repo":     job.Repo,
+		"issue":    job.Issue,
+		"attempts": job.Attempts,
+	})
+	log.Info("Starting queued command execution")
+
+	owner, repo, err := splitRepoFullName(job.Repo)
+	if err != nil {
+		return err
+	}
+
+	// トークンは期限があるため実行のたびに取得し、使い回すエージェントではなく実行に渡す
+	client, token, err := ws.getInstallationClientAndToken(ctx, job.InstallationID)
+	if err != nil {
+		return fmt.Errorf("failed to create installation client: %v", err)
+	}
+
+	statusCommentID := job.StatusCommentID
+	if statusCommentID == 0 {
+		statusCommentID, err = postStatusComment(ctx, client, owner, repo, job, progress.Render(progress.State{Phase: progress.PhaseQueued}, time.Now()))
+		if err != nil {
+			return err
+		}
+	}
+
+	reporter := progress.NewReporter(func(ctx context.Context, body string) error {
+		return editStatusComment(ctx, client, owner, repo, job, statusCommentID, body)
+	}, ws.status)
+
+	if job.CheckRunID != 0 {
+		if err := ws.startCheckRun(ctx, client, owner, repo, job); err != nil {
+			log.Errorf("Failed to start check run: %v", err)
+		}
+	}
+
+	reporter.SetPhase(progress.PhaseCloning)
+	output, err := ws.executeJob(ctx, log, client, token, owner, repo, job, reporter)
+
+	phase := progress.PhaseCompleted
+	var limitErr *agent.LimitError
+	switch {
+	case errors.Is(context.Cause(ctx), queue.ErrCanceled):
+		phase = progress.PhaseCanceled
+		log.Info("Command execution was canceled")
+	case ctx.Err() != nil:
+		// シャットダウンで中断された場合は結果を投稿せず、再起動後に再実行する
+		reporter.Stop()
+		log.Warn("Command execution was interrupted by shutdown")
+		return ctx.Err()
+	case errors.As(err, &limitErr):
+		phase = progress.PhaseLimitExceeded
+		log.Warnf("Command execution exceeded its limits: %v", limitErr)
+	case err != nil:
+		phase = progress.PhaseFailed
+		log.Errorf("Failed to execute prompt: %v", err)
+	}
+
+	// キャンセル後も結果を報告できるよう、実行とは別のコンテキストを使う
+	reportCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	if job.CheckRunID != 0 {
+		if err := ws.completeCheckRun(reportCtx, client, owner, repo, job, phase, output, err); err != nil {
+			log.Errorf("Failed to complete check run: %v", err)
+		}
+	}
+
+	// 結果でステータスコメントを更新
+	var reportErr error
+	switch phase {
+	case progress.PhaseCanceled:
+		reportErr = reporter.Cancel(reportCtx, output)
+	case progress.PhaseLimitExceeded:
+		reportErr = reporter.LimitExceeded(reportCtx, output, err)
+	default:
+		reportErr = reporter.Finish(reportCtx, output, err)
+	}
+	if reportErr != nil {
+		return fmt.Errorf("実行結果のコメント投稿に失敗しました: %v", reportErr)
+	}
+
+	log.Info("Successfully executed command and posted results")
+	return nil
+}
+
+// executeJob runs the job with the session agent and returns its output. An
+// execution stopped by one of its limits returns the *agent.LimitError.
+func (ws *WebhookServer) executeJob(ctx context.Context, log *logrus.Entry, client *github.Client, token, owner, repo string, job *queue.Job, reporter *progress.Reporter) (string, error) {
+	// 設定は実行時点のデフォルトブランチから読み込む
+	repoCfg, err := loadRepoConfig(ctx, client, owner, repo)
+	if err != nil {
+		return "", err
+	}
+	opts := ws.executeOptions(job, repoCfg)
+
+	// レビューはコミットしないため、ブランチを決めるのはそれ以外の実行だけ
+	var branch *workBranch
+	var target *reviewTarget
+	if job.Command == string(command.NameReview) {
+		if target, err = fetchReviewTarget(ctx, client, owner, repo, job.Issue); err != nil {
+			return "", err
+		}
+	} else {
+		if branch, err = ws.resolveWorkBranch(ctx, client, owner, repo, job); err != nil {
+			return "", err
+		}
+		opts.Branch, opts.HeadRepo = branch.name, branch.headRepo
+	}
+	opts.GitHubToken = token
+
+	execCtx := ctx
+	// エージェント自身が上限を守るが、応答しない場合に備えて猶予を持たせて打ち切る
+	if timeout := opts.Limits.Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		execCtx, cancel = context.WithTimeoutCause(ctx, timeout+agent.LimitGracePeriod, agent.NewTimeoutError(timeout))
+		defer cancel()
+	}
+	execCtx = agent.WithExecuteOptions(execCtx, opts)
+
+	prompt := jobPrompt(job, repoCfg, branch)
+	if target != nil {
+		prompt = target.prompt(prompt)
+	}
+	if ws.contextTokens > 0 {
+		// 文脈が取得できなくても依頼そのものは実行する
+		t, err := fetchThread(ctx, client, owner, repo, job.Issue, job.CommentID, target == nil)
+		if err != nil {
+			log.WithError(err).Warn("Failed to fetch the conversation")
+		} else {
+			prompt = contextPrompt(t.Render(ws.contextTokens), prompt)
+		}
+	}
+
+	sessionAgent, err := ws.GetAgent(execCtx, job.Repo, job.Issue, job.InstallationID)
+	if err != nil {
+		return "", err
+	}
+	ws.setSessionStatus(ctx, job.Repo, job.Issue, session.StatusRunning)
+	output, err := ws.streamAgent(execCtx, log, sessionAgent, prompt, reporter)
+	ws.setSessionStatus(context.Background(), job.Repo, job.Issue, session.StatusIdle)
+
+	var limitErr *agent.LimitError
+	if errors.As(err, &limitErr) || errors.As(context.Cause(execCtx), &limitErr) {
+		return output, limitErr
+	}
+	if err != nil || target == nil {
+		return output, err
+	}
+
+	// レビューはエージェントの出力から kommon が投稿する
+	summary, err := ws.submitReview(ctx, client, owner, repo, job.Issue, target, output)
+	if err != nil {
+		return output, err
+	}
+	return summary, nil
+}
+
+// streamAgent runs the prompt, reporting the progress of the agent, and
+// returns the whole output
+func (ws *WebhookServer) streamAgent(ctx context.Context, log *logrus.Entry, a agent.Agent, prompt string, reporter *progress.Reporter) (string, error) {
+	events, err := agent.Stream(ctx, a, prompt)
+	if err != nil {
+		return "", err
+	}
+	// Stream returns once the workspace is ready
+	reporter.SetPhase(progress.PhaseRunning)
+
+	var output strings.Builder
+	var execErr error
+	for event := range events {
+		switch event.Type {
+		case agent.EventOutput:
+			output.WriteString(event.Text)
+			output.WriteString("\n")
+			reporter.AddLine(event.Text)
+		case agent.EventToolCall:
+			log.WithField("tool", event.Tool).Info("Agent called a tool")
+		case agent.EventExit:
+			execErr = event.Err
+		}
+	}
+	return output.String(), execErr
+}
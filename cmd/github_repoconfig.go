@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/queue"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+)
+
+// loadRepoConfig reads .github/kommon.yaml from the default branch of the
+// repository, never from the branch of a pull request, since its setup
+// commands run on the agent. A repository without the file gets an empty
+// configuration.
+func loadRepoConfig(ctx context.Context, client *github.Client, owner, repo string) (*repoconfig.Config, error) {
+	// デフォルトブランチを読むため ref は指定しない
+	file, _, resp, err := client.Repositories.GetContents(ctx, owner, repo, repoconfig.Path, nil)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return &repoconfig.Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", repoconfig.Path, err)
+	}
+	if file == nil {
+		return nil, fmt.Errorf("%s is not a file", repoconfig.Path)
+	}
+
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", repoconfig.Path, err)
+	}
+	return repoconfig.Parse([]byte(content))
+}
+
+// repoConfigErrorReply explains why the configuration of the repository
+// could not be used
+func repoConfigErrorReply(err error) string {
+	var validationErr *repoconfig.ValidationError
+	if !errors.As(err, &validationErr) {
+		return fmt.Sprintf("`%s` を読み込めなかったため実行できません: %v", repoconfig.Path, err)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "`%s` に誤りがあるため実行できません。デフォルトブランチのファイルを修正してください。\n\n", repoconfig.Path)
+	for _, problem := range validationErr.Problems {
+		fmt.Fprintf(&b, "- %s\n", problem)
+	}
+	return b.String()
+}
+
+// executeOptions combines the request of the job, the configuration of the
+// repository and the server limits. The repository may only shorten the
+// server timeout.
+func (ws *WebhookServer) executeOptions(job *queue.Job, repoCfg *repoconfig.Config) agent.ExecuteOptions {
+	opts := repoCfg.ExecuteOptions()
+	if job.Model != "" {
+		opts.Model = job.Model
+	}
+	opts.Branch = job.Branch
+
+	limits := ws.limits.For(job.Repo, job.Command)
+	if timeout := opts.Limits.Timeout; timeout > 0 && (limits.Timeout == 0 || timeout < limits.Timeout) {
+		limits.Timeout = timeout
+	}
+	opts.Limits = limits
+	return opts
+}
+
+// jobPrompt adds where to commit and the instructions of the repository to
+// the prompt of the job. branch is nil for jobs that don't commit.
+func jobPrompt(job *queue.Job, repoCfg *repoconfig.Config, branch *workBranch) string {
+	prompt := job.Prompt
+	if branch != nil {
+		prompt += "\n\n" + branch.instructions(repoCfg.BaseBranch)
+	}
+	if instructions := strings.TrimSpace(repoCfg.Instructions); instructions != "" {
+		prompt += "\n\n## リポジトリの指示\n\n" + instructions
+	}
+	return prompt
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/takutakahashi/kommon/pkg/review"
+)
+
+// maxReviewDiff keeps the prompt of large pull requests reasonable
+const maxReviewDiff = 200000
+
+// reviewTarget is the state of the pull request a review is written for
+type reviewTarget struct {
+	headSHA string
+	diff    string
+}
+
+// fetchReviewTarget gets the head commit and the diff of the pull request.
+// The diff is taken at that commit, so that a push in the meantime doesn't
+// anchor comments to lines the reviewed commit doesn't have.
+func fetchReviewTarget(ctx context.Context, client *github.Client, owner, repo string, number int) (*reviewTarget, error) {
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pull request: %v", err)
+	}
+	headSHA := pr.GetHead().GetSHA()
+	// base...head はプルリクエストの差分と同じくマージベースからの差分になる
+	diff, _, err := client.Repositories.CompareCommitsRaw(ctx, owner, repo, pr.GetBase().GetSHA(), headSHA, github.RawOptions{Type: github.Diff})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pull request diff: %v", err)
+	}
+	return &reviewTarget{headSHA: headSHA, diff: diff}, nil
+}
+
+// prompt returns the review prompt of the target
+func (t *reviewTarget) prompt(instructions string) string {
+	diff := t.diff
+	if len(diff) > maxReviewDiff {
+		// 行の途中で切ると差分の行番号や UTF-8 の文字が壊れるため、最後の改行で切る
+		// （改行がなければ文字の境界で切る）
+		cut := strings.LastIndexByte(diff[:maxReviewDiff], '\n')
+		if cut < 0 {
+			cut = maxReviewDiff
+			for cut > 0 && diff[cut]&0xC0 == 0x80 {
+				cut--
+			}
+		}
+		diff = diff[:cut] + "\n...(差分が大きいため以降を省略しました)"
+	}
+	return review.Prompt(diff, instructions)
+}
+
+// submitReview posts the review written by the agent on the pull request.
+// Comments outside of the diff are listed in the summary instead. It
+// returns a description of the posted review for the status comment.
+func (ws *WebhookServer) submitReview(ctx context.Context, client *github.Client, owner, repo string, number int, target *reviewTarget, output string) (string, error) {
+	result, err := review.ParseOutput(output)
+	if err != nil {
+		return "", err
+	}
+	inline, other := result.Split(review.ParseDiff(target.diff))
+
+	var body strings.Builder
+	body.WriteString("## 🤖 kommon のレビュー\n\n")
+	if summary := strings.TrimSpace(result.Summary); summary != "" {
+		body.WriteString(summary)
+		body.WriteString("\n")
+	}
+	if len(other) > 0 {
+		body.WriteString("\n### 差分外の指摘\n\n")
+		for _, c := range other {
+			fmt.Fprintf(&body, "- `%s:%d`: %s\n", c.Path, c.Line, strings.ReplaceAll(strings.TrimSpace(c.Body), "\n", " "))
+		}
+	}
+
+	comments := make([]*github.DraftReviewComment, 0, len(inline))
+	for _, c := range inline {
+		comments = append(comments, &github.DraftReviewComment{
+			Path: github.String(c.Path),
+			Line: github.Int(c.Line),
+			Side: github.String(c.Side),
+			Body: github.String(c.Body),
+		})
+	}
+
+	posted, _, err := client.PullRequests.CreateReview(ctx, owner, repo, number, &github.PullRequestReviewRequest{
+		// 差分を取得したコミットに固定し、実行中の Push で行がずれないようにする
+		CommitID: github.String(target.headSHA),
+		Body:     github.String(body.String()),
+		Event:    github.String("COMMENT"),
+		Comments: comments,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to submit review: %v", err)
+	}
+	return fmt.Sprintf("レビューを投稿しました（インラインコメント %d 件）: %s\n\n%s", len(inline), posted.GetHTMLURL(), strings.TrimSpace(result.Summary)), nil
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/sirupsen/logrus"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"github.com/takutakahashi/kommon/pkg/repoconfig"
+)
+
+// handleReviewCommentEvent handles mentions in inline review threads. A run
+// is scoped to the commented lines, like every run on a pull request it
+// works on its head branch, and kommon replies in the same thread.
+func (ws *WebhookServer) handleReviewCommentEvent(ctx context.Context, event *github.PullRequestReviewCommentEvent) {
+	// 編集や削除では実行しない
+	if event.GetAction() != "created" {
+		return
+	}
+	comment := event.GetComment()
+	cmd, ok, parseErr := command.Parse(comment.GetBody(), ws.appSlug)
+	if !ok {
+		return
+	}
+
+	installationID := event.GetInstallation().GetID()
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	if err != nil {
+		ws.log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	// 返信はスレッドの最初のコメントに対して行う
+	threadID := comment.GetInReplyTo()
+	if threadID == 0 {
+		threadID = comment.GetID()
+	}
+	pr := event.GetPullRequest()
+	req := commandRequest{
+		repo:            event.GetRepo().GetFullName(),
+		owner:           event.GetRepo().GetOwner().GetLogin(),
+		name:            event.GetRepo().GetName(),
+		issue:           pr.GetNumber(),
+		pullRequest:     true,
+		installationID:  installationID,
+		reviewCommentID: comment.GetID(),
+		reviewThreadID:  threadID,
+		sender:          event.GetSender().GetLogin(),
+	}
+
+	if !ws.authorize(ctx, client, req) {
+		return
+	}
+
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":              req.repo,
+		"issue":             req.issue,
+		"review_comment_id": req.reviewCommentID,
+		"comment_by":        req.sender,
+		"path":              comment.GetPath(),
+	})
+
+	repoCfg, err := loadRepoConfig(ctx, client, req.owner, req.name)
+	if err != nil {
+		log.Errorf("Failed to load repository config: %v", err)
+		ws.reply(ctx, client, req, repoConfigErrorReply(err))
+		return
+	}
+	if !repoCfg.Triggers(repoconfig.EventPullRequestReviewComment) {
+		log.Info("Review comments don't trigger kommon in this repository")
+		return
+	}
+
+	if parseErr != nil {
+		log.Infof("Failed to parse command: %v", parseErr)
+		ws.reply(ctx, client, req, ws.parseErrorReply(parseErr))
+		return
+	}
+	log.WithField("command", cmd.Name).Info("Received command in review comment")
+
+	if cmd.Name == command.NameRun {
+		// 返信から依頼された場合は、指摘の内容がスレッドの最初のコメントにある
+		first := ""
+		if threadID != comment.GetID() {
+			root, _, err := client.PullRequests.GetComment(ctx, req.owner, req.name, threadID)
+			if err != nil {
+				log.Warnf("Failed to get the first comment of the thread: %v", err)
+			} else {
+				first = root.GetBody()
+			}
+		}
+		cmd.Prompt = reviewCommentPrompt(pr, comment, first, cmd.Prompt)
+	}
+
+	ws.handleCommand(ctx, client, req, cmd, repoCfg)
+}
+
+// handleReviewEvent handles mentions in the body of a submitted review. A
+// run addresses the review and its inline comments.
+func (ws *WebhookServer) handleReviewEvent(ctx context.Context, event *github.PullRequestReviewEvent) {
+	if event.GetAction() != "submitted" {
+		return
+	}
+	review := event.GetReview()
+	cmd, ok, parseErr := command.Parse(review.GetBody(), ws.appSlug)
+	if !ok {
+		return
+	}
+
+	installationID := event.GetInstallation().GetID()
+	client, _, err := ws.getInstallationClientAndToken(ctx, installationID)
+	if err != nil {
+		ws.log.Errorf("Failed to get installation client: %v", err)
+		return
+	}
+
+	pr := event.GetPullRequest()
+	req := commandRequest{
+		repo:           event.GetRepo().GetFullName(),
+		owner:          event.GetRepo().GetOwner().GetLogin(),
+		name:           event.GetRepo().GetName(),
+		issue:          pr.GetNumber(),
+		pullRequest:    true,
+		installationID: installationID,
+		sender:         event.GetSender().GetLogin(),
+	}
+
+	if !ws.authorize(ctx, client, req) {
+		return
+	}
+
+	log := ws.log.WithFields(logrus.Fields{
+		"repo":       req.repo,
+		"issue":      req.issue,
+		"review_id":  review.GetID(),
+		"comment_by": req.sender,
+	})
+
+	repoCfg, err := loadRepoConfig(ctx, client, req.owner, req.name)
+	if err != nil {
+		log.Errorf("Failed to load repository config: %v", err)
+		ws.reply(ctx, client, req, repoConfigErrorReply(err))
+		return
+	}
+	if !repoCfg.Triggers(repoconfig.EventPullRequestReview) {
+		log.Info("Reviews don't trigger kommon in this repository")
+		return
+	}
+
+	if parseErr != nil {
+		log.Infof("Failed to parse command: %v", parseErr)
+		ws.reply(ctx, client, req, ws.parseErrorReply(parseErr))
+		return
+	}
+	log.WithField("command", cmd.Name).Info("Received command in review")
+
+	if cmd.Name == command.NameRun {
+		comments, _, err := client.PullRequests.ListReviewComments(ctx, req.owner, req.name, req.issue, review.GetID(), &github.ListOptions{PerPage: 100})
+		if err != nil {
+			log.Warnf("Failed to list the comments of the review: %v", err)
+		}
+		cmd.Prompt = reviewPrompt(pr, review, comments, cmd.Prompt)
+	}
+
+	ws.handleCommand(ctx, client, req, cmd, repoCfg)
+}
+
+// reviewCommentPrompt scopes the request to the lines of the review comment.
+// first is the first comment of the thread when the request is a reply.
+func reviewCommentPrompt(pr *github.PullRequest, comment *github.PullRequestComment, first, request string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Pull Request #%d のレビューコメントで次の依頼がありました。\n\n## 対象\n\n", pr.GetNumber())
+
+	// 古い差分へのコメントは Line が空になる
+	line, startLine := comment.GetLine(), comment.GetStartLine()
+	if line == 0 {
+		line, startLine = comment.GetOriginalLine(), comment.GetOriginalStartLine()
+	}
+	version := "変更後"
+	if comment.GetSide() == "LEFT" {
+		version = "変更前"
+	}
+	switch {
+	case line == 0:
+		fmt.Fprintf(&b, "`%s`\n", comment.GetPath())
+	case startLine != 0 && startLine != line:
+		fmt.Fprintf(&b, "`%s` の %d〜%d 行目（%sのファイル）\n", comment.GetPath(), startLine, line, version)
+	default:
+		fmt.Fprintf(&b, "`%s` の %d 行目（%sのファイル）\n", comment.GetPath(), line, version)
+	}
+	if hunk := strings.TrimSpace(comment.GetDiffHunk()); hunk != "" {
+		fmt.Fprintf(&b, "\n```diff\n%s\n```\n", hunk)
+	}
+	if first = strings.TrimSpace(first); first != "" {
+		fmt.Fprintf(&b, "\n## スレッドの最初のコメント\n\n%s\n", first)
+	}
+
+	request = strings.TrimSpace(request)
+	if request == "" {
+		request = "スレッドの指摘に対応してください。"
+	}
+	fmt.Fprintf(&b, "\n## 依頼\n\n%s\n\n変更は対象の行とその周辺に絞ってください。", request)
+	return b.String()
+}
+
+// reviewPrompt asks to address the review and its inline comments
+func reviewPrompt(pr *github.PullRequest, review *github.PullRequestReview, comments []*github.PullRequestComment, request string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Pull Request #%d の @%s のレビュー（%s）で次の依頼がありました。\n", pr.GetNumber(), review.GetUser().GetLogin(), review.GetState())
+	if len(comments) > 0 {
+		b.WriteString("\n## レビューのコメント\n\n")
+		for _, c := range comments {
+			line := c.GetLine()
+			if line == 0 {
+				line = c.GetOriginalLine()
+			}
+			fmt.Fprintf(&b, "- `%s:%d`: %s\n", c.GetPath(), line, strings.ReplaceAll(strings.TrimSpace(c.GetBody()), "\n", " "))
+		}
+	}
+
+	request = strings.TrimSpace(request)
+	if request == "" {
+		request = "レビューの指摘に対応してください。"
+	}
+	fmt.Fprintf(&b, "\n## 依頼\n\n%s", request)
+	return b.String()
+}
@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/session"
+)
+
+// sessionID returns the agent session ID of the issue. Sessions started after
+// a reset get a suffix so that neither the goose history nor the workspace
+// is reused.
+func sessionID(repoFullName string, issueNumber int, generation int) string {
+	if generation > 0 {
+		return fmt.Sprintf("%s-%d-r%d", repoFullName, issueNumber, generation)
+	}
+	return fmt.Sprintf("%s-%d", repoFullName, issueNumber)
+}
+
+// sessionBranch returns the branch the session of an issue commits to. Like
+// the session ID, it changes after a reset.
+func sessionBranch(issueNumber int, generation int) string {
+	if generation > 0 {
+		return fmt.Sprintf("kommon/issue-%d-r%d", issueNumber, generation)
+	}
+	return fmt.Sprintf("kommon/issue-%d", issueNumber)
+}
+
+// sessionGeneration returns the number of resets of the session of the issue
+func (ws *WebhookServer) sessionGeneration(ctx context.Context, repoFullName string, issueNumber int) (int, error) {
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if errors.Is(err, session.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get session %s: %v", key, err)
+	}
+	return sess.Generation, nil
+}
+
+// loadKnownSessions returns the IDs of the sessions that are still open
+func loadKnownSessions(ctx context.Context, store session.Store) (map[string]bool, error) {
+	sessions, err := store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	known := make(map[string]bool, len(sessions))
+	for _, s := range sessions {
+		if s.Status != session.StatusClosed {
+			known[s.ID] = true
+		}
+	}
+	return known, nil
+}
+
+// rehydrateSessions restores the session state after a restart. Executions
+// that were running when the process stopped are marked idle again.
+func (ws *WebhookServer) rehydrateSessions(ctx context.Context) error {
+	sessions, err := ws.sessions.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+
+	open := 0
+	for _, s := range sessions {
+		if s.Status == session.StatusClosed {
+			continue
+		}
+		open++
+
+		if s.Status == session.StatusRunning {
+			ws.log.Warnf("Execution of session %s was interrupted by a restart", s.ID)
+			s.Status = session.StatusIdle
+			if err := ws.sessions.Put(ctx, s); err != nil {
+				return fmt.Errorf("failed to update session %s: %v", s.ID, err)
+			}
+		}
+	}
+
+	ws.log.Infof("Restored %d open sessions", open)
+	return nil
+}
+
+// newSession starts a session of the issue, following the closed one if any
+func newSession(repoFullName string, issueNumber int, closed *session.Session, now time.Time) *session.Session {
+	generation := 0
+	if closed != nil {
+		generation = closed.Generation
+	}
+	return &session.Session{
+		Key:        session.Key(repoFullName, issueNumber),
+		ID:         sessionID(repoFullName, issueNumber, generation),
+		Generation: generation,
+		Repo:       repoFullName,
+		Issue:      issueNumber,
+		CreatedAt:  now,
+		Status:     session.StatusIdle,
+	}
+}
+
+// openSession returns the session of the issue, or the one that replaces it
+// when there is none or it was closed. A new session is not saved. The
+// caller must hold agentsMu.
+func (ws *WebhookServer) openSession(ctx context.Context, repoFullName string, issueNumber int, now time.Time) (*session.Session, error) {
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		return nil, fmt.Errorf("failed to get session %s: %v", key, err)
+	}
+	if sess == nil || sess.Status == session.StatusClosed {
+		sess = newSession(repoFullName, issueNumber, sess, now)
+	}
+	return sess, nil
+}
+
+// GetAgent returns the agent for the issue, creating it through the executor on first use.
+// The agent is kept for later executions, so the GitHub token is not given
+// here but to every execution through agent.ExecuteOptions.
+func (ws *WebhookServer) GetAgent(ctx context.Context, repoFullName string, issueNumber int, installationID int64) (agent.Agent, error) {
+	ws.agentsMu.Lock()
+	sess, err := ws.openSession(ctx, repoFullName, issueNumber, time.Now())
+	if err != nil {
+		ws.agentsMu.Unlock()
+		return nil, err
+	}
+	a, ok := ws.agents[sess.ID]
+	ws.agentsMu.Unlock()
+
+	// Creating an agent may start a pod or a container and clone the
+	// repository, so other issues must not wait for it
+	if !ok {
+		a, err = ws.executor.CreateAgent(ctx, agent.GooseOptions{
+			SessionID: sess.ID,
+			APIType:   agent.GooseAPITypeOpenRouter,
+			APIKey:    ws.apiKey,
+			Repo:      repoFullName,
+			WorkDir:   viper.GetString("agent_work_dir"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create agent for %s: %v", sess.ID, err)
+		}
+	}
+
+	ws.agentsMu.Lock()
+	defer ws.agentsMu.Unlock()
+
+	now := time.Now()
+	current, err := ws.openSession(ctx, repoFullName, issueNumber, now)
+	if err != nil {
+		return nil, err
+	}
+	if current.ID != sess.ID {
+		// 作成中にリセットされたセッションのエージェントは使わない
+		if !ok {
+			if err := ws.executor.DestroyAgent(ctx, sess.ID); err != nil {
+				ws.log.Errorf("Failed to destroy agent for %s: %v", sess.ID, err)
+			}
+		}
+		return nil, fmt.Errorf("session %s was reset while its agent was starting", current.Key)
+	}
+	if existing, found := ws.agents[current.ID]; found {
+		a = existing
+	} else {
+		ws.agents[current.ID] = a
+	}
+
+	current.InstallationID = installationID
+	current.ExecutorHandle = current.ID
+	current.LastUsedAt = now
+	if err := ws.sessions.Put(ctx, current); err != nil {
+		return nil, fmt.Errorf("failed to save session %s: %v", current.Key, err)
+	}
+	return a, nil
+}
+
+// setSessionStatus records the execution state of the issue session
+func (ws *WebhookServer) setSessionStatus(ctx context.Context, repoFullName string, issueNumber int, status session.Status) {
+	ws.agentsMu.Lock()
+	defer ws.agentsMu.Unlock()
+
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if err != nil {
+		ws.log.Errorf("Failed to get session %s: %v", key, err)
+		return
+	}
+
+	sess.Status = status
+	sess.LastUsedAt = time.Now()
+	if err := ws.sessions.Put(ctx, sess); err != nil {
+		ws.log.Errorf("Failed to save session %s: %v", key, err)
+	}
+}
+
+// DestroyAgent releases the agent for the issue and its executor resources.
+func (ws *WebhookServer) DestroyAgent(ctx context.Context, repoFullName string, issueNumber int) error {
+	return ws.closeSession(ctx, repoFullName, issueNumber, false)
+}
+
+// ResetSession destroys the agent of the issue. The next execution starts a
+// new session with a fresh workspace. A session that is already closed is
+// left as is, so that resetting twice doesn't skip a generation.
+func (ws *WebhookServer) ResetSession(ctx context.Context, repoFullName string, issueNumber int) error {
+	return ws.closeSession(ctx, repoFullName, issueNumber, true)
+}
+
+// closeSession destroys the agent of the open session of the issue and
+// closes the session. With reset, the next session gets the next generation.
+func (ws *WebhookServer) closeSession(ctx context.Context, repoFullName string, issueNumber int, reset bool) error {
+	ws.agentsMu.Lock()
+	defer ws.agentsMu.Unlock()
+
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if errors.Is(err, session.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get session %s: %v", key, err)
+	}
+	if sess.Status == session.StatusClosed {
+		return nil
+	}
+
+	// The agent may only be known to the executor when it was rediscovered after a restart
+	ids, err := ws.executor.ListAgents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list agents: %v", err)
+	}
+	for _, id := range ids {
+		if id != sess.ExecutorHandle {
+			continue
+		}
+		if err := ws.executor.DestroyAgent(ctx, id); err != nil {
+			return fmt.Errorf("failed to destroy agent for %s: %v", id, err)
+		}
+	}
+	delete(ws.agents, sess.ID)
+
+	sess.Status = session.StatusClosed
+	sess.LastUsedAt = time.Now()
+	if reset {
+		sess.Generation++
+		// 自動修正も改めて試せるようにする
+		sess.CIFixAttempts = 0
+		sess.CIFixSHA = ""
+	}
+	if err := ws.sessions.Put(ctx, sess); err != nil {
+		return fmt.Errorf("failed to save session %s: %v", key, err)
+	}
+	return nil
+}
+
+// createSession records a session for the issue before its first
+// execution, so that state such as CI fix attempts can be kept on it. An
+// open session is left as is.
+func (ws *WebhookServer) createSession(ctx context.Context, repoFullName string, issueNumber int, installationID int64) error {
+	ws.agentsMu.Lock()
+	defer ws.agentsMu.Unlock()
+
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if err != nil && !errors.Is(err, session.ErrNotFound) {
+		return fmt.Errorf("failed to get session %s: %v", key, err)
+	}
+	if sess != nil && sess.Status != session.StatusClosed {
+		return nil
+	}
+
+	sess = newSession(repoFullName, issueNumber, sess, time.Now())
+	sess.InstallationID = installationID
+	if err := ws.sessions.Put(ctx, sess); err != nil {
+		return fmt.Errorf("failed to save session %s: %v", key, err)
+	}
+	return nil
+}
+
+// recordCIFixAttempt counts a fix of the failed CI of the commit on the open
+// session of the pull request and returns its number. It returns 0 when a
+// fix was already started for the commit, as several workflows or check
+// suites may fail on it. Attempts past the limit are still counted so that
+// the caller can tell the first one apart.
+func (ws *WebhookServer) recordCIFixAttempt(ctx context.Context, repoFullName string, issueNumber int, sha string) (int, error) {
+	ws.agentsMu.Lock()
+	defer ws.agentsMu.Unlock()
+
+	key := session.Key(repoFullName, issueNumber)
+	sess, err := ws.sessions.Get(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get session %s: %v", key, err)
+	}
+	if sess.Status == session.StatusClosed {
+		return 0, fmt.Errorf("session %s is closed", key)
+	}
+	if sess.CIFixSHA == sha {
+		return 0, nil
+	}
+
+	sess.CIFixAttempts++
+	sess.CIFixSHA = sha
+	if err := ws.sessions.Put(ctx, sess); err != nil {
+		return 0, fmt.Errorf("failed to save session %s: %v", key, err)
+	}
+	return sess.CIFixAttempts, nil
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/v57/github"
+	"github.com/takutakahashi/kommon/pkg/thread"
+)
+
+const (
+	// maxThreadPages bounds the API calls of long threads; the oldest
+	// comments are trimmed first anyway
+	maxThreadPages = 3
+	// maxReferencedFiles is the number of files mentioned in the thread that
+	// are fetched
+	maxReferencedFiles = 5
+	// maxReferencedFileSize skips large files, which would be cut anyway
+	maxReferencedFileSize = 100000
+)
+
+// fetchThread collects the conversation of the issue or pull request. The
+// comment that requested the job is left out since it is the prompt itself,
+// and so is the diff when withDiff is false.
+func fetchThread(ctx context.Context, client *github.Client, owner, repo string, number int, excludeCommentID int64, withDiff bool) (*thread.Thread, error) {
+	issue, _, err := client.Issues.Get(ctx, owner, repo, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get issue: %v", err)
+	}
+	t := &thread.Thread{
+		Number:      number,
+		PullRequest: issue.IsPullRequest(),
+		Title:       issue.GetTitle(),
+		Author:      issue.GetUser().GetLogin(),
+		State:       issue.GetState(),
+		Body:        issue.GetBody(),
+	}
+
+	// コメントは古い順に返るため、長いスレッドでは末尾のページを取得する
+	comments, err := listIssueComments(ctx, client, owner, repo, number)
+	if err != nil {
+		return nil, err
+	}
+	texts := []string{t.Body}
+	for _, c := range comments {
+		if c.GetID() == excludeCommentID {
+			continue
+		}
+		t.Comments = append(t.Comments, thread.Comment{
+			Author:    c.GetUser().GetLogin(),
+			Body:      c.GetBody(),
+			CreatedAt: c.GetCreatedAt().Time,
+		})
+		texts = append(texts, c.GetBody())
+	}
+
+	ref := ""
+	if t.PullRequest {
+		pr, _, err := client.PullRequests.Get(ctx, owner, repo, number)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pull request: %v", err)
+		}
+		ref = pr.GetHead().GetSHA()
+
+		reviews, _, err := client.PullRequests.ListReviews(ctx, owner, repo, number, &github.ListOptions{PerPage: 100})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list reviews: %v", err)
+		}
+		for _, r := range reviews {
+			t.Reviews = append(t.Reviews, thread.Comment{
+				Author:    r.GetUser().GetLogin(),
+				Body:      r.GetBody(),
+				CreatedAt: r.GetSubmittedAt().Time,
+				State:     r.GetState(),
+			})
+			texts = append(texts, r.GetBody())
+		}
+
+		reviewComments, _, err := client.PullRequests.ListComments(ctx, owner, repo, number, &github.PullRequestListCommentsOptions{
+			ListOptions: github.ListOptions{PerPage: 100},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list review comments: %v", err)
+		}
+		for _, c := range reviewComments {
+			t.ReviewComments = append(t.ReviewComments, thread.Comment{
+				Author:    c.GetUser().GetLogin(),
+				Body:      c.GetBody(),
+				CreatedAt: c.GetCreatedAt().Time,
+				Path:      c.GetPath(),
+				Line:      c.GetLine(),
+			})
+			texts = append(texts, c.GetBody())
+		}
+
+		if withDiff {
+			diff, _, err := client.PullRequests.GetRaw(ctx, owner, repo, number, github.RawOptions{Type: github.Diff})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get pull request diff: %v", err)
+			}
+			t.Diff = diff
+		}
+	}
+
+	// 参照されているファイルは取得できたものだけ渡す
+	for _, path := range thread.ReferencedPaths(owner+"/"+repo, maxReferencedFiles, texts...) {
+		file, _, _, err := client.Repositories.GetContents(ctx, owner, repo, path, &github.RepositoryContentGetOptions{Ref: ref})
+		if err != nil || file == nil || file.GetSize() > maxReferencedFileSize {
+			continue
+		}
+		content, err := file.GetContent()
+		if err != nil {
+			continue
+		}
+		t.Files = append(t.Files, thread.File{Path: path, Content: content})
+	}
+	return t, nil
+}
+
+// listIssueComments returns the last maxThreadPages pages of comments,
+// oldest first
+func listIssueComments(ctx context.Context, client *github.Client, owner, repo string, number int) ([]*github.IssueComment, error) {
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	comments, resp, err := client.Issues.ListComments(ctx, owner, repo, number, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list comments: %v", err)
+	}
+	if resp.LastPage <= 1 {
+		return comments, nil
+	}
+
+	var all []*github.IssueComment
+	for page := max(2, resp.LastPage-maxThreadPages+1); page <= resp.LastPage; page++ {
+		opts.Page = page
+		pageComments, _, err := client.Issues.ListComments(ctx, owner, repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list comments: %v", err)
+		}
+		all = append(all, pageComments...)
+	}
+	if resp.LastPage <= maxThreadPages {
+		all = append(comments, all...)
+	}
+	return all, nil
+}
+
+// contextPrompt prepends the conversation to the prompt of the job
+func contextPrompt(conversation, prompt string) string {
+	return "以下はこの Issue / Pull Request の会話です。指示の背景として参照してください。\n\n" +
+		conversation + "\n---\n\n## 依頼\n\n" + prompt
+}
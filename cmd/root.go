@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/takutakahashi/kommon/pkg/agent"
 )
 
 var (
@@ -23,6 +26,10 @@ AI-powered assistance using various agents like OpenAI GPT and Goose.`,
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Println(err)
+		var limitErr *agent.LimitError
+		if errors.As(err, &limitErr) {
+			os.Exit(agent.LimitExitCode)
+		}
 		os.Exit(1)
 	}
 }
@@ -35,7 +42,7 @@ func init() {
 	// Common flags
 	rootCmd.PersistentFlags().String("agent", "openai", "Agent type (openai or goose)")
 	rootCmd.PersistentFlags().String("session-id", "", "Session/Issue ID")
-	rootCmd.PersistentFlags().String("api-key", "", "API key for the AI service")
+	rootCmd.PersistentFlags().String("api-key", "", "API key for the AI service (or KOMMON_API_KEY / OPENROUTER_API_KEY)")
 	rootCmd.PersistentFlags().String("base-url", "", "Base URL for the AI service")
 	rootCmd.PersistentFlags().String("data-dir", getDefaultDataDir(), "Directory for storing data")
 	rootCmd.PersistentFlags().String("agent-work-dir", "", "Working directory for agent")
@@ -86,7 +93,8 @@ func init() {
 	}
 
 	// Environment variables with error handling
-	if err := viper.BindEnv("api_key", "KOMMON_API_KEY"); err != nil {
+	// The key of the default OpenRouter provider doubles as the API key
+	if err := viper.BindEnv("api_key", "KOMMON_API_KEY", "OPENROUTER_API_KEY"); err != nil {
 		fmt.Printf("Warning: failed to bind KOMMON_API_KEY environment variable: %v\n", err)
 	}
 	if err := viper.BindEnv("agent_work_dir", "KOMMON_AGENT_WORK_DIR"); err != nil {
@@ -1,8 +1,15 @@
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -16,7 +23,12 @@ var runCmd = &cobra.Command{
 	Long: `Run a command using the specified AI agent.
 For example:
   # Use Goose agent with a specific session name
-  kommon run --agent goose --session-id 123 "Your prompt here"`,
+  kommon run --agent goose --session-id 123 "Your prompt here"
+
+  # Read the prompt from stdin
+  echo "Your prompt here" | kommon run --session-id 123 --text -`,
+	// Errors of the agent are not usage errors
+	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		text, err := cmd.Flags().GetString("text")
 		if err != nil {
@@ -27,27 +39,124 @@ For example:
 			text = args[0]
 		}
 
+		textFile, err := cmd.Flags().GetString("text-file")
+		if err != nil {
+			return err
+		}
+		if textFile != "" {
+			input, readErr := os.ReadFile(textFile)
+			if readErr != nil {
+				return fmt.Errorf("failed to read text file: %w", readErr)
+			}
+			text = string(input)
+		}
+
+		// Executors put the token of the execution before the prompt, so that
+		// it never appears in the command line
+		stdin := bufio.NewReader(cmd.InOrStdin())
+		token := viper.GetString("github_token")
+		tokenFromStdin, err := cmd.Flags().GetBool("github-token-stdin")
+		if err != nil {
+			return err
+		}
+		if tokenFromStdin {
+			line, readErr := stdin.ReadString('\n')
+			if readErr != nil {
+				return fmt.Errorf("failed to read GitHub token from stdin: %w", readErr)
+			}
+			token = strings.TrimSuffix(line, "\n")
+		}
+
+		if text == "-" {
+			input, readErr := io.ReadAll(stdin)
+			if readErr != nil {
+				return fmt.Errorf("failed to read text from stdin: %w", readErr)
+			}
+			text = string(input)
+		}
+
 		if text == "" {
-			return fmt.Errorf("text is required either via --text flag or as an argument")
+			return fmt.Errorf("text is required either via --text or --text-file flag or as an argument")
 		}
 
-		return runCommand(text)
+		opts := agent.ExecuteOptions{GitHubToken: token}
+		if opts.Model, err = cmd.Flags().GetString("model"); err != nil {
+			return err
+		}
+		if opts.Provider, err = cmd.Flags().GetString("provider"); err != nil {
+			return err
+		}
+		if opts.Branch, err = cmd.Flags().GetString("branch"); err != nil {
+			return err
+		}
+		if opts.HeadRepo, err = cmd.Flags().GetString("head-repo"); err != nil {
+			return err
+		}
+		if opts.BaseBranch, err = cmd.Flags().GetString("base-branch"); err != nil {
+			return err
+		}
+		if opts.Setup, err = cmd.Flags().GetStringArray("setup"); err != nil {
+			return err
+		}
+		if opts.Limits.Timeout, err = cmd.Flags().GetDuration("timeout"); err != nil {
+			return err
+		}
+		if opts.Limits.MaxOutputBytes, err = cmd.Flags().GetInt64("max-output-bytes"); err != nil {
+			return err
+		}
+		if opts.Limits.MaxTokens, err = cmd.Flags().GetInt64("max-tokens"); err != nil {
+			return err
+		}
+		if opts.Limits.MaxCost, err = cmd.Flags().GetFloat64("max-cost"); err != nil {
+			return err
+		}
+		if opts.Limits.CostPerMTokens, err = cmd.Flags().GetFloat64("cost-per-million-tokens"); err != nil {
+			return err
+		}
+
+		return runCommand(text, opts)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(runCmd)
-	runCmd.Flags().String("text", "", "Input text for the agent")
+	runCmd.Flags().String("text", "", "Input text for the agent (use - to read from stdin)")
+	runCmd.Flags().String("text-file", "", "File holding the input text for the agent")
+	runCmd.Flags().String("repo", "", "GitHub repository (owner/name) the agent works on")
+	runCmd.Flags().Bool("github-token-stdin", false, "Read the GitHub token from the first line of stdin instead of KOMMON_GITHUB_TOKEN")
+	runCmd.Flags().String("model", "", "Model used for this run instead of the configured one")
+	runCmd.Flags().String("provider", "", "goose provider used for this run instead of the configured one")
+	runCmd.Flags().String("branch", "", "Branch checked out before the prompt runs")
+	runCmd.Flags().String("head-repo", "", "Fork (owner/name) the branch is fetched from and pushed to")
+	runCmd.Flags().String("base-branch", "", "Branch the repository is cloned at and new branches start from")
+	runCmd.Flags().StringArray("setup", nil, "Shell command run in the workspace before the prompt (repeatable)")
+	runCmd.Flags().Duration("timeout", 0, "Stop the run after this long (0 means no limit)")
+	runCmd.Flags().Int64("max-output-bytes", 0, "Stop the run once it printed more bytes (0 means no limit)")
+	runCmd.Flags().Int64("max-tokens", 0, "Stop the run once it used more LLM tokens (0 means no limit)")
+	runCmd.Flags().Float64("max-cost", 0, "Stop the run once its estimated cost in USD is higher (0 means no limit)")
+	runCmd.Flags().Float64("cost-per-million-tokens", 0, "Price in USD per million tokens used to estimate the cost")
+
+	if err := viper.BindPFlag("repo", runCmd.Flags().Lookup("repo")); err != nil {
+		fmt.Printf("Failed to bind repo flag: %v\n", err)
+		os.Exit(1)
+	}
+	if err := viper.BindEnv("github_token", "KOMMON_GITHUB_TOKEN"); err != nil {
+		fmt.Printf("Warning: failed to bind KOMMON_GITHUB_TOKEN environment variable: %v\n", err)
+	}
 }
 
-func runCommand(input string) error {
-	ctx := context.Background()
+func runCommand(input string, execOpts agent.ExecuteOptions) error {
+	// Stopping kommon run stops goose and the commands it started
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx = agent.WithExecuteOptions(ctx, execOpts)
 
 	// Create agent options from viper config
 	opts := agent.GooseOptions{
-		APIKey:      viper.GetString("api_key"),
-		SessionID:   viper.GetString("session_id"),
-		Instruction: input,
+		APIKey:    viper.GetString("api_key"),
+		SessionID: viper.GetString("session_id"),
+		Repo:      viper.GetString("repo"),
+		WorkDir:   viper.GetString("agent_work_dir"),
 	}
 
 	// Create agent
@@ -56,14 +165,28 @@ func runCommand(input string) error {
 		return fmt.Errorf("failed to create agent: %w", initErr)
 	}
 
-	// Execute command
-	output, execErr := agentClient.Execute(ctx, input)
+	// Execute command and display the output while it runs
+	events, execErr := agent.Stream(ctx, agentClient, input)
 	if execErr != nil {
 		return fmt.Errorf("failed to execute command: %w", execErr)
 	}
 
-	// Display result
-	fmt.Println(output)
+	for event := range events {
+		switch event.Type {
+		case agent.EventOutput:
+			fmt.Println(event.Text)
+		case agent.EventExit:
+			execErr = event.Err
+		}
+	}
+	var limitErr *agent.LimitError
+	if errors.As(execErr, &limitErr) {
+		// Printed as is so that executors can report the limit
+		return limitErr
+	}
+	if execErr != nil {
+		return fmt.Errorf("failed to execute command: %w", execErr)
+	}
 
 	return nil
 }
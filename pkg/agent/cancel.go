@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrCanceled is reported by the exit event of a canceled execution
+	ErrCanceled = errors.New("execution canceled")
+
+	// ErrNoExecution is returned by CancelExecution when nothing runs
+	ErrNoExecution = errors.New("no running execution")
+)
+
+// pidFile holds the process group of the running goose of a session
+func pidFile(workDir, name string) string {
+	return filepath.Join(workDir, name+".pid")
+}
+
+// cancelMarker tells the running execution that it was canceled on purpose
+func cancelMarker(workDir, name string) string {
+	return filepath.Join(workDir, name+".canceled")
+}
+
+// CancelExecution kills the goose process group running for the session in
+// the work directory. It is used by "kommon cancel" in agent containers,
+// where the execution runs in another process. The execution discards the
+// changes it left in the workspace and reports ErrCanceled.
+func CancelExecution(workDir, sessionID string) error {
+	name := sessionName(sessionID)
+	if name == "" {
+		return fmt.Errorf("invalid session ID: %q", sessionID)
+	}
+	if workDir == "" {
+		workDir = defaultWorkDir
+	}
+
+	data, err := os.ReadFile(pidFile(workDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNoExecution
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read pid file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid pid file: %q", data)
+	}
+
+	if err := os.WriteFile(cancelMarker(workDir, name), nil, 0644); err != nil {
+		return fmt.Errorf("failed to mark execution as canceled: %w", err)
+	}
+	if err := killProcessGroup(pid); err != nil {
+		return fmt.Errorf("failed to kill process %d: %w", pid, err)
+	}
+	return nil
+}
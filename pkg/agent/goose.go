@@ -2,11 +2,17 @@ package agent
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type GooseAPIType string
@@ -15,18 +21,44 @@ const (
 	GooseAPITypeOpenRouter GooseAPIType = "openrouter"
 )
 
+const (
+	defaultWorkDir = "tmp"
+
+	// gitCredentialHelper lets git authenticate with the GH_TOKEN environment variable
+	gitCredentialHelper = "!gh auth git-credential"
+
+	// forkRemote is the git remote of the fork a pull request comes from
+	forkRemote = "fork"
+
+	// sessionMarker is created in the session directory once goose knows the session
+	sessionMarker = ".goose-session"
+
+	commandWaitDelay = 5 * time.Second
+
+	// defaultUsagePollInterval is how often the token usage is checked against the limits
+	defaultUsagePollInterval = 5 * time.Second
+)
+
+var (
+	repoNamePattern    = regexp.MustCompile(`^[A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+$`)
+	sessionNamePattern = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
 // GooseAgent implements the agent interface for Goose
 type GooseAgent struct {
-	Opts              GooseOptions
-	Repo              string
-	InstallationToken string
+	Opts GooseOptions
+
+	usagePollInterval time.Duration
 }
 
+// GooseOptions configure the agent of a session. The GitHub token expires, so
+// it is given to every execution through ExecuteOptions instead.
 type GooseOptions struct {
-	SessionID   string
-	APIType     GooseAPIType
-	APIKey      string
-	Instruction string
+	SessionID string
+	APIType   GooseAPIType
+	APIKey    string
+	Repo      string
+	WorkDir   string // Directory holding the session workspaces (default is ./tmp)
 }
 
 // NewGooseAgent creates a new Goose agent
@@ -43,107 +75,472 @@ func NewGooseAgent(opts GooseOptions) (Agent, error) {
 		return nil, fmt.Errorf("API key is required for Goose agent")
 	}
 
+	if opts.Repo != "" && !repoNamePattern.MatchString(opts.Repo) {
+		return nil, fmt.Errorf("invalid repository name: %q", opts.Repo)
+	}
+
+	if opts.WorkDir == "" {
+		opts.WorkDir = defaultWorkDir
+	}
+
 	return &GooseAgent{
-		Opts: opts,
+		Opts:              opts,
+		usagePollInterval: defaultUsagePollInterval,
 	}, nil
 }
 
-func setFile(text string) (*os.File, error) {
-	f, err := os.CreateTemp("", "goose-script-*.sh")
+// sessionName returns the session ID in a form usable as goose session name
+// and directory name
+func sessionName(sessionID string) string {
+	name := sessionNamePattern.ReplaceAllString(sessionID, "-")
+	// Never resolve to the parent or current directory
+	return strings.TrimLeft(name, ".")
+}
+
+// writePrompt writes the prompt to a file only readable by the current user
+func writePrompt(dir, input string) (string, error) {
+	f, err := os.CreateTemp(dir, "goose-prompt-*.md")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temp file: %w", err)
+		return "", fmt.Errorf("failed to create prompt file: %w", err)
+	}
+
+	if _, err := f.WriteString(input); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write prompt file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to close prompt file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// environ returns the environment of the commands run by the agent. The
+// token of the execution is only passed through the environment, never as an
+// argument.
+func (a *GooseAgent) environ(ctx context.Context) []string {
+	env := make([]string, 0, len(os.Environ())+6)
+	for _, kv := range os.Environ() {
+		if strings.HasPrefix(kv, "GH_TOKEN=") || strings.HasPrefix(kv, "GITHUB_TOKEN=") {
+			continue
+		}
+		env = append(env, kv)
+	}
+
+	if token := ExecuteOptionsFrom(ctx).GitHubToken; token != "" {
+		env = append(env, "GH_TOKEN="+token, "GITHUB_TOKEN="+token)
+	}
+	return append(env,
+		"GIT_AUTHOR_NAME=kommon",
+		"GIT_AUTHOR_EMAIL=kommon@kommon.dev",
+		"GIT_COMMITTER_NAME=kommon",
+		"GIT_COMMITTER_EMAIL=kommon@kommon.dev",
+	)
+}
+
+// run executes the command without a shell and returns its combined output
+func (a *GooseAgent) run(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Env = a.environ(ctx)
+	log.Printf("Executing command: %s (in %s)", cmd.String(), dir)
+	return cmd.CombinedOutput()
+}
+
+// prepareWorkspace clones the repository into the session directory on first
+// use, at the base branch when one is given
+func (a *GooseAgent) prepareWorkspace(ctx context.Context, sessionDir, baseBranch string) (string, error) {
+	repoDir := filepath.Join(sessionDir, "repo")
+	if a.Opts.Repo == "" {
+		if err := os.MkdirAll(repoDir, 0755); err != nil {
+			return "", fmt.Errorf("failed to create workspace: %w", err)
+		}
+		return repoDir, nil
 	}
-	log.Printf("Created temporary file: %s", f.Name())
 
-	_, writeErr := f.WriteString(text)
-	if writeErr != nil {
-		return nil, fmt.Errorf("failed to write to file: %w", writeErr)
+	if _, err := os.Stat(filepath.Join(repoDir, ".git")); err == nil {
+		return repoDir, nil
+	}
+
+	url := fmt.Sprintf("https://github.com/%s.git", a.Opts.Repo)
+	args := []string{
+		"-c", "credential.helper=",
+		"-c", "credential.helper=" + gitCredentialHelper,
+		"clone",
+	}
+	if baseBranch != "" {
+		args = append(args, "--branch", baseBranch)
+	}
+	if out, err := a.run(ctx, sessionDir, "git", append(args, "--", url, repoDir)...); err != nil {
+		return "", fmt.Errorf("failed to clone %s: %w: %s", a.Opts.Repo, err, out)
+	}
+
+	// Later pushes by goose authenticate the same way
+	if out, err := a.run(ctx, repoDir, "git", "config", "--local", "credential.helper", gitCredentialHelper); err != nil {
+		return "", fmt.Errorf("failed to configure git credentials: %w: %s", err, out)
+	}
+	return repoDir, nil
+}
+
+// checkoutBranch switches the workspace to the branch of the options,
+// creating it from the base branch when it doesn't exist on the remote yet.
+// An existing branch is fast-forwarded to commits pushed since the last run.
+//
+// The branch of a fork is fetched from its own remote and checked out as
+// <owner>/<branch>, so that it can't clash with the branches of the cloned
+// repository, and git push sends it back to the fork.
+func (a *GooseAgent) checkoutBranch(ctx context.Context, repoDir string, opts ExecuteOptions) error {
+	branch, remote := opts.Branch, "origin"
+	if a.Opts.Repo != "" {
+		if opts.HeadRepo != "" && !strings.EqualFold(opts.HeadRepo, a.Opts.Repo) {
+			remote = forkRemote
+			if err := a.addForkRemote(ctx, repoDir, opts.HeadRepo); err != nil {
+				return err
+			}
+		}
+		if out, err := a.run(ctx, repoDir, "git", "fetch", "origin"); err != nil {
+			return fmt.Errorf("failed to fetch %s: %w: %s", a.Opts.Repo, err, out)
+		}
+	}
+
+	if remote == forkRemote {
+		owner, _, _ := strings.Cut(opts.HeadRepo, "/")
+		local := owner + "/" + branch
+		if _, err := a.run(ctx, repoDir, "git", "checkout", local, "--"); err == nil {
+			a.fastForward(ctx, repoDir, remote+"/"+branch)
+			return nil
+		}
+		if out, err := a.run(ctx, repoDir, "git", "checkout", "-b", local, "--track", remote+"/"+branch, "--"); err != nil {
+			return fmt.Errorf("failed to check out branch %s of %s: %w: %s", branch, opts.HeadRepo, err, out)
+		}
+		return nil
+	}
+
+	if _, err := a.run(ctx, repoDir, "git", "checkout", branch, "--"); err == nil {
+		if a.Opts.Repo != "" {
+			a.fastForward(ctx, repoDir, remote+"/"+branch)
+		}
+		return nil
+	}
+	args := []string{"checkout", "-b", branch}
+	if opts.BaseBranch != "" && a.Opts.Repo != "" {
+		args = append(args, "origin/"+opts.BaseBranch)
+	}
+	if out, err := a.run(ctx, repoDir, "git", append(args, "--")...); err != nil {
+		return fmt.Errorf("failed to check out branch %s: %w: %s", branch, err, out)
+	}
+	return nil
+}
+
+// addForkRemote points the fork remote at the repository and fetches it.
+// Pushes of branches tracking it go back to the fork.
+func (a *GooseAgent) addForkRemote(ctx context.Context, repoDir, headRepo string) error {
+	url := fmt.Sprintf("https://github.com/%s.git", headRepo)
+	if _, err := a.run(ctx, repoDir, "git", "remote", "add", forkRemote, url); err != nil {
+		// The remote is left by a previous run
+		if out, err := a.run(ctx, repoDir, "git", "remote", "set-url", forkRemote, url); err != nil {
+			return fmt.Errorf("failed to add remote for %s: %w: %s", headRepo, err, out)
+		}
+	}
+	if out, err := a.run(ctx, repoDir, "git", "config", "--local", "push.default", "upstream"); err != nil {
+		return fmt.Errorf("failed to configure git push: %w: %s", err, out)
+	}
+	if out, err := a.run(ctx, repoDir, "git", "fetch", forkRemote); err != nil {
+		return fmt.Errorf("failed to fetch %s: %w: %s", headRepo, err, out)
+	}
+	return nil
+}
+
+// fastForward brings the checked out branch up to date with the remote
+// branch. A branch that diverged, or doesn't exist on the remote yet, is
+// left as it is for the agent to deal with.
+func (a *GooseAgent) fastForward(ctx context.Context, repoDir, remoteBranch string) {
+	_, _ = a.run(ctx, repoDir, "git", "merge", "--ff-only", remoteBranch)
+}
+
+// runSetup runs the setup commands of the repository in the workspace. They
+// run without the token, which they have no need for.
+func (a *GooseAgent) runSetup(ctx context.Context, repoDir string, commands []string) error {
+	opts := ExecuteOptionsFrom(ctx)
+	opts.GitHubToken = ""
+	ctx = WithExecuteOptions(ctx, opts)
+	for _, command := range commands {
+		if out, err := a.run(ctx, repoDir, "sh", "-c", command); err != nil {
+			return fmt.Errorf("setup command %q failed: %w: %s", command, err, out)
+		}
 	}
+	return nil
+}
 
-	// Make the script executable
-	if chmodErr := os.Chmod(f.Name(), 0755); chmodErr != nil {
-		return nil, fmt.Errorf("failed to chmod file: %w", chmodErr)
+// resetWorkspace discards the changes left by a canceled execution, so the
+// next execution starts from a clean working tree
+func (a *GooseAgent) resetWorkspace(repoDir string) {
+	if _, err := os.Stat(filepath.Join(repoDir, ".git")); err != nil {
+		return
 	}
-	log.Printf("Set executable permissions on file: %s", f.Name())
 
-	return f, nil
+	// The execution context is already canceled
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Leave an interrupted merge or rebase first; these fail when there is none
+	_, _ = a.run(ctx, repoDir, "git", "merge", "--abort")
+	_, _ = a.run(ctx, repoDir, "git", "rebase", "--abort")
+	if out, err := a.run(ctx, repoDir, "git", "reset", "--hard"); err != nil {
+		log.Printf("Failed to reset workspace %s: %v: %s", repoDir, err, out)
+	}
+	if out, err := a.run(ctx, repoDir, "git", "clean", "-fd"); err != nil {
+		log.Printf("Failed to clean workspace %s: %v: %s", repoDir, err, out)
+	}
 }
 
-// Execute sends a command to Goose
+// Execute sends a command to Goose. The prompt is passed to goose through a
+// file and the token through the environment, so neither is ever
+// interpreted by a shell. ExecuteOptions in the context select the model,
+// the branch and the token.
 func (a *GooseAgent) Execute(ctx context.Context, input string) (string, error) {
-	instruction := `gh command can be used. all edit is under new branch checkout from main and PR it.`
-	i, err := setFile(instruction)
+	events, err := a.ExecuteStream(ctx, input)
 	if err != nil {
-		log.Printf("Error setting instruction file: %v", err)
 		return "", err
 	}
-	defer func() {
-		i.Close()
-		removeErr := os.Remove(i.Name())
-		if removeErr != nil {
-			log.Printf("Failed to remove instruction file %s: %v", i.Name(), removeErr)
+
+	output, execErr := Collect(events)
+	if execErr != nil {
+		log.Printf("Command output: %s", output)
+		return "", execErr
+	}
+	return output, nil
+}
+
+// ExecuteStream implements StreamingAgent.ExecuteStream. Lines printed by
+// goose are reported as they are written.
+func (a *GooseAgent) ExecuteStream(ctx context.Context, input string) (<-chan Event, error) {
+	name := sessionName(a.Opts.SessionID)
+	if name == "" {
+		return nil, fmt.Errorf("invalid session ID: %q", a.Opts.SessionID)
+	}
+
+	workDir, err := filepath.Abs(a.Opts.WorkDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve work directory: %w", err)
+	}
+	sessionDir := filepath.Join(workDir, name)
+	if err := os.MkdirAll(sessionDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	// Executions of a session share the workspace and the goose session, so
+	// only one of them may run at a time
+	unlock, lockErr := lockWorkspace(ctx, filepath.Join(workDir, name+".lock"))
+	if lockErr != nil {
+		return nil, fmt.Errorf("failed to lock session workspace: %w", lockErr)
+	}
+
+	// A cancellation that raced with the end of the previous execution
+	marker := cancelMarker(workDir, name)
+	_ = os.Remove(marker)
+
+	// An execution exceeding a limit is canceled with the limit as cause
+	limits := ExecuteOptionsFrom(ctx).Limits
+	ctx, stop := context.WithCancelCause(ctx)
+	stopTimeout := func() {}
+	if limits.Timeout > 0 {
+		ctx, stopTimeout = context.WithTimeoutCause(ctx, limits.Timeout, NewTimeoutError(limits.Timeout))
+	}
+	release := func() {
+		stopTimeout()
+		stop(nil)
+		unlock()
+	}
+
+	cmd, promptFile, err := a.gooseCommand(ctx, name, sessionDir, input)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	pid := pidFile(workDir, name)
+	cleanup := func() {
+		if removeErr := os.Remove(promptFile); removeErr != nil {
+			log.Printf("Failed to remove prompt file %s: %v", promptFile, removeErr)
 		}
+		_ = os.Remove(pid)
+		release()
+	}
+
+	// Usage is reported for the whole session, so only the growth counts
+	baseTokens, _ := gooseTokens(name)
+
+	// stdout and stderr are merged like CombinedOutput did
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	log.Printf("Executing command: %s (in %s)", cmd.String(), cmd.Dir)
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		cleanup()
+		return nil, fmt.Errorf("command execution failed: %w", err)
+	}
+
+	// CancelExecution finds the process through this file
+	if pidErr := os.WriteFile(pid, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); pidErr != nil {
+		log.Printf("Failed to write pid file %s: %v", pid, pidErr)
+	}
+
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- cmd.Wait()
+		pw.Close()
 	}()
 
-	script := fmt.Sprintf(`#!/bin/bash
-gh auth login --with-token <<< "%s"
-gh auth setup-git
-SESSION_ID=%s
-SESSION_DIR=./tmp/$SESSION_ID
-REPO=%s
-INPUT="%s"
-ls $SESSION_DIR || (mkdir -p $SESSION_DIR; git clone $REPO $SESSION_DIR/repo)
-cd $SESSION_DIR/repo
-git config --global user.email "kommon@kommon.dev"
-git config --global user.name "kommon"
-goose run --name $SESSION_ID -r --text "$INPUT" || goose run --name $SESSION_ID --text "$INPUT" 
-gh auth logout
-`, a.InstallationToken, strings.ReplaceAll(a.Opts.SessionID, "/", "-"), fmt.Sprintf("https://github.com/%s", a.Repo), input)
+	if limits.tokenBudget() {
+		go a.watchTokens(ctx, name, baseTokens, limits, stop)
+	}
 
-	f, scriptErr := os.CreateTemp("", "goose-script-*.sh")
-	if scriptErr != nil {
-		log.Printf("Error creating script file: %v", scriptErr)
-		return "", fmt.Errorf("failed to create script file: %w", scriptErr)
+	var output io.Reader = pr
+	if limits.MaxOutputBytes > 0 {
+		output = &limitedReader{r: pr, max: limits.MaxOutputBytes, exceeded: func() {
+			stop(outputLimitError(limits.MaxOutputBytes))
+		}}
 	}
 
-	log.Printf("Created script file: %s", f.Name())
-	log.Printf("Script contents:\n%s", script)
+	events := make(chan Event, 16)
+	go func() {
+		defer close(events)
+		defer cleanup()
 
-	_, writeErr := f.WriteString(script)
-	if writeErr != nil {
-		log.Printf("Error writing to script file: %v", writeErr)
-		return "", fmt.Errorf("failed to write script: %w", writeErr)
+		scanErr := scanEvents(output, events)
+		// Drain whatever is left so the process never blocks on a full pipe
+		_, _ = io.Copy(io.Discard, pr)
+
+		exit := Event{Type: EventExit}
+		err := <-waitErr
+		markSession(sessionDir, name, err)
+		if err != nil {
+			log.Printf("Command execution error: %v", err)
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				exit.ExitCode = exitErr.ExitCode()
+			}
+			exit.Err = fmt.Errorf("command execution failed: %w", err)
+		} else if scanErr != nil {
+			exit.Err = fmt.Errorf("failed to read command output: %w", scanErr)
+		}
+
+		canceled := ctx.Err() != nil
+		if removeErr := os.Remove(marker); removeErr == nil {
+			canceled = true
+		}
+		var limitErr *LimitError
+		switch {
+		case errors.As(context.Cause(ctx), &limitErr):
+			log.Printf("Execution stopped: %v", limitErr)
+			a.resetWorkspace(cmd.Dir)
+			exit.Err = limitErr
+		case canceled:
+			a.resetWorkspace(cmd.Dir)
+			// goose may also have finished by itself after the cancellation
+			exit.Err = ErrCanceled
+			if err != nil {
+				exit.Err = fmt.Errorf("%w: %v", ErrCanceled, err)
+			}
+		}
+		events <- exit
+	}()
+
+	return events, nil
+}
+
+// markSession records that goose knows the session, so that later executions
+// resume it. goose may fail before creating the session, e.g. for an unknown
+// model, so a failed execution only counts when goose saved the session.
+func markSession(sessionDir, name string, exitErr error) {
+	if exitErr != nil {
+		path := gooseSessionFile(name)
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			return
+		}
+	}
+	marker := filepath.Join(sessionDir, sessionMarker)
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		log.Printf("Failed to create session marker %s: %v", marker, err)
 	}
+}
+
+// watchTokens stops the execution once the tokens used since it started
+// exceed the limits
+func (a *GooseAgent) watchTokens(ctx context.Context, name string, baseTokens int64, limits Limits, stop context.CancelCauseFunc) {
+	ticker := time.NewTicker(a.usagePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 
-	if chmodErr := os.Chmod(f.Name(), 0755); chmodErr != nil {
-		log.Printf("Error setting script permissions: %v", chmodErr)
-		return "", fmt.Errorf("failed to set script permissions: %w", chmodErr)
+		tokens, ok := gooseTokens(name)
+		if !ok {
+			continue
+		}
+		if limitErr := limits.checkUsage(tokens - baseTokens); limitErr != nil {
+			stop(limitErr)
+			return
+		}
+	}
+}
+
+// gooseCommand prepares the workspace and the prompt file and returns the
+// goose command to run
+func (a *GooseAgent) gooseCommand(ctx context.Context, name, sessionDir, input string) (*exec.Cmd, string, error) {
+	opts := ExecuteOptionsFrom(ctx)
+	if err := opts.Validate(); err != nil {
+		return nil, "", err
 	}
 
-	if closeErr := f.Close(); closeErr != nil {
-		log.Printf("Error closing script file: %v", closeErr)
-		return "", fmt.Errorf("failed to close script file: %w", closeErr)
+	repoDir, err := a.prepareWorkspace(ctx, sessionDir, opts.BaseBranch)
+	if err != nil {
+		return nil, "", err
 	}
 
-	defer func() {
-		removeErr := os.Remove(f.Name())
-		if removeErr != nil {
-			log.Printf("Failed to remove script file %s: %v", f.Name(), removeErr)
+	if opts.Branch != "" {
+		if err := a.checkoutBranch(ctx, repoDir, opts); err != nil {
+			return nil, "", err
 		}
-	}()
+	}
 
-	// #nosec G204 -- This is a controlled environment where we create the script
-	cmd := exec.CommandContext(ctx, "bash", f.Name())
-	log.Printf("Executing command: %v", cmd.String())
+	if err := a.runSetup(ctx, repoDir, opts.Setup); err != nil {
+		return nil, "", err
+	}
 
-	out, execErr := cmd.CombinedOutput()
-	if execErr != nil {
-		log.Printf("Command execution error: %v", execErr)
-		log.Printf("Command output: %s", string(out))
-		return "", fmt.Errorf("command execution failed: %w", execErr)
+	promptFile, err := writePrompt(sessionDir, input)
+	if err != nil {
+		return nil, "", err
 	}
 
-	return string(out), nil
+	args := []string{"run", "--name=" + name, "--instructions=" + promptFile}
+	// Resume the goose session once it exists so the history is kept
+	if _, statErr := os.Stat(filepath.Join(sessionDir, sessionMarker)); statErr == nil {
+		args = append(args, "--resume")
+	}
+
+	cmd := exec.CommandContext(ctx, "goose", args...)
+	cmd.Dir = repoDir
+	cmd.Env = a.environ(ctx)
+	setProcessGroup(cmd)
+	// Don't wait forever for output of processes that outlive goose
+	cmd.WaitDelay = commandWaitDelay
+	if opts.Model != "" {
+		cmd.Env = append(cmd.Env, "GOOSE_MODEL="+opts.Model)
+	}
+	if opts.Provider != "" {
+		cmd.Env = append(cmd.Env, "GOOSE_PROVIDER="+opts.Provider)
+	}
+	return cmd, promptFile, nil
 }
 
 // GetSessionID returns the current session ID
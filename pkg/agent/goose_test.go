@@ -0,0 +1,497 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "ghs_testtoken"
+
+// Fake commands record what they receive instead of doing any work
+const (
+	fakeGit = `#!/bin/sh
+printf '%s\n' "$@" >> "$FAKE_ARGS_LOG"
+for arg in "$@"; do
+	if [ "$arg" = "clone" ]; then
+		for dir in "$@"; do :; done
+		mkdir -p "$dir/.git"
+	fi
+done
+`
+	fakeGoose = `#!/bin/sh
+printf '%s\n' "$@" >> "$FAKE_ARGS_LOG"
+printf '%s' "$GH_TOKEN" > "$FAKE_TOKEN"
+printf '%s' "$GOOSE_MODEL" > "$FAKE_MODEL"
+for arg in "$@"; do
+	case "$arg" in
+	--instructions=*) cp "${arg#--instructions=}" "$FAKE_PROMPT" ;;
+	--name=*) name="${arg#--name=}" ;;
+	esac
+done
+if [ -n "$FAKE_GOOSE_TOKENS" ]; then
+	mkdir -p "$XDG_DATA_HOME/goose/sessions"
+	echo "{\"accumulated_total_tokens\": $FAKE_GOOSE_TOKENS}" > "$XDG_DATA_HOME/goose/sessions/$name.jsonl"
+fi
+if [ -n "$FAKE_GOOSE_OUTPUT" ]; then
+	printf '%s\n' "$FAKE_GOOSE_OUTPUT"
+fi
+if [ -n "$FAKE_GOOSE_SLEEP" ]; then
+	echo sleeping
+	sleep "$FAKE_GOOSE_SLEEP"
+fi
+echo done
+exit "${FAKE_GOOSE_EXIT:-0}"
+`
+)
+
+type fakeTools struct {
+	argsLog string
+	token   string
+	model   string
+	prompt  string
+	canary  string
+}
+
+// installFakeTools puts fake git, gh and goose commands first in PATH
+func installFakeTools(t testing.TB, setenv func(key, value string)) fakeTools {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	require.NoError(t, os.MkdirAll(bin, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "git"), []byte(fakeGit), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "goose"), []byte(fakeGoose), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "gh"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+
+	tools := fakeTools{
+		argsLog: filepath.Join(dir, "args.log"),
+		token:   filepath.Join(dir, "token"),
+		model:   filepath.Join(dir, "model"),
+		prompt:  filepath.Join(dir, "prompt"),
+		canary:  filepath.Join(dir, "pwned"),
+	}
+	setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setenv("FAKE_ARGS_LOG", tools.argsLog)
+	setenv("FAKE_TOKEN", tools.token)
+	setenv("FAKE_MODEL", tools.model)
+	setenv("FAKE_PROMPT", tools.prompt)
+	// Injected commands in the seeds try to create this file
+	setenv("KOMMON_CANARY", tools.canary)
+	setenv("XDG_DATA_HOME", filepath.Join(dir, "data"))
+	return tools
+}
+
+func newTestGooseAgent(t testing.TB, workDir string) *GooseAgent {
+	a, err := NewGooseAgent(GooseOptions{
+		SessionID: "owner/repo-1",
+		APIKey:    "api-key",
+		Repo:      "owner/repo",
+		WorkDir:   workDir,
+	})
+	require.NoError(t, err)
+	return a.(*GooseAgent)
+}
+
+func TestGooseAgentExecute(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	workDir := t.TempDir()
+	a := newTestGooseAgent(t, workDir)
+
+	output, err := a.Execute(context.Background(), "first prompt")
+	require.NoError(t, err)
+	assert.Equal(t, "done\n", output)
+	assert.DirExists(t, filepath.Join(workDir, "owner-repo-1", "repo", ".git"))
+
+	output, err = a.Execute(context.Background(), "second prompt")
+	require.NoError(t, err)
+	assert.Equal(t, "done\n", output)
+
+	args, err := os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(string(args), "clone\n"), "the repository is cloned once")
+	assert.Equal(t, 1, strings.Count(string(args), "--resume\n"), "the second run resumes the session")
+	assert.Contains(t, string(args), "--name=owner-repo-1\n")
+
+	prompt, err := os.ReadFile(tools.prompt)
+	require.NoError(t, err)
+	assert.Equal(t, "second prompt", string(prompt))
+
+	// Prompt files are removed after the run
+	matches, err := filepath.Glob(filepath.Join(workDir, "owner-repo-1", "goose-prompt-*"))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+}
+
+func TestGooseAgentToken(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	a := newTestGooseAgent(t, t.TempDir())
+
+	// Installation tokens expire, so every execution of the agent brings its own
+	for _, token := range []string{"ghs_first", "ghs_second"} {
+		ctx := WithExecuteOptions(context.Background(), ExecuteOptions{GitHubToken: token})
+		_, err := a.Execute(ctx, "prompt")
+		require.NoError(t, err)
+
+		received, err := os.ReadFile(tools.token)
+		require.NoError(t, err)
+		assert.Equal(t, token, string(received))
+	}
+}
+
+func TestGooseAgentExecuteStream(t *testing.T) {
+	installFakeTools(t, t.Setenv)
+	t.Setenv("FAKE_GOOSE_OUTPUT", "starting\n─── shell | developer ──────────────────────────\ncommand: ls")
+	t.Setenv("FAKE_GOOSE_EXIT", "3")
+	a := newTestGooseAgent(t, t.TempDir())
+
+	events, err := a.ExecuteStream(context.Background(), "prompt")
+	require.NoError(t, err)
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+
+	require.Len(t, received, 6)
+	assert.Equal(t, Event{Type: EventOutput, Text: "starting"}, received[0])
+	assert.Equal(t, EventToolCall, received[1].Type)
+	assert.Equal(t, "developer__shell", received[1].Tool)
+	assert.Equal(t, EventOutput, received[2].Type)
+	assert.Equal(t, Event{Type: EventOutput, Text: "command: ls"}, received[3])
+	assert.Equal(t, Event{Type: EventOutput, Text: "done"}, received[4])
+
+	exit := received[5]
+	assert.Equal(t, EventExit, exit.Type)
+	assert.Equal(t, 3, exit.ExitCode)
+	assert.Error(t, exit.Err)
+
+	// Execute reports the same failure
+	_, err = a.Execute(context.Background(), "prompt")
+	assert.Error(t, err)
+}
+
+func TestGooseAgentExecuteOptions(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	a := newTestGooseAgent(t, t.TempDir())
+
+	ctx := WithExecuteOptions(context.Background(), ExecuteOptions{Model: "openai/gpt-4o", Branch: "fix/login"})
+	_, err := a.Execute(ctx, "prompt")
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "fetch\norigin\n")
+	assert.Contains(t, string(args), "checkout\nfix/login\n--\n")
+	assert.Contains(t, string(args), "merge\n--ff-only\norigin/fix/login\n")
+
+	model, err := os.ReadFile(tools.model)
+	require.NoError(t, err)
+	assert.Equal(t, "openai/gpt-4o", string(model))
+
+	for _, opts := range []ExecuteOptions{
+		{Branch: "--upload-pack=touch"},
+		{Branch: "../main"},
+		{Branch: "fix login"},
+		{Model: "-x"},
+		{Model: "gpt 4"},
+	} {
+		_, err := a.Execute(WithExecuteOptions(context.Background(), opts), "prompt")
+		assert.Error(t, err, opts)
+	}
+}
+
+func TestGooseAgentForkBranch(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	a := newTestGooseAgent(t, t.TempDir())
+
+	ctx := WithExecuteOptions(context.Background(), ExecuteOptions{Branch: "main", HeadRepo: "alice/repo"})
+	_, err := a.Execute(ctx, "prompt")
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "remote\nadd\nfork\nhttps://github.com/alice/repo.git\n")
+	assert.Contains(t, string(args), "config\n--local\npush.default\nupstream\n")
+	assert.Contains(t, string(args), "fetch\nfork\n")
+	// The branch of the fork doesn't clash with main of the repository
+	assert.Contains(t, string(args), "checkout\nalice/main\n--\n")
+	assert.Contains(t, string(args), "merge\n--ff-only\nfork/main\n")
+
+	for _, opts := range []ExecuteOptions{
+		{HeadRepo: "alice/repo"},
+		{HeadRepo: "-alice/repo", Branch: "main"},
+		{HeadRepo: "alice", Branch: "main"},
+	} {
+		_, err := a.Execute(WithExecuteOptions(context.Background(), opts), "prompt")
+		assert.Error(t, err, opts)
+	}
+}
+
+func TestGooseAgentSetup(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	workDir := t.TempDir()
+	a := newTestGooseAgent(t, workDir)
+
+	ctx := WithExecuteOptions(context.Background(), ExecuteOptions{
+		BaseBranch:  "develop",
+		Setup:       []string{"echo one > setup.log", "echo two >> setup.log", "echo ${GH_TOKEN:-none} ${GITHUB_TOKEN:-none} > token.log"},
+		GitHubToken: testToken,
+	})
+	_, err := a.Execute(ctx, "prompt")
+	require.NoError(t, err)
+
+	args, err := os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "clone\n--branch\ndevelop\n--\n")
+
+	// Setup commands run in order in the workspace
+	setupLog, err := os.ReadFile(filepath.Join(workDir, "owner-repo-1", "repo", "setup.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "one\ntwo\n", string(setupLog))
+	// and without the token
+	tokenLog, err := os.ReadFile(filepath.Join(workDir, "owner-repo-1", "repo", "token.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "none none\n", string(tokenLog))
+
+	// goose doesn't run when a setup command fails
+	before := strings.Count(string(args), "--name=")
+	_, err = a.Execute(WithExecuteOptions(context.Background(), ExecuteOptions{Setup: []string{"exit 3"}}), "prompt")
+	assert.ErrorContains(t, err, `setup command "exit 3" failed`)
+	args, err = os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Equal(t, before, strings.Count(string(args), "--name="))
+
+	for _, opts := range []ExecuteOptions{
+		{BaseBranch: "-main"},
+		{Provider: "Open Router"},
+	} {
+		_, err := a.Execute(WithExecuteOptions(context.Background(), opts), "prompt")
+		assert.Error(t, err, opts)
+	}
+}
+
+func TestGooseAgentResume(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	a := newTestGooseAgent(t, t.TempDir())
+	resumes := func() int {
+		args, err := os.ReadFile(tools.argsLog)
+		require.NoError(t, err)
+		return strings.Count(string(args), "--resume\n")
+	}
+
+	// goose failed before creating the session, e.g. for an unknown model
+	t.Setenv("FAKE_GOOSE_EXIT", "1")
+	_, err := a.Execute(context.Background(), "prompt")
+	require.Error(t, err)
+	_, err = a.Execute(context.Background(), "prompt")
+	require.Error(t, err)
+	assert.Equal(t, 0, resumes(), "a session goose never created is not resumed")
+
+	// goose saved the session before failing
+	t.Setenv("FAKE_GOOSE_TOKENS", "100")
+	_, err = a.Execute(context.Background(), "prompt")
+	require.Error(t, err)
+	t.Setenv("FAKE_GOOSE_EXIT", "")
+	_, err = a.Execute(context.Background(), "prompt")
+	require.NoError(t, err)
+	assert.Equal(t, 1, resumes())
+}
+
+// startSleepingGoose starts an execution that runs until it is killed
+func startSleepingGoose(t *testing.T, ctx context.Context, a *GooseAgent) <-chan Event {
+	t.Setenv("FAKE_GOOSE_SLEEP", "60")
+	events, err := a.ExecuteStream(ctx, "prompt")
+	require.NoError(t, err)
+
+	first := <-events
+	require.Equal(t, Event{Type: EventOutput, Text: "sleeping"}, first)
+	return events
+}
+
+func TestGooseAgentCancel(t *testing.T) {
+	tools := installFakeTools(t, t.Setenv)
+	workDir := t.TempDir()
+	a := newTestGooseAgent(t, workDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := startSleepingGoose(t, ctx, a)
+	assert.FileExists(t, filepath.Join(workDir, "owner-repo-1.pid"))
+
+	start := time.Now()
+	cancel()
+	_, err := Collect(events)
+	assert.ErrorIs(t, err, ErrCanceled)
+	assert.Less(t, time.Since(start), 30*time.Second, "the sleeping child is killed with goose")
+	assert.NoFileExists(t, filepath.Join(workDir, "owner-repo-1.pid"))
+
+	// The changes of the canceled execution are discarded
+	args, err := os.ReadFile(tools.argsLog)
+	require.NoError(t, err)
+	assert.Contains(t, string(args), "reset\n--hard\n")
+	assert.Contains(t, string(args), "clean\n-fd\n")
+}
+
+func TestCancelExecution(t *testing.T) {
+	installFakeTools(t, t.Setenv)
+	workDir := t.TempDir()
+	a := newTestGooseAgent(t, workDir)
+
+	assert.ErrorIs(t, CancelExecution(workDir, "owner/repo-1"), ErrNoExecution)
+
+	events := startSleepingGoose(t, context.Background(), a)
+	require.NoError(t, CancelExecution(workDir, "owner/repo-1"))
+	_, err := Collect(events)
+	assert.ErrorIs(t, err, ErrCanceled)
+
+	// The next execution is not affected by the cancellation
+	t.Setenv("FAKE_GOOSE_SLEEP", "")
+	output, err := a.Execute(context.Background(), "prompt")
+	require.NoError(t, err)
+	assert.Equal(t, "done\n", output)
+	assert.NoFileExists(t, filepath.Join(workDir, "owner-repo-1.canceled"))
+}
+
+func TestCancelExecutionCleanExit(t *testing.T) {
+	installFakeTools(t, t.Setenv)
+	workDir := t.TempDir()
+	a := newTestGooseAgent(t, workDir)
+
+	t.Setenv("FAKE_GOOSE_SLEEP", "1")
+	events, err := a.ExecuteStream(context.Background(), "prompt")
+	require.NoError(t, err)
+	require.Equal(t, Event{Type: EventOutput, Text: "sleeping"}, <-events)
+	// Canceled without killing goose, which then exits with 0
+	require.NoError(t, os.WriteFile(cancelMarker(workDir, "owner-repo-1"), nil, 0644))
+
+	_, err = Collect(events)
+	assert.Equal(t, ErrCanceled, err)
+}
+
+func TestGooseAgentLimits(t *testing.T) {
+	installFakeTools(t, t.Setenv)
+	t.Setenv("FAKE_GOOSE_SLEEP", "60")
+
+	tests := []struct {
+		name   string
+		limits Limits
+		env    map[string]string
+		reason string
+	}{
+		{
+			name:   "Timeout",
+			limits: Limits{Timeout: 200 * time.Millisecond},
+			reason: "timed out after 200ms",
+		},
+		{
+			name:   "Output",
+			limits: Limits{MaxOutputBytes: 100},
+			env:    map[string]string{"FAKE_GOOSE_OUTPUT": strings.Repeat("x", 200)},
+			reason: "output exceeded 100 bytes",
+		},
+		{
+			name:   "Tokens",
+			limits: Limits{MaxTokens: 1000},
+			env:    map[string]string{"FAKE_GOOSE_TOKENS": "5000"},
+			reason: "token limit exceeded: used 5000 of 1000 tokens",
+		},
+		{
+			name:   "Cost",
+			limits: Limits{MaxCost: 0.01, CostPerMTokens: 10},
+			env:    map[string]string{"FAKE_GOOSE_TOKENS": "5000"},
+			reason: "cost limit exceeded: estimated $0.05 of $0.01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			// Each test starts without goose session history
+			t.Setenv("XDG_DATA_HOME", t.TempDir())
+			a := newTestGooseAgent(t, t.TempDir())
+			a.usagePollInterval = 10 * time.Millisecond
+
+			start := time.Now()
+			ctx := WithExecuteOptions(context.Background(), ExecuteOptions{Limits: tt.limits})
+			_, err := a.Execute(ctx, "prompt")
+			assert.Less(t, time.Since(start), 30*time.Second, "the execution is killed")
+
+			var limitErr *LimitError
+			require.ErrorAs(t, err, &limitErr)
+			assert.ErrorIs(t, err, ErrLimitExceeded)
+			assert.Equal(t, tt.reason, limitErr.Error())
+		})
+	}
+}
+
+func TestNewGooseAgentRejectsInvalidRepo(t *testing.T) {
+	for _, repo := range []string{"owner", "owner/repo;id", "--upload-pack=touch/x", "owner/repo name", "https://evil/owner/repo"} {
+		_, err := NewGooseAgent(GooseOptions{SessionID: "s", APIKey: "k", Repo: repo})
+		assert.Error(t, err, repo)
+	}
+}
+
+func FuzzGooseAgentPrompt(f *testing.F) {
+	for _, seed := range []string{
+		`$(touch "$KOMMON_CANARY")`,
+		"`touch $KOMMON_CANARY`",
+		`"; touch "$KOMMON_CANARY"; echo "`,
+		`'; touch "$KOMMON_CANARY"; echo '`,
+		"line\n touch $KOMMON_CANARY\n",
+		`\"$(touch $KOMMON_CANARY)\"`,
+		`${IFS}touch${IFS}$KOMMON_CANARY`,
+		"--help",
+		"EOF\ntouch $KOMMON_CANARY\nEOF",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	tools := installFakeTools(f, f.Setenv)
+	workDir := f.TempDir()
+
+	f.Fuzz(func(t *testing.T, prompt string) {
+		a := newTestGooseAgent(t, workDir)
+
+		ctx := WithExecuteOptions(context.Background(), ExecuteOptions{GitHubToken: testToken})
+		output, err := a.Execute(ctx, prompt)
+		require.NoError(t, err)
+		assert.Equal(t, "done\n", output)
+
+		_, statErr := os.Stat(tools.canary)
+		assert.True(t, os.IsNotExist(statErr), "prompt was interpreted by a shell")
+
+		// goose receives the prompt unchanged
+		received, err := os.ReadFile(tools.prompt)
+		require.NoError(t, err)
+		assert.Equal(t, prompt, string(received))
+
+		// The token only travels through the environment
+		token, err := os.ReadFile(tools.token)
+		require.NoError(t, err)
+		assert.Equal(t, testToken, string(token))
+		args, err := os.ReadFile(tools.argsLog)
+		require.NoError(t, err)
+		assert.NotContains(t, string(args), testToken)
+	})
+}
+
+func FuzzSessionName(f *testing.F) {
+	for _, seed := range []string{"owner/repo-1", "../../etc", ".", "..", "a b", "$(id)", "-rf"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, sessionID string) {
+		name := sessionName(sessionID)
+		assert.NotContains(t, name, "/")
+		assert.NotContains(t, name, string(filepath.Separator))
+		assert.False(t, strings.HasPrefix(name, "."))
+		assert.Regexp(t, `^[A-Za-z0-9_.-]*$`, name)
+	})
+}
@@ -5,3 +5,14 @@ import "context"
 type Agent interface {
 	Execute(ctx context.Context, input string) (string, error)
 }
+
+// StreamingAgent is implemented by agents that report their progress while
+// a prompt runs
+type StreamingAgent interface {
+	Agent
+
+	// ExecuteStream starts the prompt and returns its events. The last event
+	// is always EventExit, after which the channel is closed. The caller must
+	// receive until the channel is closed.
+	ExecuteStream(ctx context.Context, input string) (<-chan Event, error)
+}
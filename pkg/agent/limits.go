@@ -0,0 +1,207 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// LimitExitCode is the exit status of "kommon run" when a limit stopped the
+// execution, like timeout(1)
+const LimitExitCode = 124
+
+// LimitGracePeriod is the time given to an agent to stop by itself after its
+// timeout before the execution is abandoned, by the server as well as by the
+// deadline of Kubernetes Jobs
+const LimitGracePeriod = time.Minute
+
+// ErrLimitExceeded matches every *LimitError
+var ErrLimitExceeded = errors.New("execution limit exceeded")
+
+// Limits bound a single execution. Zero values mean no limit.
+type Limits struct {
+	Timeout        time.Duration `json:"timeout,omitempty"`                 // Wall-clock time
+	MaxOutputBytes int64         `json:"max_output_bytes,omitempty"`        // Output printed by the agent
+	MaxTokens      int64         `json:"max_tokens,omitempty"`              // LLM tokens reported by goose
+	MaxCost        float64       `json:"max_cost,omitempty"`                // USD, estimated from the reported tokens
+	CostPerMTokens float64       `json:"cost_per_million_tokens,omitempty"` // USD per million tokens used for the estimate
+}
+
+// Merge returns the limits with the values set in override replacing them
+func (l Limits) Merge(override Limits) Limits {
+	if override.Timeout != 0 {
+		l.Timeout = override.Timeout
+	}
+	if override.MaxOutputBytes != 0 {
+		l.MaxOutputBytes = override.MaxOutputBytes
+	}
+	if override.MaxTokens != 0 {
+		l.MaxTokens = override.MaxTokens
+	}
+	if override.MaxCost != 0 {
+		l.MaxCost = override.MaxCost
+	}
+	if override.CostPerMTokens != 0 {
+		l.CostPerMTokens = override.CostPerMTokens
+	}
+	return l
+}
+
+// tokenBudget reports whether tokens need to be watched
+func (l Limits) tokenBudget() bool {
+	return l.MaxTokens > 0 || (l.MaxCost > 0 && l.CostPerMTokens > 0)
+}
+
+// LimitKind names the limit an execution exceeded
+type LimitKind string
+
+const (
+	LimitTimeout LimitKind = "timeout"
+	LimitOutput  LimitKind = "output"
+	LimitTokens  LimitKind = "tokens"
+	LimitCost    LimitKind = "cost"
+)
+
+// LimitError reports an execution stopped because it exceeded a limit
+type LimitError struct {
+	Limit  LimitKind
+	Reason string // e.g. "timed out after 15m"
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+func (e *LimitError) Is(target error) bool {
+	return target == ErrLimitExceeded
+}
+
+var limitReasons = []struct {
+	kind   LimitKind
+	prefix string
+}{
+	{LimitTimeout, "timed out after "},
+	{LimitOutput, "output exceeded "},
+	{LimitTokens, "token limit exceeded: "},
+	{LimitCost, "cost limit exceeded: "},
+}
+
+// NewTimeoutError returns the error of an execution running longer than d
+func NewTimeoutError(d time.Duration) *LimitError {
+	return &LimitError{Limit: LimitTimeout, Reason: "timed out after " + FormatDuration(d)}
+}
+
+func outputLimitError(max int64) *LimitError {
+	return &LimitError{Limit: LimitOutput, Reason: fmt.Sprintf("output exceeded %d bytes", max)}
+}
+
+// checkUsage returns an error when the tokens used exceed the limits
+func (l Limits) checkUsage(tokens int64) *LimitError {
+	if l.MaxTokens > 0 && tokens > l.MaxTokens {
+		return &LimitError{Limit: LimitTokens, Reason: fmt.Sprintf("token limit exceeded: used %d of %d tokens", tokens, l.MaxTokens)}
+	}
+	if l.MaxCost > 0 && l.CostPerMTokens > 0 {
+		if cost := float64(tokens) / 1e6 * l.CostPerMTokens; cost > l.MaxCost {
+			return &LimitError{Limit: LimitCost, Reason: fmt.Sprintf("cost limit exceeded: estimated $%.2f of $%.2f", cost, l.MaxCost)}
+		}
+	}
+	return nil
+}
+
+// ParseLimitError finds the limit error printed by "kommon run" in its
+// output, for executors that only see the output and the exit status
+func ParseLimitError(output string) *LimitError {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		for _, r := range limitReasons {
+			// The reason may follow a prefix like "Error: "
+			if start := strings.Index(lines[i], r.prefix); start >= 0 {
+				return &LimitError{Limit: r.kind, Reason: strings.TrimSpace(lines[i][start:])}
+			}
+		}
+	}
+	return &LimitError{Reason: "execution limit exceeded"}
+}
+
+// FormatDuration formats d without trailing zero units, e.g. 15m instead of 15m0s
+func FormatDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// limitedReader calls exceeded once more than max bytes were read
+type limitedReader struct {
+	r        io.Reader
+	max      int64
+	read     atomic.Int64
+	exceeded func()
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if total := l.read.Add(int64(n)); total > l.max && total-int64(n) <= l.max {
+		l.exceeded()
+	}
+	return n, err
+}
+
+// gooseSessionFile returns the file where goose keeps the session history
+// and its token usage
+func gooseSessionFile(name string) string {
+	dataHome := os.Getenv("XDG_DATA_HOME")
+	if dataHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dataHome = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dataHome, "goose", "sessions", name+".jsonl")
+}
+
+// gooseTokens returns the tokens used by the goose session so far. It
+// returns false when goose didn't report any.
+func gooseTokens(name string) (int64, bool) {
+	path := gooseSessionFile(name)
+	if path == "" {
+		return 0, false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	// The first line holds the session metadata
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return 0, false
+	}
+	var metadata struct {
+		TotalTokens            *int64 `json:"total_tokens"`
+		AccumulatedTotalTokens *int64 `json:"accumulated_total_tokens"`
+	}
+	if err := json.Unmarshal(line, &metadata); err != nil {
+		return 0, false
+	}
+	switch {
+	case metadata.AccumulatedTotalTokens != nil:
+		return *metadata.AccumulatedTotalTokens, true
+	case metadata.TotalTokens != nil:
+		return *metadata.TotalTokens, true
+	}
+	return 0, false
+}
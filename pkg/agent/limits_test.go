@@ -0,0 +1,36 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimitsMerge(t *testing.T) {
+	base := Limits{Timeout: 30 * time.Minute, MaxOutputBytes: 1 << 20, MaxTokens: 100000}
+	merged := base.Merge(Limits{Timeout: 15 * time.Minute, MaxCost: 2})
+	assert.Equal(t, Limits{Timeout: 15 * time.Minute, MaxOutputBytes: 1 << 20, MaxTokens: 100000, MaxCost: 2}, merged)
+	assert.Equal(t, base, base.Merge(Limits{}))
+}
+
+func TestFormatDuration(t *testing.T) {
+	assert.Equal(t, "15m", FormatDuration(15*time.Minute))
+	assert.Equal(t, "1h", FormatDuration(time.Hour))
+	assert.Equal(t, "1h30m", FormatDuration(90*time.Minute))
+	assert.Equal(t, "1m30s", FormatDuration(90*time.Second))
+	assert.Equal(t, "200ms", FormatDuration(200*time.Millisecond))
+	assert.Equal(t, "timed out after 15m", NewTimeoutError(15*time.Minute).Error())
+}
+
+func TestParseLimitError(t *testing.T) {
+	err := ParseLimitError("working...\ntimed out after 15m\n")
+	assert.Equal(t, &LimitError{Limit: LimitTimeout, Reason: "timed out after 15m"}, err)
+
+	err = ParseLimitError("Error: output exceeded 100 bytes\n")
+	assert.Equal(t, &LimitError{Limit: LimitOutput, Reason: "output exceeded 100 bytes"}, err)
+
+	err = ParseLimitError("something else")
+	assert.Equal(t, LimitKind(""), err.Limit)
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package agent
+
+import (
+	"context"
+	"sync"
+)
+
+var workspaceLocks sync.Map
+
+// lockWorkspace serializes executions of a workspace within the process.
+// File locks are only used on unix platforms.
+func lockWorkspace(ctx context.Context, path string) (func(), error) {
+	value, _ := workspaceLocks.LoadOrStore(path, make(chan struct{}, 1))
+	lock := value.(chan struct{})
+
+	select {
+	case lock <- struct{}{}:
+		return func() { <-lock }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
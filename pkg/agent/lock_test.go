@@ -0,0 +1,47 @@
+package agent
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockWorkspace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tmp", "session.lock")
+
+	unlock, err := lockWorkspace(context.Background(), path)
+	require.NoError(t, err)
+
+	// A second execution waits until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = lockWorkspace(ctx, path)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// and acquires the lock once it is released
+	acquired := make(chan struct{})
+	go func() {
+		unlockSecond, err := lockWorkspace(context.Background(), path)
+		if err == nil {
+			unlockSecond()
+		}
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("lock acquired while held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	unlock()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not acquired after release")
+	}
+}
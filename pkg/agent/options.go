@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	branchNamePattern   = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+	modelNamePattern    = regexp.MustCompile(`^[A-Za-z0-9._:/@-]+$`)
+	providerNamePattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+)
+
+// ExecuteOptions change how a single prompt is executed
+type ExecuteOptions struct {
+	Model      string   // Model used instead of the configured one
+	Provider   string   // goose provider used instead of the configured one
+	Branch     string   // Branch checked out before the prompt runs
+	HeadRepo   string   // Fork (owner/name) the branch is fetched from and pushed to, if it isn't in the cloned repository
+	BaseBranch string   // Branch the workspace is cloned at and new branches start from
+	Setup      []string // Shell commands run in the workspace before the prompt
+	Limits     Limits   // Limits enforced while the prompt runs
+
+	// GitHubToken authenticates git and gh. Installation tokens expire, so a
+	// fresh one is given to every execution.
+	GitHubToken string
+}
+
+type executeOptionsKey struct{}
+
+// WithExecuteOptions returns a context carrying the options for Execute
+func WithExecuteOptions(ctx context.Context, opts ExecuteOptions) context.Context {
+	return context.WithValue(ctx, executeOptionsKey{}, opts)
+}
+
+// ExecuteOptionsFrom returns the options set with WithExecuteOptions
+func ExecuteOptionsFrom(ctx context.Context) ExecuteOptions {
+	opts, _ := ctx.Value(executeOptionsKey{}).(ExecuteOptions)
+	return opts
+}
+
+// Validate rejects values that could be mistaken for command line options
+// or aren't valid names
+func (o ExecuteOptions) Validate() error {
+	if o.Model != "" && (!modelNamePattern.MatchString(o.Model) || strings.HasPrefix(o.Model, "-")) {
+		return fmt.Errorf("invalid model: %q", o.Model)
+	}
+	if o.Provider != "" && !providerNamePattern.MatchString(o.Provider) {
+		return fmt.Errorf("invalid provider: %q", o.Provider)
+	}
+	if o.Branch != "" && !validBranchName(o.Branch) {
+		return fmt.Errorf("invalid branch: %q", o.Branch)
+	}
+	if o.BaseBranch != "" && !validBranchName(o.BaseBranch) {
+		return fmt.Errorf("invalid base branch: %q", o.BaseBranch)
+	}
+	if o.HeadRepo != "" && (!repoNamePattern.MatchString(o.HeadRepo) || strings.HasPrefix(o.HeadRepo, "-")) {
+		return fmt.Errorf("invalid head repository: %q", o.HeadRepo)
+	}
+	if o.HeadRepo != "" && o.Branch == "" {
+		return fmt.Errorf("head repository %s needs a branch", o.HeadRepo)
+	}
+	return nil
+}
+
+func validBranchName(name string) bool {
+	return branchNamePattern.MatchString(name) &&
+		!strings.HasPrefix(name, "-") &&
+		!strings.HasPrefix(name, "/") &&
+		!strings.HasSuffix(name, "/") &&
+		!strings.HasSuffix(name, ".lock") &&
+		!strings.Contains(name, "..") &&
+		!strings.Contains(name, "//") &&
+		!strings.Contains(name, "/.")
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package agent
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op without process groups; canceling the context
+// only kills the command itself
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process
+func killProcessGroup(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return p.Kill()
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// EventType represents the kind of an execution event
+type EventType string
+
+const (
+	// EventOutput is a line printed by the agent
+	EventOutput EventType = "output"
+	// EventToolCall is reported when the agent starts using a tool
+	EventToolCall EventType = "tool_call"
+	// EventExit is the last event of an execution
+	EventExit EventType = "exit"
+)
+
+const maxEventLineSize = 1024 * 1024
+
+// goose prints a header like "─── shell | developer ──────" before each tool call
+var toolCallPattern = regexp.MustCompile(`^─── (\S+) \| (\S+) ─`)
+
+// Event is reported by a StreamingAgent during an execution
+type Event struct {
+	Type     EventType
+	Text     string // Output line without the newline, or the raw tool call line
+	Tool     string // Tool name as extension__tool (for EventToolCall)
+	ExitCode int    // Exit status of the agent process (for EventExit)
+	Err      error  // Why the execution failed (for EventExit)
+}
+
+// Stream executes the prompt and returns its events. Agents that don't
+// implement StreamingAgent report their whole output when they finish.
+func Stream(ctx context.Context, a Agent, input string) (<-chan Event, error) {
+	if s, ok := a.(StreamingAgent); ok {
+		return s.ExecuteStream(ctx, input)
+	}
+
+	events := make(chan Event, 1)
+	go func() {
+		defer close(events)
+
+		output, err := a.Execute(ctx, input)
+		if output != "" {
+			for _, line := range strings.SplitAfter(output, "\n") {
+				if line != "" {
+					events <- Event{Type: EventOutput, Text: strings.TrimSuffix(line, "\n")}
+				}
+			}
+		}
+		events <- Event{Type: EventExit, Err: err}
+	}()
+	return events, nil
+}
+
+// Collect receives all events and returns the output lines and the error of
+// the exit event
+func Collect(events <-chan Event) (string, error) {
+	var output strings.Builder
+	var err error
+	for event := range events {
+		switch event.Type {
+		case EventOutput:
+			output.WriteString(event.Text)
+			output.WriteString("\n")
+		case EventExit:
+			err = event.Err
+		}
+	}
+	return output.String(), err
+}
+
+// scanEvents reports every line read from r as an output event, plus a tool
+// call event when the line announces one
+func scanEvents(r io.Reader, events chan<- Event) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventLineSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := toolCallPattern.FindStringSubmatch(line); m != nil {
+			events <- Event{Type: EventToolCall, Text: line, Tool: m[2] + "__" + m[1]}
+		}
+		events <- Event{Type: EventOutput, Text: line}
+	}
+	return scanner.Err()
+}
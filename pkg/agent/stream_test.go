@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type staticAgent struct {
+	output string
+	err    error
+}
+
+func (a *staticAgent) Execute(ctx context.Context, input string) (string, error) {
+	return a.output, a.err
+}
+
+func TestStreamWrapsPlainAgents(t *testing.T) {
+	failure := errors.New("failed")
+	events, err := Stream(context.Background(), &staticAgent{output: "first\nsecond\n", err: failure}, "prompt")
+	require.NoError(t, err)
+
+	var received []Event
+	for event := range events {
+		received = append(received, event)
+	}
+
+	assert.Equal(t, []Event{
+		{Type: EventOutput, Text: "first"},
+		{Type: EventOutput, Text: "second"},
+		{Type: EventExit, Err: failure},
+	}, received)
+}
+
+func TestCollect(t *testing.T) {
+	events := make(chan Event, 4)
+	events <- Event{Type: EventOutput, Text: "line"}
+	events <- Event{Type: EventToolCall, Text: "─── shell | developer ───", Tool: "developer__shell"}
+	events <- Event{Type: EventOutput, Text: "another line"}
+	events <- Event{Type: EventExit}
+	close(events)
+
+	output, err := Collect(events)
+	require.NoError(t, err)
+	assert.Equal(t, "line\nanother line\n", output)
+}
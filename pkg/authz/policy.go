@@ -0,0 +1,186 @@
+package authz
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Permission is a repository role of a user, from the weakest to the strongest
+type Permission string
+
+const (
+	PermissionNone     Permission = "none"
+	PermissionRead     Permission = "read"
+	PermissionTriage   Permission = "triage"
+	PermissionWrite    Permission = "write"
+	PermissionMaintain Permission = "maintain"
+	PermissionAdmin    Permission = "admin"
+)
+
+// DefaultPermission is the permission required when the policy sets none
+const DefaultPermission = PermissionWrite
+
+var permissionRanks = map[Permission]int{
+	PermissionNone:     0,
+	PermissionRead:     1,
+	PermissionTriage:   2,
+	PermissionWrite:    3,
+	PermissionMaintain: 4,
+	PermissionAdmin:    5,
+}
+
+// ParsePermission parses a permission name
+func ParsePermission(s string) (Permission, error) {
+	p := Permission(strings.ToLower(strings.TrimSpace(s)))
+	if _, ok := permissionRanks[p]; !ok {
+		return "", fmt.Errorf("unknown permission %q (must be none, read, triage, write, maintain or admin)", s)
+	}
+	return p, nil
+}
+
+// AtLeast reports whether p grants as much as min. Unknown permissions, like
+// custom roles, grant nothing.
+func (p Permission) AtLeast(min Permission) bool {
+	rank, ok := permissionRanks[p]
+	return ok && rank >= permissionRanks[min]
+}
+
+// Policy decides who may invoke kommon on a repository. Zero values fall back
+// to the defaults: write permission and no membership requirement.
+type Policy struct {
+	// MinPermission is the repository permission the sender needs
+	MinPermission Permission `json:"min_permission,omitempty"`
+	// Orgs and Teams (org/team-slug), when set, additionally require the
+	// sender to belong to one of them
+	Orgs  []string `json:"orgs,omitempty"`
+	Teams []string `json:"teams,omitempty"`
+	// Allow lists users who may always invoke kommon
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists users who may never invoke kommon, even if allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Merge returns the policy with the values set in override replacing them.
+// Deny lists are combined so that a repository cannot lift a global ban.
+func (p Policy) Merge(override Policy) Policy {
+	if override.MinPermission != "" {
+		p.MinPermission = override.MinPermission
+	}
+	if override.Orgs != nil {
+		p.Orgs = override.Orgs
+	}
+	if override.Teams != nil {
+		p.Teams = override.Teams
+	}
+	if override.Allow != nil {
+		p.Allow = override.Allow
+	}
+	if len(override.Deny) > 0 {
+		p.Deny = append(append([]string{}, p.Deny...), override.Deny...)
+	}
+	return p
+}
+
+// Validate checks the permission and team names of the policy
+func (p Policy) Validate() error {
+	if p.MinPermission != "" {
+		if _, err := ParsePermission(string(p.MinPermission)); err != nil {
+			return err
+		}
+	}
+	for _, team := range p.Teams {
+		if _, _, err := splitTeam(team); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Directory looks up users on GitHub
+type Directory interface {
+	Permission(ctx context.Context, owner, repo, user string) (Permission, error)
+	IsOrgMember(ctx context.Context, org, user string) (bool, error)
+	IsTeamMember(ctx context.Context, org, team, user string) (bool, error)
+}
+
+// Decision is the outcome of an authorization
+type Decision struct {
+	Allowed bool
+	Reason  string // Why, for logs
+}
+
+// Authorize decides whether the user may invoke kommon on owner/repo. Errors
+// of the directory are returned and must be treated as a refusal.
+func (p Policy) Authorize(ctx context.Context, dir Directory, owner, repo, user string) (Decision, error) {
+	if containsLogin(p.Deny, user) {
+		return Decision{Reason: "user is denied"}, nil
+	}
+	if containsLogin(p.Allow, user) {
+		return Decision{Allowed: true, Reason: "user is allowed"}, nil
+	}
+
+	min := DefaultPermission
+	if p.MinPermission != "" {
+		var err error
+		if min, err = ParsePermission(string(p.MinPermission)); err != nil {
+			return Decision{}, err
+		}
+	}
+	if min != PermissionNone {
+		permission, err := dir.Permission(ctx, owner, repo, user)
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to get permission of %s: %w", user, err)
+		}
+		if !permission.AtLeast(min) {
+			return Decision{Reason: fmt.Sprintf("permission %s is below %s", permission, min)}, nil
+		}
+	}
+
+	if len(p.Orgs) == 0 && len(p.Teams) == 0 {
+		return Decision{Allowed: true, Reason: "permission granted"}, nil
+	}
+	for _, org := range p.Orgs {
+		member, err := dir.IsOrgMember(ctx, org, user)
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to check membership of %s in %s: %w", user, org, err)
+		}
+		if member {
+			return Decision{Allowed: true, Reason: "member of " + org}, nil
+		}
+	}
+	for _, team := range p.Teams {
+		org, slug, err := splitTeam(team)
+		if err != nil {
+			return Decision{}, err
+		}
+		member, err := dir.IsTeamMember(ctx, org, slug, user)
+		if err != nil {
+			return Decision{}, fmt.Errorf("failed to check membership of %s in %s: %w", user, team, err)
+		}
+		if member {
+			return Decision{Allowed: true, Reason: "member of " + team}, nil
+		}
+	}
+	return Decision{Reason: "not a member of the required organizations or teams"}, nil
+}
+
+// splitTeam splits org/team-slug
+func splitTeam(team string) (string, string, error) {
+	org, slug, ok := strings.Cut(team, "/")
+	if !ok || org == "" || slug == "" || strings.Contains(slug, "/") {
+		return "", "", fmt.Errorf("invalid team %q (must be org/team-slug)", team)
+	}
+	return org, slug, nil
+}
+
+// containsLogin reports whether the list holds the login. GitHub logins are
+// case-insensitive.
+func containsLogin(logins []string, login string) bool {
+	for _, l := range logins {
+		if strings.EqualFold(strings.TrimPrefix(l, "@"), login) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package authz
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDirectory answers from maps and counts the lookups
+type fakeDirectory struct {
+	permissions map[string]Permission
+	orgs        map[string][]string // org -> members
+	teams       map[string][]string // org/slug -> members
+	err         error
+	lookups     int
+}
+
+func (d *fakeDirectory) Permission(ctx context.Context, owner, repo, user string) (Permission, error) {
+	d.lookups++
+	if d.err != nil {
+		return "", d.err
+	}
+	if p, ok := d.permissions[user]; ok {
+		return p, nil
+	}
+	return PermissionNone, nil
+}
+
+func (d *fakeDirectory) IsOrgMember(ctx context.Context, org, user string) (bool, error) {
+	d.lookups++
+	return containsLogin(d.orgs[org], user), d.err
+}
+
+func (d *fakeDirectory) IsTeamMember(ctx context.Context, org, team, user string) (bool, error) {
+	d.lookups++
+	return containsLogin(d.teams[org+"/"+team], user), d.err
+}
+
+func TestAuthorize(t *testing.T) {
+	dir := &fakeDirectory{
+		permissions: map[string]Permission{
+			"admin":      PermissionAdmin,
+			"writer":     PermissionWrite,
+			"triager":    PermissionTriage,
+			"reader":     PermissionRead,
+			"custom":     Permission("custom-role"),
+			"org-writer": PermissionWrite,
+		},
+		orgs:  map[string][]string{"acme": {"org-writer", "reader"}},
+		teams: map[string][]string{"acme/bots": {"writer"}},
+	}
+
+	tests := []struct {
+		name    string
+		policy  Policy
+		user    string
+		allowed bool
+	}{
+		{name: "default requires write", user: "writer", allowed: true},
+		{name: "admin is above write", user: "admin", allowed: true},
+		{name: "triage is below write", user: "triager", allowed: false},
+		{name: "outside contributor", user: "stranger", allowed: false},
+		{name: "custom role grants nothing", user: "custom", allowed: false},
+		{name: "lower requirement", policy: Policy{MinPermission: PermissionTriage}, user: "triager", allowed: true},
+		{name: "no requirement", policy: Policy{MinPermission: PermissionNone}, user: "stranger", allowed: true},
+		{name: "allowlist", policy: Policy{Allow: []string{"Stranger"}}, user: "stranger", allowed: true},
+		{name: "denylist", policy: Policy{Deny: []string{"@admin"}}, user: "admin", allowed: false},
+		{name: "deny wins over allow", policy: Policy{Allow: []string{"admin"}, Deny: []string{"admin"}}, user: "admin", allowed: false},
+		{name: "org member", policy: Policy{Orgs: []string{"acme"}}, user: "org-writer", allowed: true},
+		{name: "not an org member", policy: Policy{Orgs: []string{"acme"}}, user: "admin", allowed: false},
+		{name: "org membership does not replace permission", policy: Policy{Orgs: []string{"acme"}}, user: "reader", allowed: false},
+		{name: "team member", policy: Policy{Orgs: []string{"acme"}, Teams: []string{"acme/bots"}}, user: "writer", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := tt.policy.Authorize(context.Background(), dir, "acme", "app", tt.user)
+			require.NoError(t, err)
+			assert.Equal(t, tt.allowed, decision.Allowed, decision.Reason)
+			assert.NotEmpty(t, decision.Reason)
+		})
+	}
+}
+
+func TestAuthorizeSkipsLookups(t *testing.T) {
+	dir := &fakeDirectory{err: errors.New("should not be called")}
+
+	decision, err := Policy{Allow: []string{"alice"}, Orgs: []string{"acme"}}.Authorize(context.Background(), dir, "acme", "app", "alice")
+	require.NoError(t, err)
+	assert.True(t, decision.Allowed)
+
+	decision, err = Policy{Deny: []string{"bob"}}.Authorize(context.Background(), dir, "acme", "app", "bob")
+	require.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Zero(t, dir.lookups)
+}
+
+func TestAuthorizeError(t *testing.T) {
+	lookupErr := errors.New("rate limited")
+	_, err := Policy{}.Authorize(context.Background(), &fakeDirectory{err: lookupErr}, "acme", "app", "alice")
+	assert.ErrorIs(t, err, lookupErr)
+}
+
+func TestPolicyMerge(t *testing.T) {
+	base := Policy{
+		MinPermission: PermissionWrite,
+		Orgs:          []string{"acme"},
+		Allow:         []string{"alice"},
+		Deny:          []string{"mallory"},
+	}
+
+	merged := base.Merge(Policy{
+		MinPermission: PermissionTriage,
+		Orgs:          []string{},
+		Deny:          []string{"eve"},
+	})
+	assert.Equal(t, Policy{
+		MinPermission: PermissionTriage,
+		Orgs:          []string{},
+		Allow:         []string{"alice"},
+		Deny:          []string{"mallory", "eve"},
+	}, merged)
+	assert.Equal(t, []string{"mallory"}, base.Deny)
+
+	assert.Equal(t, base, base.Merge(Policy{}))
+}
+
+func TestPolicyValidate(t *testing.T) {
+	assert.NoError(t, Policy{MinPermission: "Triage", Teams: []string{"acme/bots"}}.Validate())
+	assert.Error(t, Policy{MinPermission: "owner"}.Validate())
+	assert.Error(t, Policy{Teams: []string{"bots"}}.Validate())
+	assert.Error(t, Policy{Teams: []string{"acme/bots/x"}}.Validate())
+}
@@ -0,0 +1,106 @@
+package cifix
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/takutakahashi/kommon/pkg/progress"
+)
+
+// DefaultMaxLogBytes is the default budget of the logs given to the agent
+const DefaultMaxLogBytes = 60000
+
+// Failure is a failed job of the CI of a pull request
+type Failure struct {
+	Name  string   // Job or check run name, e.g. "test (ubuntu-latest)"
+	URL   string   // Page of the job
+	Steps []string // Failed steps, when known
+	Log   string   // Log of the job, or the output of a check run
+}
+
+var (
+	// timestampPattern matches the timestamp GitHub Actions adds to each line
+	timestampPattern = regexp.MustCompile(`(?m)^\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?Z ?`)
+	// errorLinePattern matches the error annotations of GitHub Actions
+	errorLinePattern = regexp.MustCompile(`(?m)^##\[error\].*$`)
+)
+
+// TrimLog keeps the part of a job log that explains the failure within
+// maxBytes: the end of the log up to its last error, without timestamps.
+// The cleanup steps logged after the error are left out.
+func TrimLog(log string, maxBytes int) string {
+	log = timestampPattern.ReplaceAllString(strings.ReplaceAll(log, "\r\n", "\n"), "")
+	if lines := errorLinePattern.FindAllStringIndex(log, -1); len(lines) > 0 {
+		log = log[:lines[len(lines)-1][1]]
+	}
+	log = strings.TrimSpace(log)
+
+	if len(log) <= maxBytes {
+		return log
+	}
+	if maxBytes <= len(progress.TruncatedMarker) {
+		return ""
+	}
+	return progress.Truncate(log, maxBytes-len(progress.TruncatedMarker))
+}
+
+// Prompt asks the agent to fix the failures of the commit. The logs share
+// maxLogBytes.
+func Prompt(sha string, attempt, maxAttempts int, failures []Failure, maxLogBytes int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "このプルリクエストの CI がコミット `%s` で失敗しました（自動修正 %d/%d 回目）。\n", shortSHA(sha), attempt, maxAttempts)
+	b.WriteString("以下の失敗したジョブのログから原因を調べて修正し、Push してください。")
+	b.WriteString("テストが失敗している場合は、テストを変更する前に実装の誤りを疑ってください。原因が CI の環境にあり、コードでは直せない場合は、変更せずにその旨を報告してください。\n")
+
+	each := maxLogBytes
+	if len(failures) > 0 {
+		each = maxLogBytes / len(failures)
+	}
+	for _, f := range failures {
+		fmt.Fprintf(&b, "\n## %s\n\n", f.Name)
+		if f.URL != "" {
+			fmt.Fprintf(&b, "%s\n\n", f.URL)
+		}
+		if len(f.Steps) > 0 {
+			fmt.Fprintf(&b, "失敗したステップ: %s\n\n", strings.Join(f.Steps, ", "))
+		}
+		if log := TrimLog(f.Log, each); log != "" {
+			b.WriteString(progress.CodeBlock("", log))
+			b.WriteString("\n")
+		} else {
+			b.WriteString("（ログを取得できませんでした）\n")
+		}
+	}
+	return b.String()
+}
+
+// Summary tells that kommon stopped fixing the CI of the pull request
+func Summary(maxAttempts int, failures []Failure) string {
+	var b strings.Builder
+	b.WriteString("## 🤖 CI の自動修正を停止しました\n\n")
+	fmt.Fprintf(&b, "CI の失敗を %d 回自動で修正しようとしましたが、まだ失敗しています。これ以上は自動で修正しません。\n", maxAttempts)
+	if len(failures) > 0 {
+		b.WriteString("\n失敗しているジョブ:\n\n")
+		for _, f := range failures {
+			name := f.Name
+			if f.URL != "" {
+				name = fmt.Sprintf("[%s](%s)", f.Name, f.URL)
+			}
+			if len(f.Steps) > 0 {
+				fmt.Fprintf(&b, "- %s（%s）\n", name, strings.Join(f.Steps, ", "))
+			} else {
+				fmt.Fprintf(&b, "- %s\n", name)
+			}
+		}
+	}
+	b.WriteString("\n続けて修正する場合は `/kommon run` で指示してください。`/kommon reset` で自動修正の回数もリセットされます。")
+	return b.String()
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
@@ -0,0 +1,63 @@
+package cifix
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const jobLog = "2024-01-01T00:00:00.0000000Z ##[group]Run go test ./...\r\n" +
+	"2024-01-01T00:00:01.1234567Z --- FAIL: TestLogin (0.00s)\r\n" +
+	"2024-01-01T00:00:01.2000000Z     login_test.go:12: expected 200, got 500\r\n" +
+	"2024-01-01T00:00:02.0000000Z ##[error]Process completed with exit code 1.\r\n" +
+	"2024-01-01T00:00:03.0000000Z Post job cleanup.\r\n" +
+	"2024-01-01T00:00:03.1000000Z [command]/usr/bin/git version\r\n"
+
+func TestTrimLog(t *testing.T) {
+	assert.Equal(t, "##[group]Run go test ./...\n"+
+		"--- FAIL: TestLogin (0.00s)\n"+
+		"    login_test.go:12: expected 200, got 500\n"+
+		"##[error]Process completed with exit code 1.", TrimLog(jobLog, 1000))
+
+	// The end of the log, which has the error, is kept
+	trimmed := TrimLog(jobLog, 60)
+	assert.LessOrEqual(t, len(trimmed), 60)
+	assert.True(t, strings.HasPrefix(trimmed, "...(省略)...\n"))
+	assert.True(t, strings.HasSuffix(trimmed, "##[error]Process completed with exit code 1."))
+
+	// Logs without errors, like check run outputs, keep their end
+	assert.Equal(t, "one\ntwo", TrimLog("one\ntwo\n", 100))
+	assert.Equal(t, "", TrimLog(jobLog, 5))
+
+	cut := TrimLog(strings.Repeat("あ", 100), 40)
+	assert.LessOrEqual(t, len(cut), 40)
+	assert.True(t, strings.HasSuffix(cut, "ああ"))
+}
+
+func TestPrompt(t *testing.T) {
+	prompt := Prompt("0123456789abcdef", 2, 3, []Failure{
+		{Name: "test", URL: "https://github.com/owner/repo/actions/runs/1/job/2", Steps: []string{"Run tests"}, Log: jobLog},
+		{Name: "lint"},
+	}, 1000)
+
+	assert.Contains(t, prompt, "コミット `0123456` で失敗しました（自動修正 2/3 回目）")
+	assert.Contains(t, prompt, "## test\n\nhttps://github.com/owner/repo/actions/runs/1/job/2\n\n失敗したステップ: Run tests\n\n```\n##[group]Run go test")
+	assert.Contains(t, prompt, "expected 200, got 500\n##[error]Process completed with exit code 1.\n```\n")
+	assert.NotContains(t, prompt, "Post job cleanup")
+	assert.Contains(t, prompt, "## lint\n\n（ログを取得できませんでした）\n")
+
+	// Logs share the budget
+	long := Failure{Name: "build", Log: strings.Repeat("x", 5000)}
+	prompt = Prompt("abc", 1, 3, []Failure{long, long}, 2000)
+	assert.Less(t, len(prompt), 2000+1000)
+}
+
+func TestSummary(t *testing.T) {
+	summary := Summary(3, []Failure{
+		{Name: "test", URL: "https://example.com/job", Steps: []string{"Run tests", "Upload"}},
+		{Name: "lint"},
+	})
+	assert.Contains(t, summary, "CI の失敗を 3 回自動で修正しようとしましたが")
+	assert.Contains(t, summary, "- [test](https://example.com/job)（Run tests, Upload）\n- lint\n")
+}
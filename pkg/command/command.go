@@ -0,0 +1,285 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Name is the subcommand of a kommon command
+type Name string
+
+const (
+	NameRun    Name = "run"
+	NameStatus Name = "status"
+	NameCancel Name = "cancel"
+	NameReset  Name = "reset"
+	NameHelp   Name = "help"
+	NameReview Name = "review"
+)
+
+// Prefix is the slash command prefix
+const Prefix = "/kommon"
+
+var names = []Name{NameRun, NameStatus, NameCancel, NameReset, NameHelp, NameReview}
+
+// ErrUnknownCommand is returned for subcommands that don't exist
+var ErrUnknownCommand = errors.New("unknown subcommand")
+
+// Command is a parsed kommon command
+type Command struct {
+	Name   Name
+	Prompt string // Text for run and review, may span multiple lines
+	Model  string // --model
+	Branch string // --branch
+}
+
+// ParseError describes why a comment addressed to kommon can't be parsed
+type ParseError struct {
+	Input string // Offending subcommand, flag or text
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: %s", e.Err, e.Input)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Parse parses a comment body. It returns false when the comment is not
+// addressed to kommon, i.e. starts with neither "/kommon" nor "@<slug>".
+//
+// The first line holds the subcommand and its flags; the rest of the first
+// line and the following lines form the prompt:
+//
+//	/kommon run --model openai/gpt-4o --branch "fix/login" fix the login form
+//	@kommon-bot fix the login form
+//
+// A mention without a known subcommand is a run. Status, cancel, reset and
+// help take no prompt: with trailing text a mention is a run, so that e.g.
+// "@kommon-bot reset the login flow" doesn't reset the session, and a slash
+// command is an error. A slash command with an unknown subcommand returns
+// ErrUnknownCommand.
+func Parse(body, slug string) (*Command, bool, error) {
+	text := strings.TrimLeftFunc(body, unicode.IsSpace)
+
+	rest, slash := cutPrefix(text, Prefix)
+	if !slash {
+		var mentioned bool
+		if slug == "" {
+			return nil, false, nil
+		}
+		if rest, mentioned = cutPrefix(text, "@"+slug); !mentioned {
+			return nil, false, nil
+		}
+	}
+
+	firstLine, following, _ := strings.Cut(rest, "\n")
+	firstLine = strings.TrimSpace(firstLine)
+	following = strings.TrimSpace(following)
+
+	cmd := &Command{Name: NameRun}
+	word, afterWord := nextWord(firstLine)
+	switch {
+	case word == "" && following == "":
+		if slash {
+			cmd.Name = NameHelp
+			return cmd, true, nil
+		}
+		return nil, true, &ParseError{Input: text, Err: errors.New("prompt is required")}
+	case isName(word):
+		name := Name(strings.ToLower(word))
+		if !name.takesPrompt() && (afterWord != "" || following != "") {
+			if !slash {
+				break
+			}
+			trailing := afterWord
+			if trailing == "" {
+				trailing = following
+			}
+			return nil, true, &ParseError{Input: trailing, Err: fmt.Errorf("%s takes no prompt", name)}
+		}
+		cmd.Name = name
+		firstLine = afterWord
+	case slash && word != "" && !strings.HasPrefix(word, "-"):
+		return nil, true, &ParseError{Input: word, Err: ErrUnknownCommand}
+	}
+
+	prompt, err := parseFlags(cmd, firstLine)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if following != "" {
+		if prompt != "" {
+			prompt += "\n"
+		}
+		prompt += following
+	}
+	cmd.Prompt = prompt
+
+	if cmd.Name == NameRun && cmd.Prompt == "" {
+		return nil, true, &ParseError{Input: text, Err: errors.New("prompt is required")}
+	}
+	return cmd, true, nil
+}
+
+// cutPrefix removes the prefix when it is followed by a space or the end of text
+func cutPrefix(text, prefix string) (string, bool) {
+	if len(text) < len(prefix) || !strings.EqualFold(text[:len(prefix)], prefix) {
+		return text, false
+	}
+	rest := text[len(prefix):]
+	if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+		return text, false
+	}
+	return rest, true
+}
+
+// Known reports whether the name is a subcommand of kommon
+func (n Name) Known() bool {
+	return isName(string(n))
+}
+
+// takesPrompt reports whether the text after the subcommand is its prompt
+func (n Name) takesPrompt() bool {
+	return n == NameRun || n == NameReview
+}
+
+func isName(word string) bool {
+	for _, name := range names {
+		if strings.EqualFold(word, string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextWord returns the first space-separated word and the text after it
+func nextWord(text string) (string, string) {
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end < 0 {
+		return text, ""
+	}
+	return text[:end], strings.TrimLeftFunc(text[end:], unicode.IsSpace)
+}
+
+// parseFlags reads the flags at the start of the line into cmd and returns
+// the remaining text. Parsing stops at the first word that is not a flag or
+// after "--"; the remaining text is kept as is, except that a single quoted
+// argument is unquoted.
+func parseFlags(cmd *Command, line string) (string, error) {
+	for {
+		line = strings.TrimLeftFunc(line, unicode.IsSpace)
+		if line == "" {
+			return "", nil
+		}
+		if line == "--" || strings.HasPrefix(line, "-- ") {
+			return unquoteAll(strings.TrimSpace(strings.TrimPrefix(line, "--")))
+		}
+		if !strings.HasPrefix(line, "--") {
+			return unquoteAll(line)
+		}
+
+		word, rest := nextWord(line)
+		flag, value, hasValue := strings.Cut(word, "=")
+		if hasValue {
+			var err error
+			// A quoted value may contain spaces, so read it again from the line
+			if value, rest, err = readValue(line[len(flag)+1:]); err != nil {
+				return "", &ParseError{Input: flag, Err: err}
+			}
+		} else {
+			var err error
+			if value, rest, err = readValue(rest); err != nil {
+				return "", &ParseError{Input: flag, Err: err}
+			}
+		}
+		if value == "" {
+			return "", &ParseError{Input: flag, Err: errors.New("flag needs a value")}
+		}
+
+		switch flag {
+		case "--model":
+			cmd.Model = value
+		case "--branch":
+			cmd.Branch = value
+		default:
+			return "", &ParseError{Input: flag, Err: errors.New("unknown flag")}
+		}
+		line = rest
+	}
+}
+
+// readValue reads one argument, which may be quoted with " or '. Within
+// double quotes a backslash escapes the next character.
+func readValue(text string) (string, string, error) {
+	text = strings.TrimLeftFunc(text, unicode.IsSpace)
+	if text == "" {
+		return "", "", nil
+	}
+
+	quote := text[0]
+	if quote != '"' && quote != '\'' {
+		word, rest := nextWord(text)
+		return word, rest, nil
+	}
+
+	var value strings.Builder
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == quote:
+			rest := text[i+1:]
+			if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+				return "", "", errors.New("closing quote must be followed by a space")
+			}
+			return value.String(), rest, nil
+		case c == '\\' && quote == '"' && i+1 < len(text):
+			i++
+			value.WriteByte(text[i])
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", "", errors.New("unterminated quote")
+}
+
+// unquoteAll unquotes the text when it is a single quoted argument
+func unquoteAll(text string) (string, error) {
+	if text == "" || (text[0] != '"' && text[0] != '\'') {
+		return text, nil
+	}
+	value, rest, err := readValue(text)
+	if err != nil || strings.TrimSpace(rest) != "" {
+		// Not a single argument, e.g. "foo" and "bar", so keep it as written
+		return text, nil
+	}
+	return value, nil
+}
+
+// Help returns the usage of the kommon commands
+func Help(slug string) string {
+	mention := "@" + slug
+	if slug == "" {
+		mention = Prefix
+	}
+	return fmt.Sprintf(`使い方:
+
+| コマンド | 説明 |
+| --- | --- |
+| `+"`%[1]s run [--model <model>] [--branch <branch>] <prompt>`"+` | プロンプトを実行します |
+| `+"`%[1]s review`"+` | プルリクエストをレビューします |
+| `+"`%[1]s status`"+` | 実行状況を表示します |
+| `+"`%[1]s cancel`"+` | 実行中・実行待ちの処理をキャンセルします |
+| `+"`%[1]s reset`"+` | セッションとワークスペースを作り直します |
+| `+"`%[1]s help`"+` | このヘルプを表示します |
+
+`+"`%[2]s <prompt>`"+` は `+"`%[1]s run <prompt>`"+` と同じです。
+status・cancel・reset・help は引数を取りません。`+"`%[2]s reset the login flow`"+` のように後ろに文章が続くメンションは run として実行します。
+値に空白を含む場合は `+"`\"...\"`"+` で囲んでください。2 行目以降もプロンプトに含まれます。`, Prefix, mention)
+}
@@ -0,0 +1,188 @@
+package command
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want *Command
+	}{
+		{
+			name: "run",
+			body: "/kommon run fix the login form",
+			want: &Command{Name: NameRun, Prompt: "fix the login form"},
+		},
+		{
+			name: "mention without subcommand",
+			body: "@kommon-bot fix the login form",
+			want: &Command{Name: NameRun, Prompt: "fix the login form"},
+		},
+		{
+			name: "mention with subcommand",
+			body: "@kommon-bot status",
+			want: &Command{Name: NameStatus},
+		},
+		{
+			name: "flags",
+			body: "/kommon run --model openai/gpt-4o --branch=fix/login fix it",
+			want: &Command{Name: NameRun, Prompt: "fix it", Model: "openai/gpt-4o", Branch: "fix/login"},
+		},
+		{
+			name: "flags without subcommand",
+			body: "/kommon --model openai/gpt-4o fix it",
+			want: &Command{Name: NameRun, Prompt: "fix it", Model: "openai/gpt-4o"},
+		},
+		{
+			name: "quoted arguments",
+			body: `/kommon run --branch "fix/with space\"quote" 'do "this" now'`,
+			want: &Command{Name: NameRun, Prompt: `do "this" now`, Branch: `fix/with space"quote`},
+		},
+		{
+			name: "quoted flag value with equals",
+			body: `/kommon run --model="a b" go`,
+			want: &Command{Name: NameRun, Prompt: "go", Model: "a b"},
+		},
+		{
+			name: "apostrophes in the prompt",
+			body: "/kommon run don't break the tests, it's important",
+			want: &Command{Name: NameRun, Prompt: "don't break the tests, it's important"},
+		},
+		{
+			name: "double dash ends flags",
+			body: "/kommon run -- --model is a word here",
+			want: &Command{Name: NameRun, Prompt: "--model is a word here"},
+		},
+		{
+			name: "multi-line body",
+			body: "/kommon run --model m first line\nsecond line\n\nthird line\n",
+			want: &Command{Name: NameRun, Prompt: "first line\nsecond line\n\nthird line", Model: "m"},
+		},
+		{
+			name: "prompt only on following lines",
+			body: "@kommon-bot\r\nplease fix\r\nthe bug",
+			want: &Command{Name: NameRun, Prompt: "please fix\r\nthe bug"},
+		},
+		{
+			name: "review with instructions",
+			body: "/kommon review focus on security",
+			want: &Command{Name: NameReview, Prompt: "focus on security"},
+		},
+		{
+			name: "case insensitive",
+			body: "  /Kommon CANCEL",
+			want: &Command{Name: NameCancel},
+		},
+		{
+			name: "prefix only",
+			body: "/kommon",
+			want: &Command{Name: NameHelp},
+		},
+		{
+			name: "reset",
+			body: "/kommon reset",
+			want: &Command{Name: NameReset},
+		},
+		{
+			name: "mention with reset in a sentence",
+			body: "@kommon-bot reset the login flow",
+			want: &Command{Name: NameRun, Prompt: "reset the login flow"},
+		},
+		{
+			name: "mention with cancel in a sentence",
+			body: "@kommon-bot cancel the old cron job",
+			want: &Command{Name: NameRun, Prompt: "cancel the old cron job"},
+		},
+		{
+			name: "mention with help in a sentence",
+			body: "@kommon-bot help me fix X",
+			want: &Command{Name: NameRun, Prompt: "help me fix X"},
+		},
+		{
+			name: "mention with status on the following lines",
+			body: "@kommon-bot status\nof the deploy script is wrong",
+			want: &Command{Name: NameRun, Prompt: "status\nof the deploy script is wrong"},
+		},
+		{
+			name: "mention with reset alone",
+			body: "@kommon-bot reset\n",
+			want: &Command{Name: NameReset},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, ok, err := Parse(tt.body, "kommon-bot")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, cmd)
+		})
+	}
+}
+
+func TestParseNotAddressed(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"looks good to me",
+		"/kommonx run it",
+		"@kommon-botx run it",
+		"see /kommon run",
+		"@someone else",
+	} {
+		_, ok, err := Parse(body, "kommon-bot")
+		assert.False(t, ok, body)
+		assert.NoError(t, err, body)
+	}
+
+	_, ok, _ := Parse("@ hello", "")
+	assert.False(t, ok)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, ok, err := Parse("/kommon deploy now", "kommon-bot")
+	assert.True(t, ok)
+	assert.ErrorIs(t, err, ErrUnknownCommand)
+	var parseErr *ParseError
+	require.ErrorAs(t, err, &parseErr)
+	assert.Equal(t, "deploy", parseErr.Input)
+
+	for body, input := range map[string]string{
+		"/kommon reset the login flow": "the login flow",
+		"/kommon cancel\nall of them":  "all of them",
+		"/kommon status --model m":     "--model m",
+		"/kommon help me":              "me",
+	} {
+		_, ok, err := Parse(body, "kommon-bot")
+		assert.True(t, ok, body)
+		assert.ErrorContains(t, err, "takes no prompt", body)
+		require.ErrorAs(t, err, &parseErr)
+		assert.Equal(t, input, parseErr.Input, body)
+	}
+
+	for _, body := range []string{
+		"/kommon run",
+		"@kommon-bot",
+		"/kommon run --model",
+		"/kommon run --force do it",
+		`/kommon run --branch "unterminated do it`,
+		`/kommon run --branch "a"b do it`,
+	} {
+		_, ok, err := Parse(body, "kommon-bot")
+		assert.True(t, ok, body)
+		assert.Error(t, err, body)
+		assert.NotErrorIs(t, err, ErrUnknownCommand, body)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	help := Help("kommon-bot")
+	for _, name := range names {
+		assert.Contains(t, help, "/kommon "+string(name))
+	}
+	assert.Contains(t, help, "@kommon-bot <prompt>")
+}
@@ -0,0 +1,120 @@
+package dedup
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSize = 10000
+	DefaultTTL  = 24 * time.Hour
+)
+
+type entry struct {
+	id      string
+	expires time.Time
+}
+
+// Cache remembers IDs for a limited time. When it is full the oldest IDs are
+// forgotten first.
+type Cache struct {
+	size  int
+	ttl   time.Duration
+	order *list.List // oldest first
+	ids   map[string]*list.Element
+	mutex sync.Mutex
+	now   func() time.Time
+}
+
+// NewCache creates a new cache holding at most size IDs for ttl each.
+// Non-positive values fall back to DefaultSize and DefaultTTL.
+func NewCache(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	return &Cache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+		now:   time.Now,
+	}
+}
+
+// Seen records the ID and reports whether it was already recorded and has
+// not expired yet
+func (c *Cache) Seen(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.expire(now)
+
+	if _, ok := c.ids[id]; ok {
+		return true
+	}
+	c.add(id, now)
+	return false
+}
+
+// Contains reports whether the ID was recorded and has not expired yet,
+// without recording it
+func (c *Cache) Contains(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(c.now())
+	_, ok := c.ids[id]
+	return ok
+}
+
+// Add records the ID unless it is already recorded
+func (c *Cache) Add(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.expire(now)
+	if _, ok := c.ids[id]; !ok {
+		c.add(id, now)
+	}
+}
+
+// add records the ID, forgetting the oldest ones when the cache is full.
+// The caller must hold the lock.
+func (c *Cache) add(id string, now time.Time) {
+	c.ids[id] = c.order.PushBack(&entry{id: id, expires: now.Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.evict(c.order.Front())
+	}
+}
+
+// Len returns the number of IDs recorded
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.expire(c.now())
+	return c.order.Len()
+}
+
+// expire removes the expired IDs. The caller must hold the lock.
+func (c *Cache) expire(now time.Time) {
+	// Every ID lives for the same TTL, so the oldest one expires first
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		if now.Before(front.Value.(*entry).expires) {
+			return
+		}
+		c.evict(front)
+	}
+}
+
+// evict removes the element. The caller must hold the lock.
+func (c *Cache) evict(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.ids, e.Value.(*entry).id)
+}
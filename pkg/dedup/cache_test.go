@@ -0,0 +1,82 @@
+package dedup
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheSeen(t *testing.T) {
+	c := NewCache(10, time.Minute)
+
+	assert.False(t, c.Seen("a"))
+	assert.True(t, c.Seen("a"))
+	assert.False(t, c.Seen("b"))
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCacheContainsAdd(t *testing.T) {
+	c := NewCache(10, time.Minute)
+
+	assert.False(t, c.Contains("a"))
+	assert.False(t, c.Contains("a"), "Contains doesn't record the ID")
+	c.Add("a")
+	c.Add("a")
+	assert.True(t, c.Contains("a"))
+	assert.True(t, c.Seen("a"))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewCache(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	assert.False(t, c.Seen("a"))
+	now = now.Add(30 * time.Second)
+	assert.False(t, c.Seen("b"))
+	assert.True(t, c.Seen("a"))
+
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, 1, c.Len())
+	assert.False(t, c.Seen("a"), "expired IDs are recorded again")
+	assert.True(t, c.Seen("b"))
+}
+
+func TestCacheSize(t *testing.T) {
+	c := NewCache(3, time.Minute)
+
+	for i := 0; i < 5; i++ {
+		assert.False(t, c.Seen(fmt.Sprintf("id-%d", i)))
+	}
+	assert.Equal(t, 3, c.Len())
+
+	// The oldest IDs were forgotten
+	assert.False(t, c.Seen("id-0"))
+	assert.True(t, c.Seen("id-4"))
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(100, time.Minute)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	firsts := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !c.Seen("delivery") {
+				mutex.Lock()
+				firsts++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, firsts)
+}
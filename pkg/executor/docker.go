@@ -20,6 +20,7 @@ type DockerExecutor struct {
 	options      ExecutorOptions
 	dockerClient *client.Client
 	containers   map[string]string // agentID -> containerID
+	adopted      map[string]bool   // rediscovered agents not yet reattached
 	mutex        sync.RWMutex
 }
 
@@ -38,6 +39,7 @@ func NewDockerExecutor(opts ExecutorOptions) (*DockerExecutor, error) {
 		options:      opts,
 		dockerClient: cli,
 		containers:   make(map[string]string),
+		adopted:      make(map[string]bool),
 	}, nil
 }
 
@@ -48,6 +50,52 @@ func (e *DockerExecutor) Initialize(ctx context.Context) error {
 		return fmt.Errorf("failed to connect to Docker daemon: %w", err)
 	}
 
+	return e.rediscoverAgents(ctx)
+}
+
+// rediscoverAgents adds the containers left by a previous process back to the
+// registry, or removes them when their session is an orphan
+func (e *DockerExecutor) rediscoverAgents(ctx context.Context) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	containers, listErr := e.dockerClient.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: e.buildAgentFilter(),
+	})
+	if listErr != nil {
+		return fmt.Errorf("failed to list containers: %w", listErr)
+	}
+
+	for _, c := range containers {
+		agentID := c.Labels["kommon.agent.id"]
+		if agentID == "" {
+			continue
+		}
+		if _, exists := e.containers[agentID]; exists {
+			continue
+		}
+
+		if !e.options.shouldAdopt(agentID) {
+			if removeErr := e.dockerClient.ContainerRemove(ctx, c.ID, container.RemoveOptions{
+				Force: true,
+			}); removeErr != nil {
+				return fmt.Errorf("failed to remove orphaned container %s: %w", c.ID, removeErr)
+			}
+			continue
+		}
+
+		// Restart stopped containers so the session workspace can be reused
+		if c.State != "running" {
+			if startErr := e.dockerClient.ContainerStart(ctx, c.ID, container.StartOptions{}); startErr != nil {
+				return fmt.Errorf("failed to restart container %s: %w", c.ID, startErr)
+			}
+		}
+
+		e.containers[agentID] = c.ID
+		e.adopted[agentID] = true
+	}
+
 	return nil
 }
 
@@ -58,15 +106,30 @@ func (e *DockerExecutor) CreateAgent(ctx context.Context, opts agent.GooseOption
 
 	// Check if agent already exists
 	if _, exists := e.containers[opts.SessionID]; exists {
-		return nil, fmt.Errorf("agent with ID %s already exists", opts.SessionID)
+		if !e.adopted[opts.SessionID] {
+			return nil, fmt.Errorf("agent with ID %s already exists", opts.SessionID)
+		}
+
+		// Reattach to the container rediscovered on startup
+		delete(e.adopted, opts.SessionID)
+		return e.newDockerAgent(opts, e.containers[opts.SessionID]), nil
+	}
+
+	image := DefaultAgentImage
+	if e.options.Resources != nil && e.options.Resources.Image != "" {
+		image = e.options.Resources.Image
 	}
 
 	// Create container config
 	containerConfig := &container.Config{
-		Image: e.options.Resources.Image,
+		Image: image,
+		// Keep the container alive so prompts can be executed in it
+		Entrypoint: []string{"sleep"},
+		Cmd:        []string{"infinity"},
 		Env: []string{
 			fmt.Sprintf("AGENT_SESSION_ID=%s", opts.SessionID),
 			fmt.Sprintf("AGENT_API_KEY=%s", opts.APIKey),
+			fmt.Sprintf("KOMMON_API_KEY=%s", opts.APIKey),
 		},
 		Labels: map[string]string{
 			"kommon.agent.id": opts.SessionID,
@@ -90,7 +153,7 @@ func (e *DockerExecutor) CreateAgent(ctx context.Context, opts agent.GooseOption
 		hostConfig,
 		nil,
 		nil,
-		fmt.Sprintf("kommon-agent-%s", opts.SessionID),
+		fmt.Sprintf("kommon-agent-%s", resourceName(opts.SessionID)),
 	)
 	if createErr != nil {
 		return nil, fmt.Errorf("failed to create container: %w", createErr)
@@ -103,17 +166,16 @@ func (e *DockerExecutor) CreateAgent(ctx context.Context, opts agent.GooseOption
 
 	e.containers[opts.SessionID] = resp.ID
 
-	// Create agent instance
-	newAgent, agentErr := agent.NewGooseAgent(opts)
-	if agentErr != nil {
-		// Cleanup container on agent creation failure
-		if cleanupErr := e.DestroyAgent(ctx, opts.SessionID); cleanupErr != nil {
-			return nil, fmt.Errorf("failed to create agent and cleanup failed: %w", agentErr)
-		}
-		return nil, fmt.Errorf("failed to create agent: %w", agentErr)
-	}
+	return e.newDockerAgent(opts, resp.ID), nil
+}
 
-	return newAgent, nil
+func (e *DockerExecutor) newDockerAgent(opts agent.GooseOptions, containerID string) *DockerAgent {
+	return &DockerAgent{
+		sessionID:   opts.SessionID,
+		repo:        opts.Repo,
+		containerID: containerID,
+		client:      e.dockerClient,
+	}
 }
 
 // DestroyAgent implements Executor.DestroyAgent
@@ -142,6 +204,7 @@ func (e *DockerExecutor) DestroyAgent(ctx context.Context, agentID string) error
 	}
 
 	delete(e.containers, agentID)
+	delete(e.adopted, agentID)
 	return nil
 }
 
@@ -0,0 +1,122 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/takutakahashi/kommon/pkg/agent"
+)
+
+// dockerExecAPI is the subset of the Docker client used to run commands in containers
+type dockerExecAPI interface {
+	ContainerExecCreate(ctx context.Context, container string, options container.ExecOptions) (types.IDResponse, error)
+	ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error)
+	ContainerExecStart(ctx context.Context, execID string, config container.ExecStartOptions) error
+	ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error)
+}
+
+// DockerAgent runs prompts inside the container of its session
+type DockerAgent struct {
+	sessionID   string
+	repo        string
+	containerID string
+	client      dockerExecAPI
+}
+
+func (a *DockerAgent) GetSessionID() string {
+	return a.sessionID
+}
+
+// Execute runs the prompt in the session container and returns its combined
+// stdout and stderr, like the other agents. A non-zero exit status is
+// reported as an *ExitError carrying stderr.
+func (a *DockerAgent) Execute(ctx context.Context, input string) (string, error) {
+	opts := agent.ExecuteOptionsFrom(ctx)
+	execResp, createErr := a.client.ContainerExecCreate(ctx, a.containerID, container.ExecOptions{
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          agentCommand(a.sessionID, a.repo, opts),
+	})
+	if createErr != nil {
+		return "", fmt.Errorf("failed to create exec in container %s: %w", a.containerID, createErr)
+	}
+
+	attachResp, attachErr := a.client.ContainerExecAttach(ctx, execResp.ID, container.ExecAttachOptions{})
+	if attachErr != nil {
+		return "", fmt.Errorf("failed to attach to exec %s: %w", execResp.ID, attachErr)
+	}
+	defer attachResp.Close()
+
+	// Closing the connection unblocks the copy below when the context is canceled.
+	// The command keeps running in the container after that, so it is stopped
+	// separately.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			a.cancelExec()
+			attachResp.Close()
+		case <-done:
+		}
+	}()
+
+	if _, writeErr := io.WriteString(attachResp.Conn, agentInput(opts, input)); writeErr != nil {
+		return "", fmt.Errorf("failed to write prompt to exec %s: %w", execResp.ID, writeErr)
+	}
+	if closeErr := attachResp.CloseWrite(); closeErr != nil {
+		return "", fmt.Errorf("failed to close exec stdin: %w", closeErr)
+	}
+
+	// stdout and stderr share the buffer so the output keeps its original order.
+	// kommon run reports limits on stderr.
+	var output, stderr bytes.Buffer
+	if _, copyErr := stdcopy.StdCopy(&output, io.MultiWriter(&output, &stderr), attachResp.Reader); copyErr != nil {
+		if ctx.Err() != nil {
+			return output.String(), ctx.Err()
+		}
+		return output.String(), fmt.Errorf("failed to read exec output: %w", copyErr)
+	}
+	if ctx.Err() != nil {
+		return output.String(), ctx.Err()
+	}
+
+	inspect, inspectErr := a.client.ContainerExecInspect(ctx, execResp.ID)
+	if inspectErr != nil {
+		return output.String(), fmt.Errorf("failed to inspect exec %s: %w", execResp.ID, inspectErr)
+	}
+	if inspect.ExitCode == agent.LimitExitCode {
+		return output.String(), agent.ParseLimitError(output.String())
+	}
+	if inspect.ExitCode != 0 {
+		return output.String(), &ExitError{ExitCode: inspect.ExitCode, Stderr: stderr.String()}
+	}
+
+	return output.String(), nil
+}
+
+// cancelExec stops the execution of the session running in the container
+func (a *DockerAgent) cancelExec() {
+	// The execution context is already canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	execResp, err := a.client.ContainerExecCreate(ctx, a.containerID, container.ExecOptions{
+		Cmd: cancelCommand(a.sessionID),
+	})
+	if err != nil {
+		log.Printf("Failed to create cancel exec in container %s: %v", a.containerID, err)
+		return
+	}
+	if err := a.client.ContainerExecStart(ctx, execResp.ID, container.ExecStartOptions{Detach: true}); err != nil {
+		log.Printf("Failed to start cancel exec in container %s: %v", a.containerID, err)
+	}
+}
@@ -0,0 +1,155 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/takutakahashi/kommon/pkg/agent"
+)
+
+// fakeDockerExec emulates the Docker exec API over an in-memory connection
+type fakeDockerExec struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	hang     bool
+
+	options container.ExecOptions
+	stdin   chan string
+
+	mutex   sync.Mutex
+	created []container.ExecOptions
+	started []string
+}
+
+func (f *fakeDockerExec) ContainerExecCreate(ctx context.Context, containerID string, options container.ExecOptions) (types.IDResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.created = append(f.created, options)
+	if len(f.created) == 1 {
+		f.options = options
+	}
+	return types.IDResponse{ID: fmt.Sprintf("exec-%d", len(f.created))}, nil
+}
+
+func (f *fakeDockerExec) ContainerExecStart(ctx context.Context, execID string, config container.ExecStartOptions) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.started = append(f.started, execID)
+	return nil
+}
+
+func (f *fakeDockerExec) ContainerExecAttach(ctx context.Context, execID string, config container.ExecAttachOptions) (types.HijackedResponse, error) {
+	client, server := net.Pipe()
+	f.stdin = make(chan string, 1)
+
+	go func() {
+		defer server.Close()
+		// net.Pipe can't half-close, so the prompt is taken from a single read
+		reader := bufio.NewReader(server)
+		buf := make([]byte, 4096)
+		n, _ := reader.Read(buf)
+		f.stdin <- string(buf[:n])
+
+		if f.hang {
+			_, _ = io.Copy(io.Discard, server)
+			return
+		}
+		_, _ = stdcopy.NewStdWriter(server, stdcopy.Stdout).Write([]byte(f.stdout))
+		_, _ = stdcopy.NewStdWriter(server, stdcopy.Stderr).Write([]byte(f.stderr))
+	}()
+
+	return types.NewHijackedResponse(client, types.MediaTypeMultiplexedStream), nil
+}
+
+func (f *fakeDockerExec) ContainerExecInspect(ctx context.Context, execID string) (container.ExecInspect, error) {
+	return container.ExecInspect{ExecID: execID, ExitCode: f.exitCode}, nil
+}
+
+func TestDockerAgentExecute(t *testing.T) {
+	newAgent := func(fake *fakeDockerExec) *DockerAgent {
+		return &DockerAgent{
+			sessionID:   "session-1",
+			repo:        "owner/repo",
+			containerID: "container-1",
+			client:      fake,
+		}
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		fake := &fakeDockerExec{stdout: "done\n", stderr: "progress\n"}
+
+		output, err := newAgent(fake).Execute(context.Background(), "do something")
+		require.NoError(t, err)
+		assert.Equal(t, "done\nprogress\n", output)
+		assert.Equal(t, "do something", <-fake.stdin)
+		assert.Equal(t, agentCommand("session-1", "owner/repo", agent.ExecuteOptions{}), fake.options.Cmd)
+		assert.True(t, fake.options.AttachStdin)
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		a := newAgent(&fakeDockerExec{})
+		for _, token := range []string{"ghs_first", "ghs_second"} {
+			fake := &fakeDockerExec{stdout: "done\n"}
+			a.client = fake
+
+			ctx := agent.WithExecuteOptions(context.Background(), agent.ExecuteOptions{GitHubToken: token})
+			_, err := a.Execute(ctx, "prompt")
+			require.NoError(t, err)
+			assert.Equal(t, token+"\nprompt", <-fake.stdin)
+			assert.Contains(t, fake.options.Cmd, "--github-token-stdin")
+			assert.NotContains(t, fake.options.Cmd, token)
+		}
+	})
+
+	t.Run("NonZeroExit", func(t *testing.T) {
+		fake := &fakeDockerExec{stdout: "partial\n", stderr: "boom\n", exitCode: 3}
+
+		output, err := newAgent(fake).Execute(context.Background(), "fail")
+		require.Error(t, err)
+		var exitErr *ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 3, exitErr.ExitCode)
+		assert.Equal(t, "boom\n", exitErr.Stderr)
+		assert.Equal(t, "partial\nboom\n", output)
+	})
+
+	t.Run("LimitExceeded", func(t *testing.T) {
+		// kommon run prints the limit on stderr
+		fake := &fakeDockerExec{stdout: "working\n", stderr: "Error: timed out after 15m\n", exitCode: agent.LimitExitCode}
+
+		_, err := newAgent(fake).Execute(context.Background(), "runs too long")
+		var limitErr *agent.LimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, agent.LimitTimeout, limitErr.Limit)
+		assert.Equal(t, "timed out after 15m", limitErr.Error())
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		fake := &fakeDockerExec{hang: true}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := newAgent(fake).Execute(ctx, "never finishes")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// Closing the connection doesn't stop the command in the container
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		require.Len(t, fake.created, 2)
+		assert.Equal(t, cancelCommand("session-1"), fake.created[1].Cmd)
+		assert.Equal(t, []string{"exec-2"}, fake.started)
+	})
+}
@@ -2,6 +2,7 @@ package executor
 
 import (
 	"context"
+	"strings"
 	"testing"
 	"time"
 
@@ -315,3 +316,53 @@ func TestDockerExecutorResourceParsing(t *testing.T) {
 		}
 	})
 }
+
+func TestDockerExecutorRediscovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping Docker-based test in short mode")
+	}
+
+	// Cleanup any leftover test containers
+	cleanupTestContainers(t)
+
+	ctx := context.Background()
+	opts := ExecutorOptions{
+		Type: ExecutorTypeDocker,
+		Resources: &ResourceRequirements{
+			Image: "goose:latest",
+		},
+	}
+
+	// Start an agent with a first executor, then forget about it
+	previous, err := NewDockerExecutor(opts)
+	require.NoError(t, err)
+	defer previous.Close()
+	require.NoError(t, previous.Initialize(ctx))
+
+	agentOpts := agent.GooseOptions{
+		SessionID: "test-rediscovery-agent",
+		APIKey:    "test-key",
+	}
+	_, err = previous.CreateAgent(ctx, agentOpts)
+	require.NoError(t, err)
+
+	// A new executor adopts the running container
+	executor, err := NewDockerExecutor(opts)
+	require.NoError(t, err)
+	defer executor.Close()
+	require.NoError(t, executor.Initialize(ctx))
+
+	a, err := executor.CreateAgent(ctx, agentOpts)
+	require.NoError(t, err)
+	require.NotNil(t, a)
+
+	// The container outlives installation tokens, so it never holds one
+	inspect, err := executor.dockerClient.ContainerInspect(ctx, a.(*DockerAgent).containerID)
+	require.NoError(t, err)
+	for _, env := range inspect.Config.Env {
+		assert.False(t, strings.HasPrefix(env, "KOMMON_GITHUB_TOKEN="), env)
+	}
+
+	err = executor.DestroyAgent(ctx, agentOpts.SessionID)
+	require.NoError(t, err)
+}
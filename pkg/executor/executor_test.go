@@ -3,6 +3,7 @@ package executor
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -113,7 +114,17 @@ func TestNewExecutor(t *testing.T) {
 			opts: ExecutorOptions{
 				Type: ExecutorTypeKubernetes,
 			},
-			wantErr: true, // Not implemented yet
+			wantErr: false,
+		},
+		{
+			name: "Kubernetes executor with invalid limits",
+			opts: ExecutorOptions{
+				Type: ExecutorTypeKubernetes,
+				Resources: &ResourceRequirements{
+					CPULimit: "lots",
+				},
+			},
+			wantErr: true,
 		},
 		{
 			name: "Unknown executor type",
@@ -124,6 +135,11 @@ func TestNewExecutor(t *testing.T) {
 		},
 	}
 
+	// Point the Kubernetes executor at a dummy cluster
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(testKubeconfig), 0600))
+	t.Setenv("KUBECONFIG", kubeconfig)
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			executor, err := NewExecutor(tt.opts)
@@ -137,3 +153,21 @@ func TestNewExecutor(t *testing.T) {
 		})
 	}
 }
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: https://127.0.0.1:6443
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: test
+current-context: test
+users:
+- name: test
+  user:
+    token: test-token
+`
@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	"github.com/takutakahashi/kommon/pkg/agent"
+	corev1 "k8s.io/api/core/v1"
 )
 
 // ExecutorType represents the type of executor
@@ -16,16 +17,21 @@ const (
 	ExecutorTypeKubernetes ExecutorType = "kubernetes"
 )
 
+// DefaultAgentImage is the image used for container based agents when none is configured
+const DefaultAgentImage = "kommon-agent:latest"
+
 var (
 	ErrUnsupportedExecutorType = fmt.Errorf("unsupported executor type")
 )
 
 // Executor represents the interface for agent executors
 type Executor interface {
-	// Initialize sets up the executor environment
+	// Initialize sets up the executor environment and rediscovers agents
+	// left running by a previous process
 	Initialize(ctx context.Context) error
 
 	// CreateAgent creates and starts a new agent instance
+	// Agents rediscovered by Initialize are reattached instead of created again
 	// Returns the agent interface and any error that occurred
 	CreateAgent(ctx context.Context, opts agent.GooseOptions) (agent.Agent, error)
 
@@ -39,6 +45,19 @@ type Executor interface {
 	GetStatus(ctx context.Context) (*ExecutorStatus, error)
 }
 
+// ExitError is returned when a command run inside an agent exits with a non-zero status
+type ExitError struct {
+	ExitCode int
+	Stderr   string // Only set when the executor captures stderr separately
+}
+
+func (e *ExitError) Error() string {
+	if e.Stderr != "" {
+		return fmt.Sprintf("agent command exited with status %d: %s", e.ExitCode, e.Stderr)
+	}
+	return fmt.Sprintf("agent command exited with status %d", e.ExitCode)
+}
+
 // ExecutorStatus represents the current status of an executor
 type ExecutorStatus struct {
 	Type           ExecutorType    `json:"type"`
@@ -54,12 +73,39 @@ type ResourceStatus struct {
 	DiskUsage   float64 `json:"disk_usage,omitempty"`   // Disk usage in bytes
 }
 
+// OrphanPolicy decides what happens to rediscovered agents whose session is unknown
+type OrphanPolicy string
+
+const (
+	// OrphanPolicyAdopt keeps orphaned agents and adds them to the registry
+	OrphanPolicyAdopt OrphanPolicy = "adopt"
+	// OrphanPolicyDelete removes orphaned agents
+	OrphanPolicyDelete OrphanPolicy = "delete"
+)
+
+// SessionLookup reports whether a session is still known to the caller
+type SessionLookup func(sessionID string) bool
+
 // ExecutorOptions contains configuration options for creating a new executor
 type ExecutorOptions struct {
-	Type      ExecutorType          `json:"type"`
-	ConfigDir string                `json:"config_dir"`
-	Resources *ResourceRequirements `json:"resources,omitempty"`
-	Namespace string                `json:"namespace,omitempty"`
+	Type       ExecutorType          `json:"type"`
+	ConfigDir  string                `json:"config_dir"`
+	Resources  *ResourceRequirements `json:"resources,omitempty"`
+	Namespace  string                `json:"namespace,omitempty"`
+	Kubernetes *KubernetesOptions    `json:"kubernetes,omitempty"`
+
+	// OrphanPolicy applies to rediscovered agents not reported by IsKnownSession.
+	// When IsKnownSession is nil every rediscovered agent is an orphan.
+	OrphanPolicy   OrphanPolicy  `json:"orphan_policy,omitempty"`
+	IsKnownSession SessionLookup `json:"-"`
+}
+
+// shouldAdopt reports whether a rediscovered agent is kept by the executor
+func (o ExecutorOptions) shouldAdopt(sessionID string) bool {
+	if o.IsKnownSession != nil && o.IsKnownSession(sessionID) {
+		return true
+	}
+	return o.OrphanPolicy != OrphanPolicyDelete
 }
 
 // ResourceRequirements specifies resource limits and requests
@@ -70,6 +116,33 @@ type ResourceRequirements struct {
 	DiskLimit   string `json:"disk_limit,omitempty"`   // Disk limit (e.g., "10Gi")
 }
 
+// KubernetesMode selects how the Kubernetes executor runs agents
+type KubernetesMode string
+
+const (
+	// KubernetesModePod keeps a long running pod per session and execs prompts into it
+	KubernetesModePod KubernetesMode = "pod"
+	// KubernetesModeJob runs every prompt as a batch/v1 Job
+	KubernetesModeJob KubernetesMode = "job"
+)
+
+// KubernetesOptions contains pod settings for the Kubernetes executor
+type KubernetesOptions struct {
+	Mode               KubernetesMode      `json:"mode,omitempty"` // Defaults to pod mode
+	Job                *JobOptions         `json:"job,omitempty"`
+	ServiceAccountName string              `json:"service_account_name,omitempty"`
+	NodeSelector       map[string]string   `json:"node_selector,omitempty"`
+	Tolerations        []corev1.Toleration `json:"tolerations,omitempty"`
+	ImagePullSecrets   []string            `json:"image_pull_secrets,omitempty"` // Names of docker registry secrets
+}
+
+// JobOptions configures the Jobs created in KubernetesModeJob
+type JobOptions struct {
+	TTLSecondsAfterFinished *int32 `json:"ttl_seconds_after_finished,omitempty"`
+	ActiveDeadlineSeconds   *int64 `json:"active_deadline_seconds,omitempty"`
+	BackoffLimit            *int32 `json:"backoff_limit,omitempty"`
+}
+
 // NewExecutor creates a new instance of the specified executor type
 func NewExecutor(opts ExecutorOptions) (Executor, error) {
 	switch opts.Type {
@@ -77,6 +150,8 @@ func NewExecutor(opts ExecutorOptions) (Executor, error) {
 		return NewLocalExecutor(opts)
 	case ExecutorTypeDocker:
 		return NewDockerExecutor(opts)
+	case ExecutorTypeKubernetes:
+		return NewKubernetesExecutor(opts)
 	default:
 		return nil, ErrUnsupportedExecutorType
 	}
@@ -1,32 +1,72 @@
 package executor
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/takutakahashi/kommon/pkg/agent"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
+const (
+	// agentContainerName is the name of the container running the agent in the pod
+	agentContainerName = "agent"
+	// podPollInterval is the interval used while waiting for an agent pod to start
+	podPollInterval = 2 * time.Second
+	// maxSessionNameLength keeps generated names and label values under 63 characters
+	maxSessionNameLength = 40
+
+	sessionIDLabel      = "session-id"
+	sessionIDAnnotation = "kommon.dev/session-id"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// execFactory creates a remote command executor for the given pods/exec URL
+type execFactory func(config *rest.Config, method string, url *url.URL) (remotecommand.Executor, error)
+
 type KubernetesExecutor struct {
-	client    *kubernetes.Clientset
-	namespace string
-	agents    map[string]bool
-	mu        sync.RWMutex
+	client      kubernetes.Interface
+	config      *rest.Config
+	namespace   string
+	options     ExecutorOptions
+	resources   corev1.ResourceRequirements
+	agents      map[string]bool
+	adopted     map[string]bool // rediscovered agents not yet reattached
+	mu          sync.RWMutex
+	newExecutor execFactory
 }
 
 type KubernetesAgent struct {
-	sessionID string
-	client    *kubernetes.Clientset
-	namespace string
+	sessionID    string
+	repo         string
+	client       kubernetes.Interface
+	config       *rest.Config
+	namespace    string
+	newExecutor  execFactory
+	pollInterval time.Duration
 }
 
 func (a *KubernetesAgent) GetSessionID() string {
@@ -35,14 +75,229 @@ func (a *KubernetesAgent) GetSessionID() string {
 
 func (a *KubernetesAgent) StartSession(ctx context.Context) error {
 	// For now, just verify that the pod exists
-	_, err := a.client.CoreV1().Pods(a.namespace).Get(ctx, fmt.Sprintf("kommon-agent-%s", a.sessionID), metav1.GetOptions{})
+	_, err := a.client.CoreV1().Pods(a.namespace).Get(ctx, agentPodName(a.sessionID), metav1.GetOptions{})
 	return err
 }
 
+// Execute waits for the agent pod to be running and runs the prompt inside
+// the agent container through the pods/exec subresource.
 func (a *KubernetesAgent) Execute(ctx context.Context, input string) (string, error) {
-	// TODO: Implement execution logic
-	// This could involve sending commands to the pod or reading its logs
-	return "", nil
+	podName := agentPodName(a.sessionID)
+	if err := a.waitForPodRunning(ctx, podName); err != nil {
+		return "", err
+	}
+
+	opts := agent.ExecuteOptionsFrom(ctx)
+	execURL, err := a.execURL(podName, agentCommand(a.sessionID, a.repo, opts), true)
+	if err != nil {
+		return "", err
+	}
+
+	streamer, err := a.newExecutor(a.config, "POST", execURL)
+	if err != nil {
+		return "", fmt.Errorf("failed to create pod executor: %v", err)
+	}
+
+	// stdout and stderr share the buffer so the output keeps its original order
+	var output bytes.Buffer
+	streamErr := streamer.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  strings.NewReader(agentInput(opts, input)),
+		Stdout: &output,
+		Stderr: &output,
+	})
+	if streamErr != nil {
+		if ctx.Err() != nil {
+			// Ending the stream leaves the command running in the container
+			a.cancelExec(podName)
+			return output.String(), ctx.Err()
+		}
+		if exitErr, ok := streamErr.(utilexec.ExitError); ok {
+			if exitErr.ExitStatus() == agent.LimitExitCode {
+				return output.String(), agent.ParseLimitError(output.String())
+			}
+			return output.String(), &ExitError{ExitCode: exitErr.ExitStatus()}
+		}
+		return output.String(), fmt.Errorf("failed to execute command in pod %s: %v", podName, streamErr)
+	}
+
+	return output.String(), nil
+}
+
+// cancelExec stops the execution of the session running in the pod
+func (a *KubernetesAgent) cancelExec(podName string) {
+	// The execution context is already canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	execURL, err := a.execURL(podName, cancelCommand(a.sessionID), false)
+	if err != nil {
+		log.Printf("Failed to cancel execution in pod %s: %v", podName, err)
+		return
+	}
+	streamer, err := a.newExecutor(a.config, "POST", execURL)
+	if err != nil {
+		log.Printf("Failed to cancel execution in pod %s: %v", podName, err)
+		return
+	}
+	var output bytes.Buffer
+	if err := streamer.StreamWithContext(ctx, remotecommand.StreamOptions{Stdout: &output, Stderr: &output}); err != nil {
+		log.Printf("Failed to cancel execution in pod %s: %v: %s", podName, err, output.String())
+	}
+}
+
+// waitForPodRunning blocks until the pod is running or the context is done
+func (a *KubernetesAgent) waitForPodRunning(ctx context.Context, podName string) error {
+	err := wait.PollUntilContextCancel(ctx, a.pollInterval, true, func(ctx context.Context) (bool, error) {
+		pod, err := a.client.CoreV1().Pods(a.namespace).Get(ctx, podName, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		switch pod.Status.Phase {
+		case corev1.PodRunning:
+			return true, nil
+		case corev1.PodSucceeded, corev1.PodFailed:
+			return false, fmt.Errorf("agent pod %s is %s", podName, pod.Status.Phase)
+		default:
+			return false, nil
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed waiting for agent pod %s: %v", podName, err)
+	}
+	return nil
+}
+
+// execURL builds the pods/exec URL running the command in the agent container
+func (a *KubernetesAgent) execURL(podName string, command []string, stdin bool) (*url.URL, error) {
+	config := rest.CopyConfig(a.config)
+	config.APIPath = "/api"
+	config.GroupVersion = &corev1.SchemeGroupVersion
+
+	base, versionedAPIPath, err := rest.DefaultServerUrlFor(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build kubernetes API URL: %v", err)
+	}
+
+	req := rest.NewRequestWithClient(base, versionedAPIPath, rest.ClientContentConfig{GroupVersion: corev1.SchemeGroupVersion}, nil).
+		Verb("POST").
+		Namespace(a.namespace).
+		Resource("pods").
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: agentContainerName,
+			Command:   command,
+			Stdin:     stdin,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	if err := req.Error(); err != nil {
+		return nil, fmt.Errorf("failed to build exec request: %v", err)
+	}
+
+	return req.URL(), nil
+}
+
+// agentCommand returns the command run inside agent containers. The prompt is
+// passed through stdin, after the GitHub token of the execution if there is
+// one (see agentInput).
+func agentCommand(sessionID, repo string, opts agent.ExecuteOptions) []string {
+	command := []string{"kommon", "run", "--session-id", sessionID}
+	if repo != "" {
+		command = append(command, "--repo", repo)
+	}
+	if opts.Model != "" {
+		command = append(command, "--model", opts.Model)
+	}
+	if opts.Provider != "" {
+		command = append(command, "--provider", opts.Provider)
+	}
+	if opts.Branch != "" {
+		command = append(command, "--branch", opts.Branch)
+	}
+	if opts.HeadRepo != "" {
+		command = append(command, "--head-repo", opts.HeadRepo)
+	}
+	if opts.BaseBranch != "" {
+		command = append(command, "--base-branch", opts.BaseBranch)
+	}
+	for _, setup := range opts.Setup {
+		command = append(command, "--setup", setup)
+	}
+	// The limits are enforced inside the container the same way as locally
+	limits := opts.Limits
+	if limits.Timeout > 0 {
+		command = append(command, "--timeout", limits.Timeout.String())
+	}
+	if limits.MaxOutputBytes > 0 {
+		command = append(command, "--max-output-bytes", strconv.FormatInt(limits.MaxOutputBytes, 10))
+	}
+	if limits.MaxTokens > 0 {
+		command = append(command, "--max-tokens", strconv.FormatInt(limits.MaxTokens, 10))
+	}
+	if limits.MaxCost > 0 {
+		command = append(command, "--max-cost", strconv.FormatFloat(limits.MaxCost, 'f', -1, 64))
+	}
+	if limits.CostPerMTokens > 0 {
+		command = append(command, "--cost-per-million-tokens", strconv.FormatFloat(limits.CostPerMTokens, 'f', -1, 64))
+	}
+	if opts.GitHubToken != "" {
+		command = append(command, "--github-token-stdin")
+	}
+	return append(command, "--text", "-")
+}
+
+// agentInput returns the stdin of agentCommand. The token is never part of
+// the command, which shows up in process lists and API server logs.
+func agentInput(opts agent.ExecuteOptions, input string) string {
+	if opts.GitHubToken == "" {
+		return input
+	}
+	return opts.GitHubToken + "\n" + input
+}
+
+// cancelCommand returns the command stopping the execution of the session
+// inside its agent container
+func cancelCommand(sessionID string) []string {
+	return []string{"kommon", "cancel", "--session-id", sessionID}
+}
+
+func agentPodName(sessionID string) string {
+	return fmt.Sprintf("kommon-agent-%s", resourceName(sessionID))
+}
+
+// resourceName converts a session ID into a string usable in object names
+// and label values. Long IDs are shortened with a hash suffix to stay unique.
+func resourceName(sessionID string) string {
+	name := invalidNameChars.ReplaceAllString(strings.ToLower(sessionID), "-")
+	name = strings.Trim(name, "-")
+	if len(name) <= maxSessionNameLength {
+		return name
+	}
+
+	sum := sha256.Sum256([]byte(sessionID))
+	prefix := strings.TrimRight(name[:maxSessionNameLength-9], "-")
+	return fmt.Sprintf("%s-%s", prefix, hex.EncodeToString(sum[:])[:8])
+}
+
+// agentLabels returns the labels identifying the resources of an agent
+func agentLabels(sessionID string) map[string]string {
+	return map[string]string{
+		"app":          "kommon",
+		"component":    "agent",
+		sessionIDLabel: resourceName(sessionID),
+	}
+}
+
+// agentAnnotations keeps the original session ID, which may not be a valid label value
+func agentAnnotations(sessionID string) map[string]string {
+	return map[string]string{
+		sessionIDAnnotation: sessionID,
+	}
 }
 
 func NewKubernetesExecutor(opts ExecutorOptions) (Executor, error) {
@@ -51,6 +306,11 @@ func NewKubernetesExecutor(opts ExecutorOptions) (Executor, error) {
 		err    error
 	)
 
+	resources, err := parseResourceRequirements(opts.Resources)
+	if err != nil {
+		return nil, err
+	}
+
 	// Try to use in-cluster config first
 	config, err = rest.InClusterConfig()
 	if err != nil {
@@ -76,12 +336,101 @@ func NewKubernetesExecutor(opts ExecutorOptions) (Executor, error) {
 	}
 
 	return &KubernetesExecutor{
-		client:    clientset,
-		namespace: namespace,
-		agents:    make(map[string]bool),
+		client:      clientset,
+		config:      config,
+		namespace:   namespace,
+		options:     opts,
+		resources:   resources,
+		agents:      make(map[string]bool),
+		adopted:     make(map[string]bool),
+		newExecutor: remotecommand.NewSPDYExecutor,
 	}, nil
 }
 
+// parseResourceRequirements converts the executor resource limits into pod resource limits
+func parseResourceRequirements(req *ResourceRequirements) (corev1.ResourceRequirements, error) {
+	resources := corev1.ResourceRequirements{}
+	if req == nil {
+		return resources, nil
+	}
+
+	limits := corev1.ResourceList{}
+	if req.CPULimit != "" {
+		cpu, err := resource.ParseQuantity(req.CPULimit)
+		if err != nil {
+			return resources, fmt.Errorf("invalid cpu limit %q: %v", req.CPULimit, err)
+		}
+		limits[corev1.ResourceCPU] = cpu
+	}
+	if req.MemoryLimit != "" {
+		memory, err := resource.ParseQuantity(req.MemoryLimit)
+		if err != nil {
+			return resources, fmt.Errorf("invalid memory limit %q: %v", req.MemoryLimit, err)
+		}
+		limits[corev1.ResourceMemory] = memory
+	}
+	if req.DiskLimit != "" {
+		disk, err := resource.ParseQuantity(req.DiskLimit)
+		if err != nil {
+			return resources, fmt.Errorf("invalid disk limit %q: %v", req.DiskLimit, err)
+		}
+		limits[corev1.ResourceEphemeralStorage] = disk
+	}
+
+	if len(limits) > 0 {
+		resources.Limits = limits
+	}
+	return resources, nil
+}
+
+// image returns the configured agent image
+func (e *KubernetesExecutor) image() string {
+	if e.options.Resources != nil && e.options.Resources.Image != "" {
+		return e.options.Resources.Image
+	}
+	return DefaultAgentImage
+}
+
+// agentPodSpec builds the pod spec for an agent running the given command
+func (e *KubernetesExecutor) agentPodSpec(opts agent.GooseOptions, command []string) corev1.PodSpec {
+	spec := corev1.PodSpec{
+		RestartPolicy: corev1.RestartPolicyNever,
+		Containers: []corev1.Container{
+			{
+				Name:      agentContainerName,
+				Image:     e.image(),
+				Command:   command,
+				Resources: e.resources,
+				Env: []corev1.EnvVar{
+					{
+						Name:  "SESSION_ID",
+						Value: opts.SessionID,
+					},
+					{
+						Name:  "API_KEY",
+						Value: opts.APIKey,
+					},
+					{
+						Name:  "KOMMON_API_KEY",
+						Value: opts.APIKey,
+					},
+				},
+			},
+		},
+	}
+
+	if k := e.options.Kubernetes; k != nil {
+		spec.ServiceAccountName = k.ServiceAccountName
+		spec.NodeSelector = k.NodeSelector
+		spec.Tolerations = k.Tolerations
+		for _, name := range k.ImagePullSecrets {
+			spec.ImagePullSecrets = append(spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+
+	return spec
+}
+
 func (e *KubernetesExecutor) Initialize(ctx context.Context) error {
 	// Check if namespace exists
 	_, err := e.client.CoreV1().Namespaces().Get(ctx, e.namespace, metav1.GetOptions{})
@@ -102,45 +451,107 @@ func (e *KubernetesExecutor) Initialize(ctx context.Context) error {
 		}
 	}
 
+	return e.rediscoverAgents(ctx)
+}
+
+// rediscoverAgents adds the agents left by a previous process back to the
+// registry, or removes them when their session is an orphan
+func (e *KubernetesExecutor) rediscoverAgents(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.jobMode() {
+		jobs, err := e.client.BatchV1().Jobs(e.namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: "app=kommon,component=agent",
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list agent jobs: %v", err)
+		}
+		for i := range jobs.Items {
+			sessionID := objectSessionID(&jobs.Items[i])
+			if sessionID == "" || e.agents[sessionID] {
+				continue
+			}
+			if !e.options.shouldAdopt(sessionID) {
+				if err := e.deleteJobs(ctx, sessionID); err != nil {
+					return err
+				}
+				continue
+			}
+			e.agents[sessionID] = true
+			e.adopted[sessionID] = true
+		}
+		return nil
+	}
+
+	// Pods owned by jobs are handled above
+	pods, err := e.client.CoreV1().Pods(e.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app=kommon,component=agent,!job-name",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list agent pods: %v", err)
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		sessionID := objectSessionID(pod)
+		if sessionID == "" || e.agents[sessionID] {
+			continue
+		}
+
+		// Finished pods can't run prompts anymore
+		finished := pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+		if finished || !e.options.shouldAdopt(sessionID) {
+			err := e.client.CoreV1().Pods(e.namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete orphaned agent pod %s: %v", pod.Name, err)
+			}
+			continue
+		}
+		e.agents[sessionID] = true
+		e.adopted[sessionID] = true
+	}
 	return nil
 }
 
+// objectSessionID returns the session ID an agent resource was created for
+func objectSessionID(obj metav1.Object) string {
+	if sessionID := obj.GetAnnotations()[sessionIDAnnotation]; sessionID != "" {
+		return sessionID
+	}
+	return obj.GetLabels()[sessionIDLabel]
+}
+
 func (e *KubernetesExecutor) CreateAgent(ctx context.Context, opts agent.GooseOptions) (agent.Agent, error) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	if e.agents[opts.SessionID] {
-		return nil, fmt.Errorf("agent with session ID %s already exists", opts.SessionID)
+		if !e.adopted[opts.SessionID] {
+			return nil, fmt.Errorf("agent with session ID %s already exists", opts.SessionID)
+		}
+
+		// Reattach to the agent rediscovered on startup
+		delete(e.adopted, opts.SessionID)
+		if e.jobMode() {
+			return e.newJobAgent(opts), nil
+		}
+		return e.newPodAgent(opts), nil
+	}
+
+	// In job mode every execution runs in its own job, so nothing is created up front
+	if e.jobMode() {
+		e.agents[opts.SessionID] = true
+		return e.newJobAgent(opts), nil
 	}
 
 	pod := &corev1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("kommon-agent-%s", opts.SessionID),
-			Labels: map[string]string{
-				"app":        "kommon",
-				"component":  "agent",
-				"session-id": opts.SessionID,
-			},
-		},
-		Spec: corev1.PodSpec{
-			RestartPolicy: corev1.RestartPolicyNever,
-			Containers: []corev1.Container{
-				{
-					Name:  "agent",
-					Image: "kommon-agent:latest", // TODO: Make configurable
-					Env: []corev1.EnvVar{
-						{
-							Name:  "SESSION_ID",
-							Value: opts.SessionID,
-						},
-						{
-							Name:  "API_KEY",
-							Value: opts.APIKey,
-						},
-					},
-				},
-			},
+			Name:        agentPodName(opts.SessionID),
+			Labels:      agentLabels(opts.SessionID),
+			Annotations: agentAnnotations(opts.SessionID),
 		},
+		// Keep the container alive so prompts can be executed in it
+		Spec: e.agentPodSpec(opts, []string{"sleep", "infinity"}),
 	}
 
 	_, err := e.client.CoreV1().Pods(e.namespace).Create(ctx, pod, metav1.CreateOptions{})
@@ -150,11 +561,19 @@ func (e *KubernetesExecutor) CreateAgent(ctx context.Context, opts agent.GooseOp
 
 	e.agents[opts.SessionID] = true
 
+	return e.newPodAgent(opts), nil
+}
+
+func (e *KubernetesExecutor) newPodAgent(opts agent.GooseOptions) *KubernetesAgent {
 	return &KubernetesAgent{
-		sessionID: opts.SessionID,
-		client:    e.client,
-		namespace: e.namespace,
-	}, nil
+		sessionID:    opts.SessionID,
+		repo:         opts.Repo,
+		client:       e.client,
+		config:       e.config,
+		namespace:    e.namespace,
+		newExecutor:  e.newExecutor,
+		pollInterval: podPollInterval,
+	}
 }
 
 func (e *KubernetesExecutor) ListAgents(ctx context.Context) ([]string, error) {
@@ -176,13 +595,23 @@ func (e *KubernetesExecutor) DestroyAgent(ctx context.Context, sessionID string)
 		return fmt.Errorf("agent with session ID %s does not exist", sessionID)
 	}
 
-	podName := fmt.Sprintf("kommon-agent-%s", sessionID)
+	if e.jobMode() {
+		if err := e.deleteJobs(ctx, sessionID); err != nil {
+			return err
+		}
+		delete(e.agents, sessionID)
+		delete(e.adopted, sessionID)
+		return nil
+	}
+
+	podName := agentPodName(sessionID)
 	err := e.client.CoreV1().Pods(e.namespace).Delete(ctx, podName, metav1.DeleteOptions{})
 	if err != nil && !errors.IsNotFound(err) {
 		return fmt.Errorf("failed to delete agent pod: %v", err)
 	}
 
 	delete(e.agents, sessionID)
+	delete(e.adopted, sessionID)
 	return nil
 }
 
@@ -0,0 +1,320 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/takutakahashi/kommon/pkg/agent"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// jobSecretTokenKey is the key of the GitHub token in the Secret of a job
+	jobSecretTokenKey = "github-token"
+	// jobSecretPromptKey is the key of the prompt in the Secret of a job
+	jobSecretPromptKey = "prompt"
+	// jobSecretVolume is mounted at jobSecretDir in the agent container
+	jobSecretVolume = "kommon-job"
+	jobSecretDir    = "/var/run/kommon"
+)
+
+var (
+	defaultJobTTLSecondsAfterFinished = int32(3600)
+	defaultJobActiveDeadlineSeconds   = int64(3600)
+	defaultJobBackoffLimit            = int32(2)
+)
+
+// KubernetesJobAgent runs every prompt as a batch/v1 Job and returns the
+// logs of the job pod as output
+type KubernetesJobAgent struct {
+	opts         agent.GooseOptions
+	client       kubernetes.Interface
+	namespace    string
+	template     func(command []string) corev1.PodSpec
+	jobOptions   JobOptions
+	pollInterval time.Duration
+}
+
+func (a *KubernetesJobAgent) GetSessionID() string {
+	return a.opts.SessionID
+}
+
+// Execute creates a Job running the prompt, waits for it to finish and
+// collects the output from the job pod logs
+func (a *KubernetesJobAgent) Execute(ctx context.Context, input string) (string, error) {
+	opts := agent.ExecuteOptionsFrom(ctx)
+	job := a.buildJob(input, opts)
+
+	created, err := a.client.BatchV1().Jobs(a.namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create agent job: %v", err)
+	}
+
+	// The pod waits for the Secret, which is removed along with the job
+	secret := jobSecret(created, input, opts.GitHubToken)
+	if _, err := a.client.CoreV1().Secrets(a.namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		a.deleteJob(created.Name)
+		return "", fmt.Errorf("failed to create secret of agent job: %v", err)
+	}
+
+	finished, waitErr := a.waitForJob(ctx, created.Name)
+	if waitErr != nil {
+		// The job is useless once nobody waits for it
+		a.deleteJob(created.Name)
+		return "", waitErr
+	}
+
+	output, logErr := a.jobLogs(ctx, created.Name)
+	if logErr != nil {
+		return "", logErr
+	}
+
+	if cond := jobCondition(finished, batchv1.JobFailed); cond != nil {
+		switch {
+		case cond.Reason == "PodFailurePolicy":
+			// Only a limit stopping the agent fails the job this way
+			return output, agent.ParseLimitError(output)
+		case cond.Reason == "DeadlineExceeded" && opts.Limits.Timeout > 0:
+			return output, agent.NewTimeoutError(opts.Limits.Timeout)
+		}
+		return output, fmt.Errorf("agent job %s failed: %s", created.Name, cond.Message)
+	}
+	return output, nil
+}
+
+func (a *KubernetesJobAgent) buildJob(input string, opts agent.ExecuteOptions) *batchv1.Job {
+	name := fmt.Sprintf("kommon-job-%s-%s", resourceName(a.opts.SessionID), utilrand.String(5))
+
+	// Jobs can't receive stdin, so the prompt and the token come from the
+	// Secret of the job: the prompt as a file and the token through the
+	// environment. Neither is readable in the job itself, and the size of
+	// the prompt doesn't count against the job object.
+	token := opts.GitHubToken
+	opts.GitHubToken = ""
+	command := agentCommand(a.opts.SessionID, a.opts.Repo, opts)
+	command = append(command[:len(command)-2], "--text-file", jobSecretDir+"/"+jobSecretPromptKey)
+
+	spec := a.template(command)
+	spec.RestartPolicy = corev1.RestartPolicyNever
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: jobSecretVolume,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: name,
+				Items:      []corev1.KeyToPath{{Key: jobSecretPromptKey, Path: jobSecretPromptKey}},
+			},
+		},
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      jobSecretVolume,
+		MountPath: jobSecretDir,
+		ReadOnly:  true,
+	})
+	if token != "" {
+		spec.Containers[0].Env = append(spec.Containers[0].Env, corev1.EnvVar{
+			Name: "KOMMON_GITHUB_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: name},
+					Key:                  jobSecretTokenKey,
+				},
+			},
+		})
+	}
+
+	// The agent enforces the timeout itself; the deadline only catches a pod
+	// that doesn't stop in time
+	deadline := a.jobOptions.ActiveDeadlineSeconds
+	if opts.Limits.Timeout > 0 {
+		seconds := int64((opts.Limits.Timeout + agent.LimitGracePeriod).Seconds())
+		if deadline == nil || seconds < *deadline {
+			deadline = &seconds
+		}
+	}
+
+	container := agentContainerName
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      agentLabels(a.opts.SessionID),
+			Annotations: agentAnnotations(a.opts.SessionID),
+		},
+		Spec: batchv1.JobSpec{
+			TTLSecondsAfterFinished: a.jobOptions.TTLSecondsAfterFinished,
+			ActiveDeadlineSeconds:   deadline,
+			BackoffLimit:            a.jobOptions.BackoffLimit,
+			// Retrying an execution that exceeded a limit would exceed it again
+			PodFailurePolicy: &batchv1.PodFailurePolicy{
+				Rules: []batchv1.PodFailurePolicyRule{{
+					Action: batchv1.PodFailurePolicyActionFailJob,
+					OnExitCodes: &batchv1.PodFailurePolicyOnExitCodesRequirement{
+						ContainerName: &container,
+						Operator:      batchv1.PodFailurePolicyOnExitCodesOpIn,
+						Values:        []int32{agent.LimitExitCode},
+					},
+				}},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      agentLabels(a.opts.SessionID),
+					Annotations: agentAnnotations(a.opts.SessionID),
+				},
+				Spec: spec,
+			},
+		},
+	}
+}
+
+// jobSecret returns the Secret holding the prompt and the token of the job.
+// It is owned by the job, so it is deleted with it.
+func jobSecret(job *batchv1.Job, input, token string) *corev1.Secret {
+	data := map[string][]byte{jobSecretPromptKey: []byte(input)}
+	if token != "" {
+		data[jobSecretTokenKey] = []byte(token)
+	}
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        job.Name,
+			Labels:      job.Labels,
+			Annotations: job.Annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(job, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: data,
+	}
+}
+
+// waitForJob blocks until the job completes or fails
+func (a *KubernetesJobAgent) waitForJob(ctx context.Context, name string) (*batchv1.Job, error) {
+	var finished *batchv1.Job
+	err := wait.PollUntilContextCancel(ctx, a.pollInterval, true, func(ctx context.Context) (bool, error) {
+		job, err := a.client.BatchV1().Jobs(a.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if jobCondition(job, batchv1.JobComplete) != nil || jobCondition(job, batchv1.JobFailed) != nil {
+			finished = job
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed waiting for agent job %s: %v", name, err)
+	}
+	return finished, nil
+}
+
+// jobLogs returns the logs of the most recent pod of the job
+func (a *KubernetesJobAgent) jobLogs(ctx context.Context, name string) (string, error) {
+	pods, err := a.client.CoreV1().Pods(a.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{"job-name": name}).String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods of job %s: %v", name, err)
+	}
+	if len(pods.Items) == 0 {
+		return "", fmt.Errorf("no pods found for job %s", name)
+	}
+
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].CreationTimestamp.Before(&pods.Items[j].CreationTimestamp)
+	})
+	pod := pods.Items[len(pods.Items)-1]
+
+	stream, err := a.client.CoreV1().Pods(a.namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: agentContainerName,
+	}).Stream(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get logs of pod %s: %v", pod.Name, err)
+	}
+	defer stream.Close()
+
+	var output strings.Builder
+	if _, err := io.Copy(&output, stream); err != nil {
+		return "", fmt.Errorf("failed to read logs of pod %s: %v", pod.Name, err)
+	}
+	return output.String(), nil
+}
+
+func (a *KubernetesJobAgent) deleteJob(name string) {
+	// Use a fresh context as the execution context is usually already canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	propagation := metav1.DeletePropagationBackground
+	_ = a.client.BatchV1().Jobs(a.namespace).Delete(ctx, name, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+}
+
+func jobCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		cond := &job.Status.Conditions[i]
+		if cond.Type == conditionType && cond.Status == corev1.ConditionTrue {
+			return cond
+		}
+	}
+	return nil
+}
+
+// jobMode reports whether the executor runs prompts as Jobs
+func (e *KubernetesExecutor) jobMode() bool {
+	return e.options.Kubernetes != nil && e.options.Kubernetes.Mode == KubernetesModeJob
+}
+
+func (e *KubernetesExecutor) newJobAgent(opts agent.GooseOptions) *KubernetesJobAgent {
+	jobOptions := JobOptions{
+		TTLSecondsAfterFinished: &defaultJobTTLSecondsAfterFinished,
+		ActiveDeadlineSeconds:   &defaultJobActiveDeadlineSeconds,
+		BackoffLimit:            &defaultJobBackoffLimit,
+	}
+	if custom := e.options.Kubernetes.Job; custom != nil {
+		if custom.TTLSecondsAfterFinished != nil {
+			jobOptions.TTLSecondsAfterFinished = custom.TTLSecondsAfterFinished
+		}
+		if custom.ActiveDeadlineSeconds != nil {
+			jobOptions.ActiveDeadlineSeconds = custom.ActiveDeadlineSeconds
+		}
+		if custom.BackoffLimit != nil {
+			jobOptions.BackoffLimit = custom.BackoffLimit
+		}
+	}
+
+	return &KubernetesJobAgent{
+		opts:      opts,
+		client:    e.client,
+		namespace: e.namespace,
+		template: func(command []string) corev1.PodSpec {
+			return e.agentPodSpec(opts, command)
+		},
+		jobOptions:   jobOptions,
+		pollInterval: podPollInterval,
+	}
+}
+
+// deleteJobs removes all jobs of the session along with their pods
+func (e *KubernetesExecutor) deleteJobs(ctx context.Context, sessionID string) error {
+	propagation := metav1.DeletePropagationBackground
+	err := e.client.BatchV1().Jobs(e.namespace).DeleteCollection(ctx, metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	}, metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(labels.Set{sessionIDLabel: resourceName(sessionID)}).String(),
+	})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete agent jobs: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func newJobModeExecutor(client *fake.Clientset, jobOptions *JobOptions) *KubernetesExecutor {
+	return &KubernetesExecutor{
+		client:    client,
+		config:    &rest.Config{},
+		namespace: testNamespace,
+		options: ExecutorOptions{
+			Type: ExecutorTypeKubernetes,
+			Kubernetes: &KubernetesOptions{
+				Mode: KubernetesModeJob,
+				Job:  jobOptions,
+			},
+		},
+		agents:  make(map[string]bool),
+		adopted: make(map[string]bool),
+	}
+}
+
+// finishJob waits for the agent job to be created, then simulates the job
+// controller by creating its pod and marking the job with the given condition
+func finishJob(t *testing.T, client *fake.Clientset, conditionType batchv1.JobConditionType) {
+	finishJobWithReason(t, client, conditionType, "")
+}
+
+func finishJobWithReason(t *testing.T, client *fake.Clientset, conditionType batchv1.JobConditionType, reason string) {
+	t.Helper()
+
+	ctx := context.Background()
+	var job batchv1.Job
+	require.Eventually(t, func() bool {
+		jobs, err := client.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+		if err != nil || len(jobs.Items) == 0 {
+			return false
+		}
+		job = jobs.Items[0]
+		return true
+	}, time.Second, 5*time.Millisecond)
+
+	_, err := client.CoreV1().Pods(testNamespace).Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   job.Name + "-abcde",
+			Labels: map[string]string{"job-name": job.Name},
+		},
+	}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{
+		Type:    conditionType,
+		Status:  corev1.ConditionTrue,
+		Reason:  reason,
+		Message: "BackoffLimitExceeded",
+	})
+	_, err = client.BatchV1().Jobs(testNamespace).UpdateStatus(ctx, &job, metav1.UpdateOptions{})
+	require.NoError(t, err)
+}
+
+// executeAsync starts the execution and returns a function waiting for its result
+func executeAsync(a agent.Agent, input string) func() (string, error) {
+	type result struct {
+		output string
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		output, err := a.Execute(context.Background(), input)
+		done <- result{output, err}
+	}()
+	return func() (string, error) {
+		r := <-done
+		return r.output, r.err
+	}
+}
+
+func TestKubernetesJobAgent(t *testing.T) {
+	ctx := context.Background()
+	agentOpts := agent.GooseOptions{SessionID: "owner/repo-1", Repo: "owner/repo", APIKey: "test-key"}
+
+	t.Run("Complete", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		backoffLimit := int32(5)
+		executor := newJobModeExecutor(client, &JobOptions{BackoffLimit: &backoffLimit})
+
+		a, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+		jobAgent := a.(*KubernetesJobAgent)
+		jobAgent.pollInterval = 5 * time.Millisecond
+
+		// No pod is created up front in job mode
+		pods, err := client.CoreV1().Pods(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, pods.Items)
+
+		result := executeAsync(jobAgent, "do something")
+		finishJob(t, client, batchv1.JobComplete)
+
+		output, err := result()
+		require.NoError(t, err)
+		// The fake clientset always returns this for pod logs
+		assert.Equal(t, "fake logs", output)
+
+		jobs, err := client.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, jobs.Items, 1)
+		job := jobs.Items[0]
+		assert.Equal(t, "owner-repo-1", job.Labels[sessionIDLabel])
+		assert.Equal(t, "owner/repo-1", job.Annotations[sessionIDAnnotation])
+		assert.Equal(t, int32(5), *job.Spec.BackoffLimit)
+		assert.Equal(t, defaultJobTTLSecondsAfterFinished, *job.Spec.TTLSecondsAfterFinished)
+		assert.Equal(t, defaultJobActiveDeadlineSeconds, *job.Spec.ActiveDeadlineSeconds)
+		assert.Equal(t, corev1.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+
+		// The prompt is read from the Secret of the job, not the job itself
+		podSpec := job.Spec.Template.Spec
+		command := podSpec.Containers[0].Command
+		assert.Equal(t, []string{"--text-file", "/var/run/kommon/prompt"}, command[len(command)-2:])
+		assert.NotContains(t, command, "do something")
+		assert.Equal(t, []corev1.VolumeMount{{Name: jobSecretVolume, MountPath: jobSecretDir, ReadOnly: true}}, podSpec.Containers[0].VolumeMounts)
+		require.Len(t, podSpec.Volumes, 1)
+		assert.Equal(t, job.Name, podSpec.Volumes[0].Secret.SecretName)
+
+		secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, job.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "do something", string(secret.Data[jobSecretPromptKey]))
+		assert.NotContains(t, secret.Data, jobSecretTokenKey)
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		executor := newJobModeExecutor(client, nil)
+
+		a, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+		jobAgent := a.(*KubernetesJobAgent)
+		jobAgent.pollInterval = 5 * time.Millisecond
+
+		tokenCtx := agent.WithExecuteOptions(ctx, agent.ExecuteOptions{GitHubToken: "ghs_token"})
+		done := make(chan error, 1)
+		go func() {
+			_, err := jobAgent.Execute(tokenCtx, "prompt")
+			done <- err
+		}()
+		finishJob(t, client, batchv1.JobComplete)
+		require.NoError(t, <-done)
+
+		jobs, err := client.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, jobs.Items, 1)
+		job := jobs.Items[0]
+
+		// Only a reference to the Secret of the job is visible in the job
+		container := job.Spec.Template.Spec.Containers[0]
+		assert.NotContains(t, container.Command, "ghs_token")
+		var tokenEnv *corev1.EnvVar
+		for i := range container.Env {
+			assert.NotEqual(t, "ghs_token", container.Env[i].Value)
+			if container.Env[i].Name == "KOMMON_GITHUB_TOKEN" {
+				tokenEnv = &container.Env[i]
+			}
+		}
+		require.NotNil(t, tokenEnv)
+		assert.Equal(t, &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: job.Name},
+			Key:                  jobSecretTokenKey,
+		}, tokenEnv.ValueFrom.SecretKeyRef)
+
+		secret, err := client.CoreV1().Secrets(testNamespace).Get(ctx, job.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, "ghs_token", string(secret.Data[jobSecretTokenKey]))
+		require.Len(t, secret.OwnerReferences, 1)
+		assert.Equal(t, "Job", secret.OwnerReferences[0].Kind)
+		assert.Equal(t, job.Name, secret.OwnerReferences[0].Name)
+	})
+
+	t.Run("Failed", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		executor := newJobModeExecutor(client, nil)
+
+		a, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+		jobAgent := a.(*KubernetesJobAgent)
+		jobAgent.pollInterval = 5 * time.Millisecond
+
+		result := executeAsync(jobAgent, "fail")
+		finishJob(t, client, batchv1.JobFailed)
+
+		output, err := result()
+		assert.Error(t, err)
+		assert.Equal(t, "fake logs", output)
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		executor := newJobModeExecutor(client, nil)
+
+		a, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+		jobAgent := a.(*KubernetesJobAgent)
+		jobAgent.pollInterval = 5 * time.Millisecond
+
+		limitCtx := agent.WithExecuteOptions(ctx, agent.ExecuteOptions{Limits: agent.Limits{Timeout: 10 * time.Minute}})
+		done := make(chan error, 1)
+		go func() {
+			_, err := jobAgent.Execute(limitCtx, "runs too long")
+			done <- err
+		}()
+		finishJobWithReason(t, client, batchv1.JobFailed, "DeadlineExceeded")
+
+		err = <-done
+		var limitErr *agent.LimitError
+		require.ErrorAs(t, err, &limitErr)
+		assert.Equal(t, "timed out after 10m", limitErr.Error())
+
+		jobs, err := client.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, jobs.Items, 1)
+		spec := jobs.Items[0].Spec
+		assert.Equal(t, int64(660), *spec.ActiveDeadlineSeconds, "the deadline follows the timeout")
+		require.NotNil(t, spec.PodFailurePolicy)
+		assert.Equal(t, []int32{agent.LimitExitCode}, spec.PodFailurePolicy.Rules[0].OnExitCodes.Values)
+		assert.Contains(t, spec.Template.Spec.Containers[0].Command, "10m0s")
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		executor := newJobModeExecutor(client, nil)
+
+		a, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+		jobAgent := a.(*KubernetesJobAgent)
+		jobAgent.pollInterval = 5 * time.Millisecond
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err = jobAgent.Execute(timeoutCtx, "never finishes")
+		assert.Error(t, err)
+
+		// The unfinished job is cleaned up
+		jobs, err := client.BatchV1().Jobs(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, jobs.Items)
+	})
+
+	t.Run("DestroyAgent", func(t *testing.T) {
+		client := fake.NewSimpleClientset()
+		executor := newJobModeExecutor(client, nil)
+
+		_, err := executor.CreateAgent(ctx, agentOpts)
+		require.NoError(t, err)
+
+		err = executor.DestroyAgent(ctx, agentOpts.SessionID)
+		require.NoError(t, err)
+
+		agents, err := executor.ListAgents(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, agents)
+	})
+}
+
+func TestAgentCommand(t *testing.T) {
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "owner/repo-1", "--repo", "owner/repo", "--text", "-"},
+		agentCommand("owner/repo-1", "owner/repo", agent.ExecuteOptions{}))
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "owner/repo-1", "--model", "openai/gpt-4o", "--branch", "fix/login", "--text", "-"},
+		agentCommand("owner/repo-1", "", agent.ExecuteOptions{Model: "openai/gpt-4o", Branch: "fix/login"}))
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "s", "--branch", "main", "--head-repo", "alice/repo", "--text", "-"},
+		agentCommand("s", "", agent.ExecuteOptions{Branch: "main", HeadRepo: "alice/repo"}))
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "s", "--provider", "anthropic", "--base-branch", "develop", "--setup", "make deps", "--setup", "npm ci", "--text", "-"},
+		agentCommand("s", "", agent.ExecuteOptions{Provider: "anthropic", BaseBranch: "develop", Setup: []string{"make deps", "npm ci"}}))
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "s", "--timeout", "15m0s", "--max-output-bytes", "1048576", "--max-tokens", "100000", "--max-cost", "1.5", "--cost-per-million-tokens", "3", "--text", "-"},
+		agentCommand("s", "", agent.ExecuteOptions{Limits: agent.Limits{
+			Timeout:        15 * time.Minute,
+			MaxOutputBytes: 1 << 20,
+			MaxTokens:      100000,
+			MaxCost:        1.5,
+			CostPerMTokens: 3,
+		}}))
+
+	// The token is read from stdin, never passed as an argument
+	opts := agent.ExecuteOptions{GitHubToken: "ghs_token"}
+	assert.Equal(t,
+		[]string{"kommon", "run", "--session-id", "s", "--github-token-stdin", "--text", "-"},
+		agentCommand("s", "", opts))
+	assert.Equal(t, "ghs_token\nprompt", agentInput(opts, "prompt"))
+	assert.Equal(t, "prompt", agentInput(agent.ExecuteOptions{}, "prompt"))
+}
+
+func TestResourceName(t *testing.T) {
+	assert.Equal(t, "owner-repo-1", resourceName("owner/repo-1"))
+	assert.Equal(t, "test-agent-1", resourceName("test-agent-1"))
+
+	long := resourceName("takutakahashi/a-very-long-repository-name-for-testing-123")
+	assert.LessOrEqual(t, len(long), maxSessionNameLength)
+	assert.NotEqual(t, long, resourceName("takutakahashi/a-very-long-repository-name-for-testing-456"))
+}
@@ -3,6 +3,8 @@ package executor
 import (
 	"context"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"testing"
@@ -14,7 +16,11 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
 )
 
 const (
@@ -173,3 +179,273 @@ func TestKubernetesExecutor(t *testing.T) {
 		assert.Error(t, err)
 	})
 }
+
+type fakeStreamExecutor struct {
+	stdout string
+	stderr string
+	err    error
+	stdin  string
+	hang   bool // Block the prompt until the context is done
+}
+
+func (f *fakeStreamExecutor) Stream(options remotecommand.StreamOptions) error {
+	return f.StreamWithContext(context.Background(), options)
+}
+
+func (f *fakeStreamExecutor) StreamWithContext(ctx context.Context, options remotecommand.StreamOptions) error {
+	if options.Stdin == nil {
+		return nil
+	}
+	input, err := io.ReadAll(options.Stdin)
+	if err != nil {
+		return err
+	}
+	f.stdin = string(input)
+	if f.hang {
+		<-ctx.Done()
+	}
+	_, _ = io.WriteString(options.Stdout, f.stdout)
+	_, _ = io.WriteString(options.Stderr, f.stderr)
+	if f.err != nil {
+		return f.err
+	}
+	return ctx.Err()
+}
+
+func newFakeKubernetesAgent(t *testing.T, phase corev1.PodPhase, stream *fakeStreamExecutor) (*KubernetesAgent, *url.URL) {
+	t.Helper()
+
+	client := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      agentPodName("session-1"),
+			Namespace: testNamespace,
+		},
+		Status: corev1.PodStatus{Phase: phase},
+	})
+
+	var execURL url.URL
+	return &KubernetesAgent{
+		sessionID: "session-1",
+		repo:      "owner/repo",
+		client:    client,
+		config:    &rest.Config{Host: "https://kubernetes.example.com"},
+		namespace: testNamespace,
+		newExecutor: func(config *rest.Config, method string, u *url.URL) (remotecommand.Executor, error) {
+			assert.Equal(t, "POST", method)
+			execURL = *u
+			return stream, nil
+		},
+		pollInterval: 10 * time.Millisecond,
+	}, &execURL
+}
+
+func TestKubernetesAgentExecute(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		stream := &fakeStreamExecutor{stdout: "hello\n", stderr: "warning\n"}
+		a, execURL := newFakeKubernetesAgent(t, corev1.PodRunning, stream)
+
+		output, err := a.Execute(context.Background(), "do something")
+		require.NoError(t, err)
+		assert.Equal(t, "hello\nwarning\n", output)
+		assert.Equal(t, "do something", stream.stdin)
+
+		assert.Equal(t, "/api/v1/namespaces/kommon-test/pods/kommon-agent-session-1/exec", execURL.Path)
+		query := execURL.Query()
+		assert.Equal(t, agentContainerName, query.Get("container"))
+		assert.Equal(t, agentCommand("session-1", "owner/repo", agent.ExecuteOptions{}), query["command"])
+		assert.Equal(t, "true", query.Get("stdin"))
+	})
+
+	t.Run("NonZeroExit", func(t *testing.T) {
+		stream := &fakeStreamExecutor{
+			stderr: "boom\n",
+			err:    utilexec.CodeExitError{Err: fmt.Errorf("command terminated"), Code: 2},
+		}
+		a, _ := newFakeKubernetesAgent(t, corev1.PodRunning, stream)
+
+		output, err := a.Execute(context.Background(), "fail")
+		require.Error(t, err)
+		var exitErr *ExitError
+		require.ErrorAs(t, err, &exitErr)
+		assert.Equal(t, 2, exitErr.ExitCode)
+		assert.Equal(t, "boom\n", output)
+	})
+
+	t.Run("PodFailed", func(t *testing.T) {
+		a, _ := newFakeKubernetesAgent(t, corev1.PodFailed, &fakeStreamExecutor{})
+
+		_, err := a.Execute(context.Background(), "prompt")
+		assert.Error(t, err)
+	})
+
+	t.Run("CancelRunning", func(t *testing.T) {
+		a, execURL := newFakeKubernetesAgent(t, corev1.PodRunning, &fakeStreamExecutor{hang: true})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := a.Execute(ctx, "never finishes")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The command in the container is stopped with a second exec
+		query := execURL.Query()
+		assert.Equal(t, cancelCommand("session-1"), query["command"])
+		assert.Empty(t, query.Get("stdin"))
+	})
+
+	t.Run("ContextCanceled", func(t *testing.T) {
+		a, _ := newFakeKubernetesAgent(t, corev1.PodPending, &fakeStreamExecutor{})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := a.Execute(ctx, "prompt")
+		assert.Error(t, err)
+	})
+}
+
+func TestKubernetesExecutorPodSpec(t *testing.T) {
+	opts := ExecutorOptions{
+		Type:      ExecutorTypeKubernetes,
+		Namespace: testNamespace,
+		Resources: &ResourceRequirements{
+			Image:       "ghcr.io/takutakahashi/kommon-goose-agent:latest",
+			CPULimit:    "1.0",
+			MemoryLimit: "1Gi",
+		},
+		Kubernetes: &KubernetesOptions{
+			ServiceAccountName: "kommon-agent",
+			NodeSelector:       map[string]string{"pool": "agents"},
+			Tolerations: []corev1.Toleration{
+				{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "agents", Effect: corev1.TaintEffectNoSchedule},
+			},
+			ImagePullSecrets: []string{"ghcr"},
+		},
+	}
+
+	resources, err := parseResourceRequirements(opts.Resources)
+	require.NoError(t, err)
+
+	client := fake.NewSimpleClientset()
+	executor := &KubernetesExecutor{
+		client:    client,
+		config:    &rest.Config{},
+		namespace: testNamespace,
+		options:   opts,
+		resources: resources,
+		agents:    make(map[string]bool),
+		adopted:   make(map[string]bool),
+	}
+
+	ctx := context.Background()
+	_, err = executor.CreateAgent(ctx, agent.GooseOptions{SessionID: "spec-test", APIKey: "test-key"})
+	require.NoError(t, err)
+
+	pod, err := client.CoreV1().Pods(testNamespace).Get(ctx, agentPodName("spec-test"), metav1.GetOptions{})
+	require.NoError(t, err)
+
+	container := pod.Spec.Containers[0]
+	assert.Equal(t, "ghcr.io/takutakahashi/kommon-goose-agent:latest", container.Image)
+	for _, env := range container.Env {
+		assert.NotEqual(t, "KOMMON_GITHUB_TOKEN", env.Name, "the token is given to every execution")
+	}
+	assert.Equal(t, "1", container.Resources.Limits.Cpu().String())
+	assert.Equal(t, "1Gi", container.Resources.Limits.Memory().String())
+	assert.Equal(t, "kommon-agent", pod.Spec.ServiceAccountName)
+	assert.Equal(t, map[string]string{"pool": "agents"}, pod.Spec.NodeSelector)
+	assert.Equal(t, opts.Kubernetes.Tolerations, pod.Spec.Tolerations)
+	assert.Equal(t, []corev1.LocalObjectReference{{Name: "ghcr"}}, pod.Spec.ImagePullSecrets)
+
+	t.Run("DefaultImage", func(t *testing.T) {
+		executor.options.Resources = nil
+		spec := executor.agentPodSpec(agent.GooseOptions{SessionID: "default"}, nil)
+		assert.Equal(t, DefaultAgentImage, spec.Containers[0].Image)
+	})
+}
+
+func TestKubernetesExecutorRediscovery(t *testing.T) {
+	ctx := context.Background()
+
+	agentPod := func(sessionID string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        agentPodName(sessionID),
+				Namespace:   testNamespace,
+				Labels:      agentLabels(sessionID),
+				Annotations: agentAnnotations(sessionID),
+			},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+
+	newExecutor := func(opts ExecutorOptions) (*KubernetesExecutor, *fake.Clientset) {
+		client := fake.NewSimpleClientset(
+			agentPod("owner/repo-1", corev1.PodRunning),
+			agentPod("owner/repo-2", corev1.PodRunning),
+			agentPod("owner/repo-3", corev1.PodFailed),
+		)
+		return &KubernetesExecutor{
+			client:    client,
+			config:    &rest.Config{},
+			namespace: testNamespace,
+			options:   opts,
+			agents:    make(map[string]bool),
+			adopted:   make(map[string]bool),
+		}, client
+	}
+
+	t.Run("Adopt", func(t *testing.T) {
+		executor, client := newExecutor(ExecutorOptions{OrphanPolicy: OrphanPolicyAdopt})
+		require.NoError(t, executor.Initialize(ctx))
+
+		agents, err := executor.ListAgents(ctx)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{"owner/repo-1", "owner/repo-2"}, agents)
+
+		// Finished pods are removed
+		_, err = client.CoreV1().Pods(testNamespace).Get(ctx, agentPodName("owner/repo-3"), metav1.GetOptions{})
+		assert.Error(t, err)
+
+		// Rediscovered agents are reattached once
+		a, err := executor.CreateAgent(ctx, agent.GooseOptions{SessionID: "owner/repo-1", APIKey: "test-key"})
+		require.NoError(t, err)
+		assert.Equal(t, "owner/repo-1", a.(*KubernetesAgent).GetSessionID())
+		_, err = executor.CreateAgent(ctx, agent.GooseOptions{SessionID: "owner/repo-1", APIKey: "test-key"})
+		assert.Error(t, err)
+
+		// The token of the pod would have expired, so the execution brings its own
+		stream := &fakeStreamExecutor{stdout: "done\n"}
+		reattached := a.(*KubernetesAgent)
+		reattached.config = &rest.Config{Host: "https://kubernetes.example.com"}
+		reattached.newExecutor = func(config *rest.Config, method string, u *url.URL) (remotecommand.Executor, error) {
+			return stream, nil
+		}
+		tokenCtx := agent.WithExecuteOptions(ctx, agent.ExecuteOptions{GitHubToken: "ghs_fresh"})
+		_, err = reattached.Execute(tokenCtx, "prompt")
+		require.NoError(t, err)
+		assert.Equal(t, "ghs_fresh\nprompt", stream.stdin)
+
+		require.NoError(t, executor.DestroyAgent(ctx, "owner/repo-2"))
+		_, err = client.CoreV1().Pods(testNamespace).Get(ctx, agentPodName("owner/repo-2"), metav1.GetOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("DeleteUnknown", func(t *testing.T) {
+		executor, client := newExecutor(ExecutorOptions{
+			OrphanPolicy: OrphanPolicyDelete,
+			IsKnownSession: func(sessionID string) bool {
+				return sessionID == "owner/repo-1"
+			},
+		})
+		require.NoError(t, executor.Initialize(ctx))
+
+		agents, err := executor.ListAgents(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"owner/repo-1"}, agents)
+
+		pods, err := client.CoreV1().Pods(testNamespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Len(t, pods.Items, 1)
+		assert.Equal(t, agentPodName("owner/repo-1"), pods.Items[0].Name)
+	})
+}
@@ -0,0 +1,157 @@
+package progress
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(83 * time.Second)
+
+	tests := []struct {
+		name     string
+		state    State
+		contains []string
+	}{
+		{
+			name:     "Queued",
+			state:    State{Phase: PhaseQueued, Position: 3},
+			contains: []string{"待ち順: 3 番目"},
+		},
+		{
+			name:     "Cloning",
+			state:    State{Phase: PhaseCloning, StartedAt: start},
+			contains: []string{"リポジトリを準備しています", "1m23s"},
+		},
+		{
+			name:     "Running",
+			state:    State{Phase: PhaseRunning, StartedAt: start, Lines: []string{"first", "second"}},
+			contains: []string{"実行中です", "1m23s", "```\nfirst\nsecond\n```"},
+		},
+		{
+			name:     "Completed",
+			state:    State{Phase: PhaseCompleted, StartedAt: start, FinishedAt: now, Output: "result\n"},
+			contains: []string{"実行が完了しました", "1m23s", "```\nresult\n```"},
+		},
+		{
+			name:     "Failed",
+			state:    State{Phase: PhaseFailed, StartedAt: start, FinishedAt: now, Err: errors.New("exit status 1")},
+			contains: []string{"エラーが発生しました: exit status 1"},
+		},
+		{
+			name:     "Canceled",
+			state:    State{Phase: PhaseCanceled, StartedAt: start, FinishedAt: now},
+			contains: []string{"キャンセルされました", "1m23s"},
+		},
+		{
+			name:     "LimitExceeded",
+			state:    State{Phase: PhaseLimitExceeded, StartedAt: start, FinishedAt: now, Err: errors.New("timed out after 15m"), Output: "partial\n"},
+			contains: []string{"実行を停止しました: timed out after 15m", "1m23s", "```\npartial\n```"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := Render(tt.state, now)
+			for _, s := range tt.contains {
+				assert.Contains(t, body, s)
+			}
+		})
+	}
+}
+
+func TestRenderEscapesFences(t *testing.T) {
+	body := Render(State{Phase: PhaseCompleted, Output: "```go\ncode\n```"}, time.Now())
+	assert.Contains(t, body, "````\n```go\ncode\n```\n````")
+}
+
+func TestRenderTruncatesOutput(t *testing.T) {
+	output := strings.Repeat("あ", maxBodySize) + "tail"
+	body := Render(State{Phase: PhaseCompleted, Output: output}, time.Now())
+
+	assert.Less(t, len(body), maxBodySize+200)
+	assert.Contains(t, body, "省略")
+	assert.Contains(t, body, "tail")
+	assert.True(t, strings.ToValidUTF8(body, "") == body, "multi-byte characters are kept whole")
+}
+
+type recordedUpdate struct {
+	body string
+	at   time.Time
+}
+
+type updateRecorder struct {
+	mutex   sync.Mutex
+	updates []recordedUpdate
+}
+
+func (u *updateRecorder) update(ctx context.Context, body string) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.updates = append(u.updates, recordedUpdate{body: body, at: time.Now()})
+	return nil
+}
+
+func (u *updateRecorder) recorded() []recordedUpdate {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return append([]recordedUpdate(nil), u.updates...)
+}
+
+func TestReporterThrottlesUpdates(t *testing.T) {
+	interval := 50 * time.Millisecond
+	u := &updateRecorder{}
+	r := NewReporter(u.update, Options{Interval: interval, Lines: 3})
+
+	r.SetPhase(PhaseCloning)
+	r.SetPhase(PhaseRunning)
+	for i := 0; i < 100; i++ {
+		r.AddLine(fmt.Sprintf("line %d", i))
+		time.Sleep(time.Millisecond)
+	}
+
+	state := r.State()
+	assert.Equal(t, PhaseRunning, state.Phase)
+	assert.Equal(t, []string{"line 97", "line 98", "line 99"}, state.Lines)
+
+	require.NoError(t, r.Finish(context.Background(), "result", nil))
+
+	updates := u.recorded()
+	require.NotEmpty(t, updates)
+	// Far fewer edits than lines, spaced by the interval
+	assert.Less(t, len(updates), 10)
+	for i := 1; i < len(updates)-1; i++ {
+		assert.GreaterOrEqual(t, updates[i].at.Sub(updates[i-1].at), interval-10*time.Millisecond)
+	}
+
+	last := updates[len(updates)-1]
+	assert.Contains(t, last.body, "実行が完了しました")
+	assert.Contains(t, last.body, "result")
+}
+
+func TestReporterKeepsQueuedCommentUntouched(t *testing.T) {
+	u := &updateRecorder{}
+	r := NewReporter(u.update, Options{Interval: 10 * time.Millisecond})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, u.recorded())
+
+	require.NoError(t, r.Finish(context.Background(), "", errors.New("canceled")))
+	updates := u.recorded()
+	require.Len(t, updates, 1)
+	assert.Contains(t, updates[0].body, "canceled")
+}
+
+func TestCodeBlock(t *testing.T) {
+	assert.Equal(t, "```\nok\n```", CodeBlock("", "ok\n"))
+	assert.Equal(t, "````diff\n```go\n````", CodeBlock("diff", "```go"))
+}
@@ -0,0 +1,122 @@
+package progress
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phase represents how far an execution has progressed
+type Phase string
+
+const (
+	PhaseQueued    Phase = "queued"
+	PhaseCloning   Phase = "cloning"
+	PhaseRunning   Phase = "running"
+	PhaseCompleted Phase = "completed"
+	PhaseFailed    Phase = "failed"
+	PhaseCanceled  Phase = "canceled"
+
+	// PhaseLimitExceeded is an execution stopped by one of its limits
+	PhaseLimitExceeded Phase = "limit_exceeded"
+)
+
+// maxBodySize keeps comments below the GitHub limit of 65536 characters
+const maxBodySize = 60000
+
+// State is the information shown in a status comment
+type State struct {
+	Phase      Phase
+	Position   int      // Queue position while queued, 0 when unknown
+	Lines      []string // Latest output lines while running
+	Output     string   // Whole output once finished
+	Err        error    // Why the execution failed
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Final reports whether the execution is over
+func (s State) Final() bool {
+	return s.Phase == PhaseCompleted || s.Phase == PhaseFailed || s.Phase == PhaseCanceled || s.Phase == PhaseLimitExceeded
+}
+
+// Render returns the markdown body of the status comment
+func Render(s State, now time.Time) string {
+	switch s.Phase {
+	case PhaseQueued:
+		if s.Position > 0 {
+			return fmt.Sprintf("⏳ キューに追加しました。待ち順: %d 番目", s.Position)
+		}
+		return "⏳ キューに追加しました。"
+	case PhaseCloning:
+		return fmt.Sprintf("📥 リポジトリを準備しています...（経過時間 %s）", elapsed(s.StartedAt, now))
+	case PhaseRunning:
+		body := fmt.Sprintf("🏃 実行中です。少々お待ちください...（経過時間 %s）", elapsed(s.StartedAt, now))
+		if len(s.Lines) > 0 {
+			body += "\n\n" + CodeBlock("", strings.Join(s.Lines, "\n"))
+		}
+		return body
+	case PhaseCompleted:
+		return fmt.Sprintf("✅ 実行が完了しました（所要時間 %s）:\n%s",
+			elapsed(s.StartedAt, s.FinishedAt), CodeBlock("", Truncate(s.Output, maxBodySize)))
+	case PhaseFailed:
+		body := fmt.Sprintf("❌ コマンドの実行中にエラーが発生しました: %v（所要時間 %s）", s.Err, elapsed(s.StartedAt, s.FinishedAt))
+		if s.Output != "" {
+			body += "\n\n" + CodeBlock("", Truncate(s.Output, maxBodySize))
+		}
+		return body
+	case PhaseCanceled:
+		return fmt.Sprintf("🛑 実行はキャンセルされました（所要時間 %s）", elapsed(s.StartedAt, s.FinishedAt))
+	case PhaseLimitExceeded:
+		body := fmt.Sprintf("⏱️ 上限に達したため実行を停止しました: %v（所要時間 %s）", s.Err, elapsed(s.StartedAt, s.FinishedAt))
+		if s.Output != "" {
+			body += "\n\n" + CodeBlock("", Truncate(s.Output, maxBodySize))
+		}
+		return body
+	default:
+		return string(s.Phase)
+	}
+}
+
+func elapsed(from, to time.Time) time.Duration {
+	if from.IsZero() || to.Before(from) {
+		return 0
+	}
+	return to.Sub(from).Round(time.Second)
+}
+
+// TruncatedMarker starts the output cut by Truncate
+const TruncatedMarker = "...(省略)...\n"
+
+// Truncate keeps at most size bytes from the end of the output, which
+// usually has the result
+func Truncate(output string, size int) string {
+	output = strings.TrimRight(output, "\n")
+	if len(output) <= size {
+		return output
+	}
+
+	cut := len(output) - size
+	// Don't split a multi-byte character
+	for cut < len(output) && output[cut]&0xC0 == 0x80 {
+		cut++
+	}
+	return TruncatedMarker + output[cut:]
+}
+
+// CodeBlock fences the text with more backticks than it contains in a row,
+// so that fences in the text don't end the block. The language may be empty.
+func CodeBlock(lang, text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + lang + "\n" + strings.TrimRight(text, "\n") + "\n" + fence
+}
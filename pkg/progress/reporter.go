@@ -0,0 +1,175 @@
+package progress
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultLines    = 20
+)
+
+// UpdateFunc replaces the body of the status comment
+type UpdateFunc func(ctx context.Context, body string) error
+
+// Options contains configuration options for creating a new reporter
+type Options struct {
+	Interval time.Duration // Minimum time between two edits
+	Lines    int           // Number of output lines shown while running
+}
+
+// Reporter keeps a status comment up to date during an execution. Changes
+// are sent at most once per interval; the elapsed time is refreshed on every
+// interval while the execution runs.
+type Reporter struct {
+	update   UpdateFunc
+	interval time.Duration
+	lines    int
+	now      func() time.Time
+
+	state State
+	dirty bool
+	mutex sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewReporter creates a new reporter and starts sending updates
+func NewReporter(update UpdateFunc, opts Options) *Reporter {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Lines <= 0 {
+		opts.Lines = DefaultLines
+	}
+
+	r := &Reporter{
+		update:   update,
+		interval: opts.Interval,
+		lines:    opts.Lines,
+		now:      time.Now,
+		state:    State{Phase: PhaseQueued},
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	r.state.StartedAt = r.now()
+
+	go r.loop()
+	return r
+}
+
+// SetPhase moves the execution to the phase
+func (r *Reporter) SetPhase(phase Phase) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.state.Phase == PhaseQueued && phase != PhaseQueued {
+		// The elapsed time counts from the start of the execution
+		r.state.StartedAt = r.now()
+	}
+	r.state.Phase = phase
+	r.dirty = true
+}
+
+// AddLine records a line of output, keeping only the latest ones
+func (r *Reporter) AddLine(line string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.state.Lines = append(r.state.Lines, line)
+	if len(r.state.Lines) > r.lines {
+		r.state.Lines = append([]string(nil), r.state.Lines[len(r.state.Lines)-r.lines:]...)
+	}
+	r.dirty = true
+}
+
+// Finish stops the periodic updates and sends the final state right away
+func (r *Reporter) Finish(ctx context.Context, output string, err error) error {
+	phase := PhaseCompleted
+	if err != nil {
+		phase = PhaseFailed
+	}
+	return r.finish(ctx, phase, output, err)
+}
+
+// Cancel stops the periodic updates and reports the execution as canceled
+func (r *Reporter) Cancel(ctx context.Context, output string) error {
+	return r.finish(ctx, PhaseCanceled, output, nil)
+}
+
+// LimitExceeded stops the periodic updates and reports the execution as
+// stopped by one of its limits
+func (r *Reporter) LimitExceeded(ctx context.Context, output string, limitErr error) error {
+	return r.finish(ctx, PhaseLimitExceeded, output, limitErr)
+}
+
+func (r *Reporter) finish(ctx context.Context, phase Phase, output string, err error) error {
+	close(r.stop)
+	<-r.done
+
+	r.mutex.Lock()
+	r.state.Phase = phase
+	r.state.FinishedAt = r.now()
+	r.state.Output = output
+	r.state.Err = err
+	body := Render(r.state, r.state.FinishedAt)
+	r.mutex.Unlock()
+
+	return r.update(ctx, body)
+}
+
+// Stop stops the periodic updates without sending the final state, e.g.
+// when the execution is interrupted and will be retried
+func (r *Reporter) Stop() {
+	close(r.stop)
+	<-r.done
+}
+
+// State returns a copy of the current state
+func (r *Reporter) State() State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	s := r.state
+	s.Lines = append([]string(nil), r.state.Lines...)
+	return s
+}
+
+func (r *Reporter) loop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// flush sends the state when it changed or the elapsed time needs a refresh
+func (r *Reporter) flush() {
+	r.mutex.Lock()
+	if !r.dirty && r.state.Phase == PhaseQueued {
+		r.mutex.Unlock()
+		return
+	}
+	r.dirty = false
+	body := Render(r.state, r.now())
+	r.mutex.Unlock()
+
+	// Don't let a slow edit outlive the interval
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	if err := r.update(ctx, body); err != nil {
+		log.Printf("Failed to update status comment: %v", err)
+	}
+}
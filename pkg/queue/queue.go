@@ -0,0 +1,492 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Status represents the state of a job
+type Status string
+
+const (
+	StatusPending Status = "pending"
+	StatusRunning Status = "running"
+)
+
+const (
+	defaultMaxConcurrency = 2
+	defaultMaxPerRepo     = 1
+	defaultMaxAttempts    = 3
+)
+
+var (
+	ErrNotFound = errors.New("job not found")
+	// ErrCanceled is the cause of the handler context of a canceled job
+	ErrCanceled = errors.New("job canceled")
+)
+
+// Job is a unit of work executed by the queue handler
+type Job struct {
+	ID              string    `json:"id"`
+	SessionKey      string    `json:"session_key"` // Jobs of the same session run one at a time, in order
+	Repo            string    `json:"repo"`        // Repository full name (owner/name)
+	Issue           int       `json:"issue"`
+	InstallationID  int64     `json:"installation_id"`
+	CommentID       int64     `json:"comment_id,omitempty"`        // Comment that requested the job
+	StatusCommentID int64     `json:"status_comment_id,omitempty"` // Comment edited with the progress of the job
+	ReviewThreadID  int64     `json:"review_thread_id,omitempty"`  // First comment of the review thread the status is posted in, if any
+	CheckRunID      int64     `json:"check_run_id,omitempty"`      // Check run reporting the job on a pull request
+	Sender          string    `json:"sender,omitempty"`
+	Command         string    `json:"command,omitempty"` // Subcommand that requested the job, e.g. run or review
+	Prompt          string    `json:"prompt"`
+	Model           string    `json:"model,omitempty"`  // Model requested with --model
+	Branch          string    `json:"branch,omitempty"` // Branch requested with --branch
+	EnqueuedAt      time.Time `json:"enqueued_at"`
+	Status          Status    `json:"status"`
+	Attempts        int       `json:"attempts"` // Number of times the job was started
+}
+
+// Handler executes a job. The context is canceled when the queue stops.
+type Handler func(ctx context.Context, job *Job) error
+
+// Options contains configuration options for creating a new queue
+type Options struct {
+	MaxConcurrency int    `json:"max_concurrency,omitempty"` // Jobs running at the same time
+	MaxPerRepo     int    `json:"max_per_repo,omitempty"`    // Jobs running at the same time per repository
+	MaxAttempts    int    `json:"max_attempts,omitempty"`    // Starts allowed before a job interrupted by restarts is dropped
+	Path           string `json:"path,omitempty"`            // File persisting the jobs, memory only when empty
+	MergePending   bool   `json:"merge_pending,omitempty"`   // Append prompts to the pending job of the session instead of queueing another one
+}
+
+// Queue runs jobs with global and per-repository concurrency limits and
+// persists the jobs that are not finished yet
+type Queue struct {
+	options Options
+	handler Handler
+
+	jobs    []*Job // pending and running jobs in FIFO order
+	running map[string]int
+	cancels map[string]context.CancelCauseFunc // keyed by ID of running jobs
+	mutex   sync.Mutex
+
+	wake    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	started bool
+}
+
+// New creates a new queue and loads the jobs left by a previous process.
+// Jobs that were running are started again once Start is called.
+func New(opts Options, handler Handler) (*Queue, error) {
+	if opts.MaxConcurrency <= 0 {
+		opts.MaxConcurrency = defaultMaxConcurrency
+	}
+	if opts.MaxPerRepo <= 0 {
+		opts.MaxPerRepo = defaultMaxPerRepo
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		options: opts,
+		handler: handler,
+		running: make(map[string]int),
+		cancels: make(map[string]context.CancelCauseFunc),
+		wake:    make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	if err := q.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Start starts dispatching jobs
+func (q *Queue) Start() {
+	q.mutex.Lock()
+	if q.started {
+		q.mutex.Unlock()
+		return
+	}
+	q.started = true
+	q.mutex.Unlock()
+
+	q.wg.Add(1)
+	go q.dispatchLoop()
+	q.notify()
+}
+
+// Stop stops dispatching, cancels the running jobs and waits for them to
+// return. Unfinished jobs stay persisted and resume on the next start.
+func (q *Queue) Stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Enqueue adds the job to the end of the queue. When MergePending is set
+// and the session already has a pending job with the same command, model,
+// branch and review thread, the prompt is appended to that job instead, job.ID is set to
+// its ID and merged is true.
+func (q *Queue) Enqueue(job *Job) (merged bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending, err := q.merge(job)
+	if err != nil || pending != nil {
+		return pending != nil, err
+	}
+	return false, q.add(job)
+}
+
+// Merge appends the prompt of the job to the pending job of the session like
+// Enqueue, but never adds the job. It returns a copy of the pending job, or
+// nil when the job can't be merged and should be added with Add.
+func (q *Queue) Merge(job *Job) (*Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	pending, err := q.merge(job)
+	if pending == nil || err != nil {
+		return nil, err
+	}
+	pendingCopy := *pending
+	return &pendingCopy, nil
+}
+
+// Add adds the job to the end of the queue without merging it
+func (q *Queue) Add(job *Job) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.add(job)
+}
+
+// merge appends the prompt of the job to the matching pending job and
+// returns it, or nil. The caller must hold the lock.
+func (q *Queue) merge(job *Job) (*Job, error) {
+	if !q.options.MergePending {
+		return nil, nil
+	}
+	pending := q.lastPending(job.SessionKey)
+	if pending == nil || pending.Command != job.Command || pending.Model != job.Model || pending.Branch != job.Branch || pending.ReviewThreadID != job.ReviewThreadID {
+		return nil, nil
+	}
+
+	prompt := pending.Prompt
+	pending.Prompt = prompt + "\n\n" + job.Prompt
+	if err := q.save(); err != nil {
+		pending.Prompt = prompt
+		return nil, err
+	}
+	job.ID = pending.ID
+	return pending, nil
+}
+
+// add appends the job. The caller must hold the lock.
+func (q *Queue) add(job *Job) error {
+	if job.ID == "" {
+		id, err := NewJobID()
+		if err != nil {
+			return err
+		}
+		job.ID = id
+	}
+	if job.EnqueuedAt.IsZero() {
+		job.EnqueuedAt = time.Now()
+	}
+	job.Status = StatusPending
+
+	q.jobs = append(q.jobs, job)
+	if err := q.save(); err != nil {
+		q.jobs = q.jobs[:len(q.jobs)-1]
+		return err
+	}
+
+	q.notify()
+	return nil
+}
+
+// Cancel cancels the job. A pending job is removed from the queue right away
+// and never handled. A running job has its context canceled with ErrCanceled
+// as cause and is removed once the handler returns. It returns a copy of the
+// job or ErrNotFound.
+func (q *Queue) Cancel(id string) (*Job, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, job := range q.jobs {
+		if job.ID != id {
+			continue
+		}
+
+		jobCopy := *job
+		if job.Status == StatusRunning {
+			q.cancels[job.ID](ErrCanceled)
+			return &jobCopy, nil
+		}
+
+		q.remove(job)
+		if err := q.save(); err != nil {
+			return nil, err
+		}
+		q.notify()
+		return &jobCopy, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Position returns the 1-based position of the job among the jobs that
+// have not started yet. It returns 0 when the job is running or finished.
+func (q *Queue) Position(id string) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	position := 0
+	for _, job := range q.jobs {
+		if job.Status != StatusPending {
+			continue
+		}
+		position++
+		if job.ID == id {
+			return position
+		}
+	}
+	return 0
+}
+
+// lastPending returns the last job of the session that has not started yet.
+// The caller must hold the lock.
+func (q *Queue) lastPending(sessionKey string) *Job {
+	for i := len(q.jobs) - 1; i >= 0; i-- {
+		job := q.jobs[i]
+		if job.SessionKey != sessionKey {
+			continue
+		}
+		if job.Status == StatusPending {
+			return job
+		}
+		return nil
+	}
+	return nil
+}
+
+// Jobs returns a copy of the pending and running jobs in queue order
+func (q *Queue) Jobs() []Job {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) dispatchLoop() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-q.wake:
+			q.dispatch()
+		}
+	}
+}
+
+// dispatch starts every pending job allowed by the concurrency limits
+func (q *Queue) dispatch() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.ctx.Err() != nil {
+		return
+	}
+
+	total := 0
+	busySessions := make(map[string]bool)
+	for _, job := range q.jobs {
+		if job.Status == StatusRunning {
+			total++
+			busySessions[job.SessionKey] = true
+		}
+	}
+
+	var dropped []*Job
+	for _, job := range q.jobs {
+		if total >= q.options.MaxConcurrency {
+			break
+		}
+		if job.Status != StatusPending {
+			continue
+		}
+		// Later jobs of a session wait for the earlier ones
+		if busySessions[job.SessionKey] {
+			continue
+		}
+		busySessions[job.SessionKey] = true
+
+		if q.running[job.Repo] >= q.options.MaxPerRepo {
+			continue
+		}
+
+		if job.Attempts >= q.options.MaxAttempts {
+			log.Printf("Dropping job %s after %d interrupted attempts", job.ID, job.Attempts)
+			dropped = append(dropped, job)
+			continue
+		}
+
+		job.Status = StatusRunning
+		job.Attempts++
+		q.running[job.Repo]++
+		total++
+
+		ctx, cancel := context.WithCancelCause(q.ctx)
+		q.cancels[job.ID] = cancel
+
+		q.wg.Add(1)
+		go q.run(ctx, job)
+	}
+
+	for _, job := range dropped {
+		q.remove(job)
+	}
+	if err := q.save(); err != nil {
+		log.Printf("Failed to save queue: %v", err)
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job *Job) {
+	defer q.wg.Done()
+
+	jobCopy := *job
+	if err := q.handler(ctx, &jobCopy); err != nil {
+		log.Printf("Job %s failed: %v", job.ID, err)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.cancels[job.ID](nil)
+	delete(q.cancels, job.ID)
+
+	q.running[job.Repo]--
+	if q.running[job.Repo] <= 0 {
+		delete(q.running, job.Repo)
+	}
+
+	// Keep interrupted jobs so they resume after a restart
+	if q.ctx.Err() != nil {
+		return
+	}
+
+	q.remove(job)
+	if err := q.save(); err != nil {
+		log.Printf("Failed to save queue: %v", err)
+	}
+	q.notify()
+}
+
+// remove deletes the job from the queue. The caller must hold the lock.
+func (q *Queue) remove(job *Job) {
+	for i, j := range q.jobs {
+		if j == job {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return
+		}
+	}
+}
+
+// load reads the persisted jobs. The caller must hold the lock or own the queue.
+func (q *Queue) load() error {
+	if q.options.Path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(q.options.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read queue file: %w", err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := json.Unmarshal(data, &q.jobs); err != nil {
+		return fmt.Errorf("failed to parse queue file %s: %w", q.options.Path, err)
+	}
+	for _, job := range q.jobs {
+		job.Status = StatusPending
+	}
+	return nil
+}
+
+// save persists the jobs. The caller must hold the lock.
+func (q *Queue) save() error {
+	if q.options.Path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(q.jobs, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode queue: %w", err)
+	}
+
+	dir := filepath.Dir(q.options.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+
+	// Replace the file atomically so a crash never leaves it half written
+	tmp, err := os.CreateTemp(dir, filepath.Base(q.options.Path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp queue file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write queue file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close queue file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), q.options.Path); err != nil {
+		return fmt.Errorf("failed to replace queue file: %w", err)
+	}
+	return nil
+}
+
+// NewJobID returns a random job ID. Jobs get one when they are enqueued
+// without an ID.
+func NewJobID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
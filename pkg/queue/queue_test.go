@@ -0,0 +1,357 @@
+package queue
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder is a handler that blocks every job until it is released
+type recorder struct {
+	mutex    sync.Mutex
+	started  []string
+	running  map[string]string // prompt -> repo
+	maxTotal int
+	maxRepo  map[string]int
+	release  chan struct{}
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		running: make(map[string]string),
+		maxRepo: make(map[string]int),
+		release: make(chan struct{}),
+	}
+}
+
+func (r *recorder) handle(ctx context.Context, job *Job) error {
+	r.mutex.Lock()
+	r.started = append(r.started, job.Prompt)
+	r.running[job.Prompt] = job.Repo
+	if len(r.running) > r.maxTotal {
+		r.maxTotal = len(r.running)
+	}
+	perRepo := 0
+	for _, repo := range r.running {
+		if repo == job.Repo {
+			perRepo++
+		}
+	}
+	if perRepo > r.maxRepo[job.Repo] {
+		r.maxRepo[job.Repo] = perRepo
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+	}
+
+	r.mutex.Lock()
+	delete(r.running, job.Prompt)
+	r.mutex.Unlock()
+	return ctx.Err()
+}
+
+func (r *recorder) startedJobs() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.started...)
+}
+
+func waitForQueue(t *testing.T, q *Queue, remaining int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return len(q.Jobs()) == remaining
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func requireEnqueue(t *testing.T, q *Queue, job *Job) {
+	t.Helper()
+	merged, err := q.Enqueue(job)
+	require.NoError(t, err)
+	require.False(t, merged)
+}
+
+func TestQueueConcurrencyLimits(t *testing.T) {
+	r := newRecorder()
+	q, err := New(Options{MaxConcurrency: 2, MaxPerRepo: 1}, r.handle)
+	require.NoError(t, err)
+
+	jobs := []*Job{
+		{SessionKey: "a#1", Repo: "a/repo", Prompt: "a1"},
+		{SessionKey: "a#2", Repo: "a/repo", Prompt: "a2"},
+		{SessionKey: "b#1", Repo: "b/repo", Prompt: "b1"},
+		{SessionKey: "c#1", Repo: "c/repo", Prompt: "c1"},
+	}
+	for _, job := range jobs {
+		requireEnqueue(t, q, job)
+		assert.NotEmpty(t, job.ID)
+	}
+	q.Start()
+	defer q.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(r.startedJobs()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []string{"a1", "b1"}, r.startedJobs())
+
+	for range jobs {
+		r.release <- struct{}{}
+	}
+	waitForQueue(t, q, 0)
+
+	assert.ElementsMatch(t, []string{"a1", "a2", "b1", "c1"}, r.startedJobs())
+	assert.LessOrEqual(t, r.maxTotal, 2)
+	for repo, max := range r.maxRepo {
+		assert.LessOrEqual(t, max, 1, "repo %s", repo)
+	}
+}
+
+func TestQueueSessionOrder(t *testing.T) {
+	var mutex sync.Mutex
+	var order []string
+	active := 0
+	maxActive := 0
+
+	q, err := New(Options{MaxConcurrency: 4, MaxPerRepo: 4}, func(ctx context.Context, job *Job) error {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		order = append(order, job.Prompt)
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, prompt := range []string{"first", "second", "third"} {
+		requireEnqueue(t, q, &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: prompt})
+	}
+	q.Start()
+	defer q.Stop()
+
+	waitForQueue(t, q, 0)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"first", "second", "third"}, order)
+	assert.Equal(t, 1, maxActive)
+}
+
+func TestQueueResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	r := newRecorder()
+	q, err := New(Options{Path: path}, r.handle)
+	require.NoError(t, err)
+	q.Start()
+
+	requireEnqueue(t, q, &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Issue: 1, Prompt: "o1"})
+	requireEnqueue(t, q, &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Issue: 1, Prompt: "o2"})
+	require.Eventually(t, func() bool {
+		return len(r.startedJobs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Simulate a restart while the first job is running
+	q.Stop()
+
+	var resumed []Job
+	var mutex sync.Mutex
+	q, err = New(Options{Path: path}, func(ctx context.Context, job *Job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		resumed = append(resumed, *job)
+		return nil
+	})
+	require.NoError(t, err)
+
+	jobs := q.Jobs()
+	require.Len(t, jobs, 2)
+	assert.Equal(t, StatusPending, jobs[0].Status)
+	assert.Equal(t, 1, jobs[0].Attempts)
+
+	q.Start()
+	defer q.Stop()
+	waitForQueue(t, q, 0)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Len(t, resumed, 2)
+	assert.Equal(t, "o1", resumed[0].Prompt)
+	assert.Equal(t, 2, resumed[0].Attempts)
+	assert.Equal(t, "o2", resumed[1].Prompt)
+
+	// Finished jobs are removed from the file as well
+	q2, err := New(Options{Path: path}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, q2.Jobs())
+}
+
+func TestQueueDropsJobsAfterMaxAttempts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	q, err := New(Options{Path: path, MaxAttempts: 1}, nil)
+	require.NoError(t, err)
+	requireEnqueue(t, q, &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "crash", Attempts: 1})
+	requireEnqueue(t, q, &Job{SessionKey: "owner/repo#2", Repo: "owner/repo", Prompt: "ok"})
+
+	var handled []string
+	var mutex sync.Mutex
+	q, err = New(Options{Path: path, MaxAttempts: 1}, func(ctx context.Context, job *Job) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handled = append(handled, job.Prompt)
+		return nil
+	})
+	require.NoError(t, err)
+	q.Start()
+	defer q.Stop()
+
+	waitForQueue(t, q, 0)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"ok"}, handled)
+}
+
+func TestQueuePositionAndMerge(t *testing.T) {
+	r := newRecorder()
+	q, err := New(Options{MaxConcurrency: 1, MergePending: true}, r.handle)
+	require.NoError(t, err)
+
+	running := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "running"}
+	other := &Job{SessionKey: "owner/repo#2", Repo: "owner/repo", Prompt: "other"}
+	requireEnqueue(t, q, running)
+	requireEnqueue(t, q, other)
+	q.Start()
+	defer q.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(r.startedJobs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The running job is never merged into
+	first := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "first"}
+	requireEnqueue(t, q, first)
+	assert.Equal(t, 0, q.Position(running.ID))
+	assert.Equal(t, 1, q.Position(other.ID))
+	assert.Equal(t, 2, q.Position(first.ID))
+
+	second := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "second"}
+	merged, err := q.Enqueue(second)
+	require.NoError(t, err)
+	assert.True(t, merged)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Len(t, q.Jobs(), 3)
+	assert.Equal(t, "first\n\nsecond", q.Jobs()[2].Prompt)
+
+	// Requests for another model run on their own
+	third := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "third", Model: "openai/gpt-4o"}
+	merged, err = q.Enqueue(third)
+	require.NoError(t, err)
+	assert.False(t, merged)
+	assert.Equal(t, 3, q.Position(third.ID))
+
+	// So do requests replying in another review thread
+	fourth := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "fourth", Model: "openai/gpt-4o", ReviewThreadID: 7}
+	merged, err = q.Enqueue(fourth)
+	require.NoError(t, err)
+	assert.False(t, merged)
+	assert.Equal(t, 4, q.Position(fourth.ID))
+
+	for i := 0; i < 5; i++ {
+		r.release <- struct{}{}
+	}
+	waitForQueue(t, q, 0)
+	assert.Equal(t, 0, q.Position(first.ID))
+	assert.Equal(t, []string{"running", "other", "first\n\nsecond", "third", "fourth"}, r.startedJobs())
+}
+
+func TestQueueMerge(t *testing.T) {
+	r := newRecorder()
+	q, err := New(Options{MaxConcurrency: 1, MergePending: true}, r.handle)
+	require.NoError(t, err)
+
+	// Nothing to merge into, so the job is left to Add
+	first := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "first", StatusCommentID: 10}
+	pending, err := q.Merge(first)
+	require.NoError(t, err)
+	assert.Nil(t, pending)
+	assert.Empty(t, q.Jobs())
+	require.NoError(t, q.Add(first))
+
+	second := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "second"}
+	pending, err = q.Merge(second)
+	require.NoError(t, err)
+	require.NotNil(t, pending)
+	assert.Equal(t, first.ID, pending.ID)
+	assert.Equal(t, int64(10), pending.StatusCommentID)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, "first\n\nsecond", q.Jobs()[0].Prompt)
+
+	// Add never merges
+	third := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "third"}
+	require.NoError(t, q.Add(third))
+	assert.Len(t, q.Jobs(), 2)
+	assert.NotEqual(t, first.ID, third.ID)
+}
+
+func TestQueueCancel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.json")
+
+	var mutex sync.Mutex
+	var causes []error
+	started := make(chan struct{}, 1)
+	q, err := New(Options{MaxConcurrency: 1, Path: path}, func(ctx context.Context, job *Job) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		mutex.Lock()
+		causes = append(causes, context.Cause(ctx))
+		mutex.Unlock()
+		return ctx.Err()
+	})
+	require.NoError(t, err)
+
+	running := &Job{SessionKey: "owner/repo#1", Repo: "owner/repo", Prompt: "running"}
+	pending := &Job{SessionKey: "owner/repo#2", Repo: "owner/repo", Prompt: "pending"}
+	requireEnqueue(t, q, running)
+	requireEnqueue(t, q, pending)
+	q.Start()
+	defer q.Stop()
+	<-started
+
+	canceled, err := q.Cancel(pending.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusPending, canceled.Status)
+	assert.Len(t, q.Jobs(), 1)
+
+	canceled, err = q.Cancel(running.ID)
+	require.NoError(t, err)
+	assert.Equal(t, StatusRunning, canceled.Status)
+	waitForQueue(t, q, 0)
+
+	_, err = q.Cancel(running.ID)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []error{ErrCanceled}, causes, "the pending job never starts")
+
+	// Canceled jobs are not resumed
+	q2, err := New(Options{Path: path}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, q2.Jobs())
+}
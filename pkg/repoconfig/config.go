@@ -0,0 +1,255 @@
+package repoconfig
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"sigs.k8s.io/yaml"
+)
+
+// Path is where the configuration lives in the repository
+const Path = ".github/kommon.yaml"
+
+// DefaultLabel is the issue label that starts an execution when the
+// configuration sets none
+const DefaultLabel = "kommon:implement"
+
+// Schema is the JSON schema of the configuration file, for editors and
+// linters. Parse enforces the same rules, and the tests check both against
+// the same files.
+//
+//go:embed schema.json
+var Schema []byte
+
+// Event is a webhook event that can trigger kommon
+type Event string
+
+const (
+	EventIssueComment Event = "issue_comment"
+	// EventIssues starts an execution when an issue gets the label or is
+	// assigned to kommon
+	EventIssues Event = "issues"
+	// EventPullRequest reviews pull requests when they are opened or updated
+	EventPullRequest Event = "pull_request"
+	// EventPullRequestReviewComment handles mentions in inline review threads
+	EventPullRequestReviewComment Event = "pull_request_review_comment"
+	// EventPullRequestReview handles mentions in the body of a review
+	EventPullRequestReview Event = "pull_request_review"
+	// EventWorkflowRun and EventCheckSuite start a fix when the CI of a pull
+	// request opened by kommon fails
+	EventWorkflowRun Event = "workflow_run"
+	EventCheckSuite  Event = "check_suite"
+)
+
+// knownEvents are the events kommon handles
+var knownEvents = []Event{
+	EventIssueComment, EventIssues, EventPullRequest, EventPullRequestReviewComment, EventPullRequestReview,
+	EventWorkflowRun, EventCheckSuite,
+}
+
+// DefaultEvents trigger kommon when the configuration lists none
+var DefaultEvents = []Event{EventIssueComment, EventIssues, EventPullRequestReviewComment, EventPullRequestReview}
+
+// DefaultCIFixAttempts is the number of fixes of failed CI tried on a pull
+// request unless the configuration sets another
+const DefaultCIFixAttempts = 3
+
+// Config is the per-repository configuration of kommon. Every field is
+// optional; unset fields keep the server configuration.
+type Config struct {
+	Model         string   `json:"model,omitempty"`           // Model used unless a command sets --model
+	Provider      string   `json:"provider,omitempty"`        // goose provider, e.g. openrouter
+	Instructions  string   `json:"instructions,omitempty"`    // Added to every prompt, like goosehints
+	Setup         []string `json:"setup,omitempty"`           // Shell commands run in the workspace before each execution
+	Commands      []string `json:"commands,omitempty"`        // Allowed subcommands (default is all); help is always allowed
+	BaseBranch    string   `json:"base_branch,omitempty"`     // Branch new branches start from and pull requests target
+	Timeout       Duration `json:"timeout,omitempty"`         // Wall-clock limit of an execution, capped by the server limit
+	Events        []Event  `json:"events,omitempty"`          // Events that trigger kommon (default is DefaultEvents)
+	Label         string   `json:"label,omitempty"`           // Issue label that starts an execution (default is DefaultLabel)
+	CIFixAttempts *int     `json:"ci_fix_attempts,omitempty"` // Fixes of failed CI tried per pull request, at least 1 (default is DefaultCIFixAttempts)
+}
+
+// Duration is a time.Duration written like "15m" or "1h30m". It is only
+// used for timeout, which its errors name.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return errors.New("timeout: must be a duration like \"15m\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("timeout: invalid duration %q (use a value like \"15m\")", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ValidationError lists the problems of a configuration file
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", Path, strings.Join(e.Problems, "; "))
+}
+
+// Parse reads and validates a configuration file. Problems are returned as
+// a *ValidationError.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return cfg, nil
+	}
+
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, &ValidationError{Problems: []string{strings.TrimPrefix(err.Error(), "error converting YAML to JSON: ")}}
+	}
+	if bytes.Equal(bytes.TrimSpace(jsonData), []byte("null")) {
+		return cfg, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return nil, &ValidationError{Problems: []string{decodeProblem(err)}}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decodeProblem rewrites errors of encoding/json in terms of the file
+func decodeProblem(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &typeErr) && typeErr.Field == "":
+		return "the file must be a mapping"
+	case errors.As(err, &typeErr) && typeErr.Type.Kind() == reflect.Slice:
+		return fmt.Sprintf("%s: must be a list, not %s", typeErr.Field, typeErr.Value)
+	case errors.As(err, &typeErr) && typeErr.Type.Kind() == reflect.Int:
+		return fmt.Sprintf("%s: must be an integer, not %s", typeErr.Field, typeErr.Value)
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("%s: must be a string, not %s", typeErr.Field, typeErr.Value)
+	default:
+		return strings.TrimPrefix(err.Error(), "json: ")
+	}
+}
+
+// Validate checks the values of the configuration
+func (c *Config) Validate() error {
+	var problems []string
+
+	if err := (agent.ExecuteOptions{Model: c.Model, Provider: c.Provider, BaseBranch: c.BaseBranch}).Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for i, setup := range c.Setup {
+		if strings.TrimSpace(setup) == "" {
+			problems = append(problems, fmt.Sprintf("setup[%d]: command is empty", i))
+		}
+	}
+	for i, name := range c.Commands {
+		if !command.Name(name).Known() {
+			problems = append(problems, fmt.Sprintf("commands[%d]: unknown subcommand %q", i, name))
+		}
+	}
+	if c.Timeout < 0 {
+		problems = append(problems, "timeout: must not be negative")
+	}
+	if c.Label != "" && strings.TrimSpace(c.Label) == "" {
+		problems = append(problems, "label: must not be blank")
+	}
+	if c.CIFixAttempts != nil && *c.CIFixAttempts < 1 {
+		problems = append(problems, "ci_fix_attempts: must be at least 1 (leave out workflow_run and check_suite to turn fixes off)")
+	}
+	for i, event := range c.Events {
+		if !knownEvent(event) {
+			problems = append(problems, fmt.Sprintf("events[%d]: unknown event %q", i, event))
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func knownEvent(event Event) bool {
+	for _, known := range knownEvents {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Triggers reports whether the event triggers kommon
+func (c *Config) Triggers(event Event) bool {
+	events := c.Events
+	if events == nil {
+		events = DefaultEvents
+	}
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// TriggerLabel returns the issue label that starts an execution
+func (c *Config) TriggerLabel() string {
+	if c.Label == "" {
+		return DefaultLabel
+	}
+	return c.Label
+}
+
+// MaxCIFixAttempts returns the number of fixes of failed CI tried per pull
+// request
+func (c *Config) MaxCIFixAttempts() int {
+	if c.CIFixAttempts == nil {
+		return DefaultCIFixAttempts
+	}
+	return *c.CIFixAttempts
+}
+
+// Allows reports whether the subcommand may be used. Help is always allowed
+// so that users can find out what is.
+func (c *Config) Allows(name command.Name) bool {
+	if c.Commands == nil || name == command.NameHelp {
+		return true
+	}
+	for _, allowed := range c.Commands {
+		if strings.EqualFold(allowed, string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteOptions returns the execution options set by the configuration
+func (c *Config) ExecuteOptions() agent.ExecuteOptions {
+	return agent.ExecuteOptions{
+		Model:      c.Model,
+		Provider:   c.Provider,
+		BaseBranch: c.BaseBranch,
+		Setup:      c.Setup,
+		Limits:     agent.Limits{Timeout: time.Duration(c.Timeout)},
+	}
+}
@@ -0,0 +1,279 @@
+package repoconfig
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/takutakahashi/kommon/pkg/agent"
+	"github.com/takutakahashi/kommon/pkg/command"
+	"sigs.k8s.io/yaml"
+)
+
+// testConfig sets every field
+const testConfig = `
+model: anthropic/claude-3.5-sonnet
+provider: openrouter
+instructions: |
+  テストは make test で実行してください。
+setup:
+  - make deps
+commands: [run, review]
+base_branch: develop
+timeout: 15m
+events: [issue_comment]
+label: "ai: implement"
+ci_fix_attempts: 5
+`
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	require.NoError(t, err)
+	attempts := 5
+	assert.Equal(t, &Config{
+		Model:         "anthropic/claude-3.5-sonnet",
+		Provider:      "openrouter",
+		Instructions:  "テストは make test で実行してください。\n",
+		Setup:         []string{"make deps"},
+		Commands:      []string{"run", "review"},
+		BaseBranch:    "develop",
+		Timeout:       Duration(15 * time.Minute),
+		Events:        []Event{EventIssueComment},
+		Label:         "ai: implement",
+		CIFixAttempts: &attempts,
+	}, cfg)
+	assert.Equal(t, 5, cfg.MaxCIFixAttempts())
+	assert.Equal(t, DefaultCIFixAttempts, (&Config{}).MaxCIFixAttempts())
+	assert.Equal(t, "ai: implement", cfg.TriggerLabel())
+	assert.Equal(t, DefaultLabel, (&Config{}).TriggerLabel())
+
+	assert.Equal(t, agent.ExecuteOptions{
+		Model:      "anthropic/claude-3.5-sonnet",
+		Provider:   "openrouter",
+		BaseBranch: "develop",
+		Setup:      []string{"make deps"},
+		Limits:     agent.Limits{Timeout: 15 * time.Minute},
+	}, cfg.ExecuteOptions())
+}
+
+func TestParseEmpty(t *testing.T) {
+	for _, data := range []string{"", "\n", "# nothing yet\n"} {
+		cfg, err := Parse([]byte(data))
+		require.NoError(t, err, data)
+		assert.Equal(t, &Config{}, cfg)
+	}
+}
+
+// parseErrorTests are files Parse rejects
+var parseErrorTests = []struct {
+	name     string
+	data     string
+	problems []string
+}{
+	{name: "not a mapping", data: "- run", problems: []string{"the file must be a mapping"}},
+	{name: "invalid yaml", data: "model: [", problems: nil},
+	{name: "unknown field", data: "modle: gpt-4o", problems: []string{`unknown field "modle"`}},
+	{name: "wrong type", data: "setup: make deps", problems: []string{"setup: must be a list, not string"}},
+	{name: "wrong scalar type", data: "model: 4", problems: []string{"model: must be a string, not number"}},
+	{name: "wrong integer type", data: "ci_fix_attempts: many", problems: []string{"ci_fix_attempts: must be an integer, not string"}},
+	{name: "invalid timeout", data: "timeout: soon", problems: []string{`timeout: invalid duration "soon" (use a value like "15m")`}},
+	{name: "timeout without unit", data: "timeout: 15", problems: []string{`timeout: must be a duration like "15m"`}},
+	{
+		name: "invalid values",
+		data: "model: -x\ncommands: [run, deploy]\nevents: [push]\nsetup: ['  ']\ntimeout: -1m\nlabel: ' '\nci_fix_attempts: -1",
+		problems: []string{
+			`invalid model: "-x"`,
+			`setup[0]: command is empty`,
+			`commands[1]: unknown subcommand "deploy"`,
+			`timeout: must not be negative`,
+			`label: must not be blank`,
+			`ci_fix_attempts: must be at least 1 (leave out workflow_run and check_suite to turn fixes off)`,
+			`events[0]: unknown event "push"`,
+		},
+	},
+	{name: "invalid base branch", data: "base_branch: ../main", problems: []string{`invalid base branch: "../main"`}},
+	{name: "lock base branch", data: "base_branch: main.lock", problems: []string{`invalid base branch: "main.lock"`}},
+	{name: "no ci fix attempts", data: "ci_fix_attempts: 0", problems: []string{"ci_fix_attempts: must be at least 1 (leave out workflow_run and check_suite to turn fixes off)"}},
+	{name: "fractional ci fix attempts", data: "ci_fix_attempts: 1.5", problems: nil},
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tt := range parseErrorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			var validationErr *ValidationError
+			require.ErrorAs(t, err, &validationErr)
+			if tt.problems != nil {
+				assert.Equal(t, tt.problems, validationErr.Problems)
+			} else {
+				assert.Len(t, validationErr.Problems, 1)
+			}
+			assert.Contains(t, err.Error(), Path)
+		})
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	assert.True(t, (&Config{}).Triggers(EventIssueComment))
+	assert.True(t, (&Config{}).Triggers(EventIssues))
+	assert.False(t, (&Config{Events: []Event{}}).Triggers(EventIssueComment))
+	assert.True(t, (&Config{Events: []Event{EventIssueComment}}).Triggers(EventIssueComment))
+	assert.False(t, (&Config{}).Triggers(EventPullRequest), "reviews are opt-in")
+	assert.True(t, (&Config{Events: []Event{EventPullRequest}}).Triggers(EventPullRequest))
+	assert.True(t, (&Config{}).Triggers(EventPullRequestReviewComment))
+	assert.False(t, (&Config{Events: []Event{EventIssueComment}}).Triggers(EventPullRequestReview))
+	assert.False(t, (&Config{}).Triggers(EventWorkflowRun), "fixing CI is opt-in")
+	assert.False(t, (&Config{}).Triggers(EventCheckSuite), "fixing CI is opt-in")
+}
+
+func TestAllows(t *testing.T) {
+	assert.True(t, (&Config{}).Allows(command.NameRun))
+
+	cfg := &Config{Commands: []string{"Review", "status"}}
+	assert.True(t, cfg.Allows(command.NameReview))
+	assert.True(t, cfg.Allows(command.NameStatus))
+	assert.False(t, cfg.Allows(command.NameRun))
+	assert.True(t, cfg.Allows(command.NameHelp), "help is always allowed")
+}
+
+// The schema documents the same fields as Config
+func TestSchema(t *testing.T) {
+	var schema struct {
+		Properties map[string]struct {
+			Items struct {
+				Enum []string `json:"enum"`
+			} `json:"items"`
+		} `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(Schema, &schema))
+
+	var fields []string
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	var properties []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	sort.Strings(fields)
+	sort.Strings(properties)
+	assert.Equal(t, fields, properties)
+
+	for _, name := range schema.Properties["commands"].Items.Enum {
+		assert.True(t, command.Name(name).Known(), name)
+	}
+	var events []string
+	for _, event := range knownEvents {
+		events = append(events, string(event))
+	}
+	assert.ElementsMatch(t, events, schema.Properties["events"].Items.Enum)
+}
+
+// The schema accepts the files Parse accepts and rejects the files Parse
+// rejects
+func TestSchemaFixtures(t *testing.T) {
+	var schema jsonSchema
+	require.NoError(t, json.Unmarshal(Schema, &schema))
+
+	valid := []string{testConfig, "ci_fix_attempts: 1", "base_branch: release/v1.2", "timeout: 1h30m"}
+	for _, data := range valid {
+		_, err := Parse([]byte(data))
+		require.NoError(t, err, data)
+		assert.True(t, schema.validates(t, data), data)
+	}
+	for _, tt := range parseErrorTests {
+		if _, err := yaml.YAMLToJSON([]byte(tt.data)); err != nil {
+			continue // Not YAML, nothing to validate
+		}
+		assert.False(t, schema.validates(t, tt.data), tt.name)
+	}
+}
+
+// jsonSchema implements the keywords of JSON schema that schema.json uses
+type jsonSchema struct {
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []string               `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Not                  *jsonSchema            `json:"not"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+}
+
+func (s *jsonSchema) validates(t *testing.T, data string) bool {
+	jsonData, err := yaml.YAMLToJSON([]byte(data))
+	require.NoError(t, err)
+	var value any
+	require.NoError(t, json.Unmarshal(jsonData, &value))
+	return s.valid(value)
+}
+
+func (s *jsonSchema) valid(value any) bool {
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return false
+		}
+		for name, v := range object {
+			property, known := s.Properties[name]
+			if !known && s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return false
+			}
+			if known && !property.valid(v) {
+				return false
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return false
+		}
+		for _, v := range array {
+			if s.Items != nil && !s.Items.valid(v) {
+				return false
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return false
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return false
+		}
+	}
+
+	if s.Enum != nil {
+		str, _ := value.(string)
+		if !slices.Contains(s.Enum, str) {
+			return false
+		}
+	}
+	if str, ok := value.(string); ok && s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+		return false
+	}
+	if number, ok := value.(float64); ok && s.Minimum != nil && number < *s.Minimum {
+		return false
+	}
+	if s.Not != nil && s.Not.valid(value) {
+		return false
+	}
+	if s.AnyOf != nil && !slices.ContainsFunc(s.AnyOf, func(sub *jsonSchema) bool { return sub.valid(value) }) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package review
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+)
+
+// Side of a diff a review comment is anchored to
+const (
+	SideLeft  = "LEFT"  // Deleted and unchanged lines of the base
+	SideRight = "RIGHT" // Added and unchanged lines of the head
+)
+
+// Diff holds the lines of a unified diff that review comments can be
+// anchored to, per file and side
+type Diff struct {
+	files map[string]map[string]map[int]bool // path -> side -> line
+}
+
+// ParseDiff reads a unified diff as returned by GitHub for a pull request
+func ParseDiff(diff string) Diff {
+	d := Diff{files: make(map[string]map[string]map[int]bool)}
+
+	var path string
+	var oldLine, newLine int
+	inHunk := false
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			path, inHunk = "", false
+		case !inHunk && strings.HasPrefix(line, "--- "):
+			if p := diffPath(line[4:]); p != "" {
+				path = p
+			}
+		case !inHunk && strings.HasPrefix(line, "+++ "):
+			// The new path wins, except for deleted files
+			if p := diffPath(line[4:]); p != "" {
+				path = p
+			}
+		case strings.HasPrefix(line, "@@ "):
+			var ok bool
+			oldLine, newLine, ok = parseHunkHeader(line)
+			inHunk = ok && path != ""
+		case !inHunk:
+		case strings.HasPrefix(line, "+"):
+			d.add(path, SideRight, newLine)
+			newLine++
+		case strings.HasPrefix(line, "-"):
+			d.add(path, SideLeft, oldLine)
+			oldLine++
+		case strings.HasPrefix(line, " ") || line == "":
+			d.add(path, SideLeft, oldLine)
+			d.add(path, SideRight, newLine)
+			oldLine++
+			newLine++
+		}
+		// "\ No newline at end of file" changes nothing
+	}
+	return d
+}
+
+func (d Diff) add(path, side string, line int) {
+	sides, ok := d.files[path]
+	if !ok {
+		sides = map[string]map[int]bool{SideLeft: {}, SideRight: {}}
+		d.files[path] = sides
+	}
+	sides[side][line] = true
+}
+
+// Contains reports whether a comment can be anchored to the line
+func (d Diff) Contains(path, side string, line int) bool {
+	return d.files[path][side][line]
+}
+
+// Files returns the number of files in the diff
+func (d Diff) Files() int {
+	return len(d.files)
+}
+
+// diffPath returns the path of a ---/+++ line without its a/ or b/ prefix
+func diffPath(name string) string {
+	name = strings.TrimSuffix(name, "\t")
+	if name == "/dev/null" {
+		return ""
+	}
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		name = unquoted
+	}
+	if strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/") {
+		return name[2:]
+	}
+	return name
+}
+
+// parseHunkHeader reads the first lines of "@@ -l,s +l,s @@"
+func parseHunkHeader(line string) (int, int, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return 0, 0, false
+	}
+	oldStart, err := strconv.Atoi(strings.SplitN(fields[1][1:], ",", 2)[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	newStart, err := strconv.Atoi(strings.SplitN(fields[2][1:], ",", 2)[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	return oldStart, newStart, true
+}
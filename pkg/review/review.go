@@ -0,0 +1,98 @@
+package review
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/takutakahashi/kommon/pkg/progress"
+)
+
+// resultFence opens the block holding the result in the agent output
+const resultFence = "```kommon-review"
+
+// ErrNoResult is returned when the agent output holds no review
+var ErrNoResult = errors.New("review result not found in the agent output")
+
+// Comment is an inline review comment
+type Comment struct {
+	Path string `json:"path"`
+	Line int    `json:"line"`
+	Side string `json:"side,omitempty"` // SideRight unless set
+	Body string `json:"body"`
+}
+
+// Result is the review written by the agent
+type Result struct {
+	Summary  string    `json:"summary"`
+	Comments []Comment `json:"comments"`
+}
+
+// Prompt asks the agent to review the diff and to answer in the format read
+// by ParseOutput. Instructions are added at the end.
+func Prompt(diff, instructions string) string {
+	var b strings.Builder
+	b.WriteString(`このプルリクエストの変更をレビューしてください。
+バグ、セキュリティ上の問題、テスト不足、読みにくい箇所を指摘し、修正案があれば示してください。
+コードの変更やコミット、GitHub へのコメント投稿は行わないでください。レビューは kommon が投稿します。
+
+最後に、次の形式でレビュー結果を出力してください。line は差分の行番号で、side は追加行と変更のない行なら RIGHT、削除行なら LEFT です。
+指摘がない場合は comments を空にしてください。
+
+` + resultFence + `
+{"summary": "全体の所見", "comments": [{"path": "path/to/file.go", "line": 42, "side": "RIGHT", "body": "指摘と修正案"}]}
+` + "```" + `
+
+## 差分
+
+`)
+	b.WriteString(progress.CodeBlock("diff", diff))
+	if instructions = strings.TrimSpace(instructions); instructions != "" {
+		b.WriteString("\n\n## 追加の指示\n\n")
+		b.WriteString(instructions)
+	}
+	return b.String()
+}
+
+// ParseOutput reads the last review result in the agent output. The JSON
+// value is decoded up to its end rather than up to the closing fence, since
+// comment bodies may hold fences of their own, like suggestion blocks.
+func ParseOutput(output string) (*Result, error) {
+	start := strings.LastIndex(output, resultFence)
+	if start < 0 {
+		return nil, ErrNoResult
+	}
+
+	var result Result
+	decoder := json.NewDecoder(strings.NewReader(output[start+len(resultFence):]))
+	if err := decoder.Decode(&result); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w: the result is cut off", ErrNoResult)
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid review result: %w", err)
+	}
+	for i := range result.Comments {
+		if result.Comments[i].Side == "" {
+			result.Comments[i].Side = SideRight
+		}
+		result.Comments[i].Side = strings.ToUpper(result.Comments[i].Side)
+	}
+	return &result, nil
+}
+
+// Split separates the comments that can be anchored to the diff from the
+// others, which GitHub would reject
+func (r *Result) Split(diff Diff) (inline, other []Comment) {
+	for _, c := range r.Comments {
+		if strings.TrimSpace(c.Body) == "" {
+			continue
+		}
+		if diff.Contains(c.Path, c.Side, c.Line) {
+			inline = append(inline, c)
+		} else {
+			other = append(other, c)
+		}
+	}
+	return inline, other
+}
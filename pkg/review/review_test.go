@@ -0,0 +1,137 @@
+package review
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testDiff = `diff --git a/main.go b/main.go
+index 1111111..2222222 100644
+--- a/main.go
++++ b/main.go
+@@ -1,5 +1,6 @@
+ package main
+
+-import "fmt"
++import (
++	"fmt"
++)
+
+ func main() {
+@@ -10,3 +11,2 @@ func main() {
+ 	fmt.Println("a")
+-	fmt.Println("b")
+ }
+diff --git a/old.txt b/old.txt
+deleted file mode 100644
+--- a/old.txt
++++ /dev/null
+@@ -1,2 +0,0 @@
+-one
+-two
+diff --git a/new.txt b/new.txt
+new file mode 100644
+--- /dev/null
++++ b/new.txt
+@@ -0,0 +1 @@
++--- not a header
+\ No newline at end of file
+`
+
+func TestParseDiff(t *testing.T) {
+	d := ParseDiff(testDiff)
+	assert.Equal(t, 3, d.Files())
+
+	tests := []struct {
+		path string
+		side string
+		line int
+		want bool
+	}{
+		{"main.go", SideRight, 1, true},  // context
+		{"main.go", SideLeft, 3, true},   // deleted import
+		{"main.go", SideRight, 3, true},  // added import
+		{"main.go", SideRight, 5, true},  // added
+		{"main.go", SideRight, 6, true},  // empty context line
+		{"main.go", SideRight, 7, true},  // func main
+		{"main.go", SideRight, 8, false}, // between hunks
+		{"main.go", SideLeft, 11, true},  // deleted in second hunk
+		{"main.go", SideRight, 11, true}, // context in second hunk
+		{"main.go", SideRight, 12, true},
+		{"main.go", SideRight, 13, false},
+		{"old.txt", SideLeft, 2, true},
+		{"old.txt", SideRight, 1, false},
+		{"new.txt", SideRight, 1, true},
+		{"other.go", SideRight, 1, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, d.Contains(tt.path, tt.side, tt.line), "%s %s %d", tt.path, tt.side, tt.line)
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	prompt := Prompt("+```go\n+x\n", "セキュリティを重点的に")
+	assert.Contains(t, prompt, resultFence)
+	assert.Contains(t, prompt, "````diff\n+```go\n+x\n````")
+	assert.True(t, strings.HasSuffix(prompt, "## 追加の指示\n\nセキュリティを重点的に"))
+	assert.NotContains(t, Prompt("+x", ""), "追加の指示")
+}
+
+func TestParseOutput(t *testing.T) {
+	output := "let me look at the diff\n" +
+		"```kommon-review\n{\"summary\": \"draft\", \"comments\": []}\n```\n" +
+		"on second thought\n" +
+		"```kommon-review\n" +
+		`{"summary": "概ね良いです", "comments": [` +
+		`{"path": "main.go", "line": 3, "body": "グループ化は不要です"},` +
+		`{"path": "main.go", "line": 11, "side": "left", "body": "削除して問題ありませんか？"},` +
+		`{"path": "main.go", "line": 42, "body": "範囲外"},` +
+		`{"path": "main.go", "line": 5, "body": " "}]}` +
+		"\n```\ndone\n"
+
+	result, err := ParseOutput(output)
+	require.NoError(t, err)
+	assert.Equal(t, "概ね良いです", result.Summary)
+	require.Len(t, result.Comments, 4)
+	assert.Equal(t, SideRight, result.Comments[0].Side)
+	assert.Equal(t, SideLeft, result.Comments[1].Side)
+
+	inline, other := result.Split(ParseDiff(testDiff))
+	assert.Equal(t, []Comment{
+		{Path: "main.go", Line: 3, Side: SideRight, Body: "グループ化は不要です"},
+		{Path: "main.go", Line: 11, Side: SideLeft, Body: "削除して問題ありませんか？"},
+	}, inline)
+	assert.Equal(t, []Comment{{Path: "main.go", Line: 42, Side: SideRight, Body: "範囲外"}}, other)
+}
+
+func TestParseOutputErrors(t *testing.T) {
+	_, err := ParseOutput("no review here")
+	assert.ErrorIs(t, err, ErrNoResult)
+
+	_, err = ParseOutput("```kommon-review\n{\"summary\": \"cut\"")
+	assert.ErrorIs(t, err, ErrNoResult)
+
+	_, err = ParseOutput("```kommon-review\n")
+	assert.ErrorIs(t, err, ErrNoResult)
+
+	_, err = ParseOutput("```kommon-review\nnot json\n```")
+	assert.ErrorContains(t, err, "invalid review result")
+}
+
+// Fences in comment bodies don't end the result
+func TestParseOutputSuggestion(t *testing.T) {
+	output := "```kommon-review\n" +
+		`{"summary": "提案があります", "comments": [` +
+		`{"path": "main.go", "line": 3, "body": "こちらの方が簡潔です\n` + "```suggestion\\nimport \\\"fmt\\\"\\n```" + `"}]}` +
+		"\n```\n"
+
+	result, err := ParseOutput(output)
+	require.NoError(t, err)
+	assert.Equal(t, "提案があります", result.Summary)
+	assert.Equal(t, []Comment{
+		{Path: "main.go", Line: 3, Side: SideRight, Body: "こちらの方が簡潔です\n```suggestion\nimport \"fmt\"\n```"},
+	}, result.Comments)
+}
@@ -0,0 +1,175 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+const defaultConfigMapName = "kommon-sessions"
+
+var invalidConfigMapKeyChars = regexp.MustCompile(`[^-._a-zA-Z0-9]+`)
+
+// ConfigMapStore keeps sessions in a Kubernetes ConfigMap, one data entry per session
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+}
+
+// NewConfigMapStore creates a new instance of ConfigMapStore using the
+// in-cluster config or the local kubeconfig
+func NewConfigMapStore(namespace, name string) (*ConfigMapStore, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		kubeconfig := os.Getenv("KUBECONFIG")
+		if kubeconfig == "" {
+			kubeconfig = filepath.Join(os.Getenv("HOME"), ".kube", "config")
+		}
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kubernetes config: %v", err)
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %v", err)
+	}
+
+	return newConfigMapStore(clientset, namespace, name), nil
+}
+
+func newConfigMapStore(client kubernetes.Interface, namespace, name string) *ConfigMapStore {
+	if namespace == "" {
+		namespace = "default"
+	}
+	if name == "" {
+		name = defaultConfigMapName
+	}
+	return &ConfigMapStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Get implements Store.Get
+func (s *ConfigMapStore) Get(ctx context.Context, key string) (*Session, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session configmap: %v", err)
+	}
+
+	data, exists := cm.Data[configMapKey(key)]
+	if !exists {
+		return nil, ErrNotFound
+	}
+
+	var sess Session
+	if err := json.Unmarshal([]byte(data), &sess); err != nil {
+		return nil, fmt.Errorf("failed to parse session %s: %v", key, err)
+	}
+	return &sess, nil
+}
+
+// Put implements Store.Put
+func (s *ConfigMapStore) Put(ctx context.Context, sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("failed to encode session %s: %v", sess.Key, err)
+	}
+
+	return s.update(ctx, func(cm *corev1.ConfigMap) {
+		cm.Data[configMapKey(sess.Key)] = string(data)
+	})
+}
+
+// Delete implements Store.Delete
+func (s *ConfigMapStore) Delete(ctx context.Context, key string) error {
+	return s.update(ctx, func(cm *corev1.ConfigMap) {
+		delete(cm.Data, configMapKey(key))
+	})
+}
+
+// List implements Store.List
+func (s *ConfigMapStore) List(ctx context.Context) ([]*Session, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return []*Session{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session configmap: %v", err)
+	}
+
+	sessions := make([]*Session, 0, len(cm.Data))
+	for key, data := range cm.Data {
+		var sess Session
+		if err := json.Unmarshal([]byte(data), &sess); err != nil {
+			return nil, fmt.Errorf("failed to parse session %s: %v", key, err)
+		}
+		sessions = append(sessions, &sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Key < sessions[j].Key
+	})
+	return sessions, nil
+}
+
+// update applies the mutation to the configmap, creating it when missing
+// and retrying on conflicting writes
+func (s *ConfigMapStore) update(ctx context.Context, mutate func(cm *corev1.ConfigMap)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      s.name,
+					Namespace: s.namespace,
+					Labels: map[string]string{
+						"app":       "kommon",
+						"component": "sessions",
+					},
+				},
+				Data: map[string]string{},
+			}
+			mutate(cm)
+			_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			if errors.IsAlreadyExists(err) {
+				// Someone else created it first, retry as an update
+				return errors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get session configmap: %v", err)
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		mutate(cm)
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// configMapKey converts a session key into a valid configmap data key
+func configMapKey(key string) string {
+	return invalidConfigMapKeyChars.ReplaceAllString(key, "_")
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileStore keeps sessions in memory and writes them to a JSON file on
+// every change
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore creates a new instance of FileStore and loads the sessions
+// already stored in the file
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get home directory: %w", err)
+		}
+		path = filepath.Join(homeDir, ".kommon", "sessions.json")
+	}
+
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.sessions); err != nil {
+			return nil, fmt.Errorf("failed to parse session file %s: %w", path, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Put implements Store.Put
+func (s *FileStore) Put(ctx context.Context, sess *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[sess.Key] = *sess
+	return s.save()
+}
+
+// Delete implements Store.Delete
+func (s *FileStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, key)
+	return s.save()
+}
+
+// save writes all sessions to the file. The caller must hold the lock.
+func (s *FileStore) save() error {
+	return writeJSONFile(s.path, s.sessions)
+}
+
+// writeJSONFile replaces the file atomically so a crash never leaves it half written
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", path, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
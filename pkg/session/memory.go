@@ -0,0 +1,66 @@
+package session
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps sessions in memory. Sessions are lost on restart.
+type MemoryStore struct {
+	sessions map[string]Session
+	mutex    sync.RWMutex
+}
+
+// NewMemoryStore creates a new instance of MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+// Get implements Store.Get
+func (s *MemoryStore) Get(ctx context.Context, key string) (*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sess, exists := s.sessions[key]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return &sess, nil
+}
+
+// Put implements Store.Put
+func (s *MemoryStore) Put(ctx context.Context, sess *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sessions[sess.Key] = *sess
+	return nil
+}
+
+// Delete implements Store.Delete
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.sessions, key)
+	return nil
+}
+
+// List implements Store.List
+func (s *MemoryStore) List(ctx context.Context) ([]*Session, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(s.sessions))
+	for key := range s.sessions {
+		sess := s.sessions[key]
+		sessions = append(sessions, &sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Key < sessions[j].Key
+	})
+	return sessions, nil
+}
@@ -0,0 +1,91 @@
+package session
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Status represents the state of a session
+type Status string
+
+const (
+	// StatusIdle means the session has an agent but nothing is running
+	StatusIdle Status = "idle"
+	// StatusRunning means an execution is in progress
+	StatusRunning Status = "running"
+	// StatusClosed means the issue was closed and the agent destroyed
+	StatusClosed Status = "closed"
+)
+
+// StoreType represents the type of session store
+type StoreType string
+
+const (
+	StoreTypeMemory    StoreType = "memory"
+	StoreTypeFile      StoreType = "file"
+	StoreTypeConfigMap StoreType = "configmap"
+)
+
+var (
+	ErrNotFound             = fmt.Errorf("session not found")
+	ErrUnsupportedStoreType = fmt.Errorf("unsupported session store type")
+)
+
+// Session records the agent session bound to an issue or pull request
+type Session struct {
+	Key            string    `json:"key"`             // Stable key of the issue, see Key
+	ID             string    `json:"id"`              // Agent session ID passed to the executor and goose
+	Repo           string    `json:"repo"`            // Repository full name (owner/name)
+	Issue          int       `json:"issue"`           // Issue or pull request number
+	InstallationID int64     `json:"installation_id"` // GitHub App installation of the repository
+	ExecutorHandle string    `json:"executor_handle"` // Agent ID known to the executor
+	CreatedAt      time.Time `json:"created_at"`
+	LastUsedAt     time.Time `json:"last_used_at"`
+	Status         Status    `json:"status"`
+	Generation     int       `json:"generation,omitempty"`      // Incremented by a reset so the next session gets a new ID
+	CIFixAttempts  int       `json:"ci_fix_attempts,omitempty"` // Fixes of failed CI started on the pull request
+	CIFixSHA       string    `json:"ci_fix_sha,omitempty"`      // Head commit whose failed CI was handled last
+}
+
+// Store persists sessions across restarts
+type Store interface {
+	// Get returns the session for the key or ErrNotFound
+	Get(ctx context.Context, key string) (*Session, error)
+
+	// Put creates or replaces the session
+	Put(ctx context.Context, s *Session) error
+
+	// Delete removes the session. Deleting an unknown session is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// List returns all sessions
+	List(ctx context.Context) ([]*Session, error)
+}
+
+// StoreOptions contains configuration options for creating a new store
+type StoreOptions struct {
+	Type      StoreType `json:"type"`
+	Path      string    `json:"path,omitempty"`      // File path (for file store)
+	Namespace string    `json:"namespace,omitempty"` // ConfigMap namespace (for configmap store)
+	Name      string    `json:"name,omitempty"`      // ConfigMap name (for configmap store)
+}
+
+// Key returns the key identifying the session of an issue
+func Key(repo string, issue int) string {
+	return fmt.Sprintf("%s#%d", repo, issue)
+}
+
+// NewStore creates a new instance of the specified store type
+func NewStore(opts StoreOptions) (Store, error) {
+	switch opts.Type {
+	case StoreTypeMemory, "":
+		return NewMemoryStore(), nil
+	case StoreTypeFile:
+		return NewFileStore(opts.Path)
+	case StoreTypeConfigMap:
+		return NewConfigMapStore(opts.Namespace, opts.Name)
+	default:
+		return nil, ErrUnsupportedStoreType
+	}
+}
@@ -0,0 +1,105 @@
+package session
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+	ctx := context.Background()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	sess := &Session{
+		Key:            Key("owner/repo", 1),
+		ID:             "owner/repo-1",
+		Repo:           "owner/repo",
+		Issue:          1,
+		InstallationID: 42,
+		ExecutorHandle: "owner/repo-1",
+		CreatedAt:      now,
+		LastUsedAt:     now,
+		Status:         StatusIdle,
+	}
+
+	_, err := store.Get(ctx, sess.Key)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, store.Put(ctx, sess))
+	got, err := store.Get(ctx, sess.Key)
+	require.NoError(t, err)
+	assert.Equal(t, sess, got)
+
+	// Returned sessions are copies
+	got.Status = StatusRunning
+	got, err = store.Get(ctx, sess.Key)
+	require.NoError(t, err)
+	assert.Equal(t, StatusIdle, got.Status)
+
+	other := *sess
+	other.Key = Key("owner/repo", 2)
+	other.Issue = 2
+	require.NoError(t, store.Put(ctx, &other))
+
+	sessions, err := store.List(ctx)
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+	assert.Equal(t, sess.Key, sessions[0].Key)
+	assert.Equal(t, other.Key, sessions[1].Key)
+
+	require.NoError(t, store.Delete(ctx, sess.Key))
+	require.NoError(t, store.Delete(ctx, "unknown"))
+	_, err = store.Get(ctx, sess.Key)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "sessions.json")
+
+	store, err := NewFileStore(path)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	// Sessions survive a restart
+	reloaded, err := NewFileStore(path)
+	require.NoError(t, err)
+	sessions, err := reloaded.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, Key("owner/repo", 2), sessions[0].Key)
+}
+
+func TestConfigMapStore(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	testStore(t, newConfigMapStore(client, "kommon", ""))
+
+	// Sessions survive a restart
+	reloaded := newConfigMapStore(client, "kommon", "")
+	sessions, err := reloaded.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.Equal(t, Key("owner/repo", 2), sessions[0].Key)
+}
+
+func TestNewStore(t *testing.T) {
+	store, err := NewStore(StoreOptions{Type: StoreTypeFile, Path: filepath.Join(t.TempDir(), "sessions.json")})
+	require.NoError(t, err)
+	assert.IsType(t, &FileStore{}, store)
+
+	store, err = NewStore(StoreOptions{})
+	require.NoError(t, err)
+	assert.IsType(t, &MemoryStore{}, store)
+
+	_, err = NewStore(StoreOptions{Type: "unknown"})
+	assert.ErrorIs(t, err, ErrUnsupportedStoreType)
+}
@@ -0,0 +1,277 @@
+package thread
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/takutakahashi/kommon/pkg/progress"
+)
+
+// DefaultMaxTokens is the default budget of the rendered context
+const DefaultMaxTokens = 8000
+
+// maxCommentBytes keeps a single long comment, like the output of a previous
+// execution, from taking the whole budget
+const maxCommentBytes = 4000
+
+// Comment is a comment of the thread. Review comments have a path and a line.
+type Comment struct {
+	Author    string
+	Body      string
+	CreatedAt time.Time
+	Path      string
+	Line      int
+	State     string // State of a review, e.g. CHANGES_REQUESTED
+}
+
+// File is a file of the repository referenced in the thread
+type File struct {
+	Path    string
+	Content string
+}
+
+// Thread is the conversation of an issue or a pull request
+type Thread struct {
+	Number         int
+	PullRequest    bool
+	Title          string
+	Author         string
+	State          string
+	Body           string
+	Comments       []Comment // Oldest first
+	Reviews        []Comment // Review summaries of a pull request, oldest first
+	ReviewComments []Comment // Inline comments of a pull request, oldest first
+	Diff           string
+	Files          []File
+}
+
+// EstimateTokens approximates the number of LLM tokens of the text
+func EstimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// section shares of the budget, in the order they are filled. A section
+// that needs less than its share leaves the rest to the following ones.
+var shares = []struct {
+	name  string
+	share float64
+}{
+	{"description", 0.15},
+	{"comments", 0.30},
+	{"reviews", 0.20},
+	{"diff", 0.20},
+	{"files", 0.15},
+}
+
+// Render formats the thread as markdown within about maxTokens tokens.
+// Recent comments are kept over older ones, and long texts are cut.
+func (t *Thread) Render(maxTokens int) string {
+	if maxTokens <= 0 {
+		maxTokens = DefaultMaxTokens
+	}
+	budget := maxTokens * 4 // bytes
+
+	var b strings.Builder
+	kind := "Issue"
+	if t.PullRequest {
+		kind = "Pull Request"
+	}
+	fmt.Fprintf(&b, "# %s #%d: %s\n\n作成者: @%s / 状態: %s\n", kind, t.Number, t.Title, t.Author, t.State)
+	budget -= b.Len()
+
+	carry := 0
+	for _, s := range shares {
+		size := int(float64(maxTokens*4)*s.share) + carry
+		if size > budget {
+			size = budget
+		}
+		var text string
+		switch s.name {
+		case "description":
+			text = renderDescription(t.Body, size)
+		case "comments":
+			text = renderComments("コメント", t.Comments, size)
+		case "reviews":
+			text = renderReviews(t.Reviews, t.ReviewComments, size)
+		case "diff":
+			text = renderDiff(t.Diff, size)
+		case "files":
+			text = renderFiles(t.Files, size)
+		}
+		b.WriteString(text)
+		budget -= len(text)
+		carry = size - len(text)
+	}
+	return b.String()
+}
+
+func renderDescription(body string, size int) string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return ""
+	}
+	const heading = "\n## 説明\n\n"
+	if size <= len(heading) {
+		return ""
+	}
+	return heading + truncate(body, size-len(heading)-1) + "\n"
+}
+
+// renderComments keeps the newest comments that fit in size
+func renderComments(title string, comments []Comment, size int) string {
+	heading := "\n## " + title + "\n"
+	if len(comments) == 0 || size <= len(heading) {
+		return ""
+	}
+
+	var entries []string
+	used := len(heading)
+	for i := len(comments) - 1; i >= 0; i-- {
+		entry := renderComment(comments[i])
+		if used+len(entry) > size {
+			break
+		}
+		entries = append(entries, entry)
+		used += len(entry)
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString(heading)
+	if omitted := len(comments) - len(entries); omitted > 0 {
+		fmt.Fprintf(&b, "\n（古いコメント %d 件を省略）\n", omitted)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		b.WriteString(entries[i])
+	}
+	return b.String()
+}
+
+func renderComment(c Comment) string {
+	var header string
+	switch {
+	case c.Path != "" && c.Line > 0:
+		header = fmt.Sprintf("@%s（`%s:%d`）", c.Author, c.Path, c.Line)
+	case c.Path != "":
+		header = fmt.Sprintf("@%s（`%s`）", c.Author, c.Path)
+	case c.State != "":
+		header = fmt.Sprintf("@%s（%s）", c.Author, c.State)
+	default:
+		header = "@" + c.Author
+	}
+	if !c.CreatedAt.IsZero() {
+		header += " " + c.CreatedAt.UTC().Format("2006-01-02 15:04")
+	}
+	return fmt.Sprintf("\n### %s\n\n%s\n", header, truncate(strings.TrimSpace(c.Body), maxCommentBytes))
+}
+
+// renderReviews shares size between the review summaries and the inline
+// comments
+func renderReviews(reviews, comments []Comment, size int) string {
+	var withBody []Comment
+	for _, r := range reviews {
+		if strings.TrimSpace(r.Body) != "" || r.State == "CHANGES_REQUESTED" {
+			withBody = append(withBody, r)
+		}
+	}
+	text := renderComments("レビュー", withBody, size/3)
+	return text + renderComments("レビューコメント", comments, size-len(text))
+}
+
+func renderDiff(diff string, size int) string {
+	diff = strings.TrimSpace(diff)
+	const heading = "\n## 差分\n\n"
+	if diff == "" || size <= len(heading)+16 {
+		return ""
+	}
+	return heading + progress.CodeBlock("diff", truncate(diff, size-len(heading)-16)) + "\n"
+}
+
+// renderFiles shares size equally between the files
+func renderFiles(files []File, size int) string {
+	const heading = "\n## 参照されているファイル\n"
+	if len(files) == 0 || size <= len(heading) {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(heading)
+	each := (size - len(heading)) / len(files)
+	for _, f := range files {
+		title := fmt.Sprintf("\n### `%s`\n\n", f.Path)
+		if each <= len(title)+16 {
+			continue
+		}
+		b.WriteString(title)
+		b.WriteString(progress.CodeBlock("", truncate(f.Content, each-len(title)-16)))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// truncate keeps the start of the text within size bytes
+func truncate(text string, size int) string {
+	const marker = "\n...(省略)"
+	if len(text) <= size {
+		return text
+	}
+	if size <= len(marker) {
+		return ""
+	}
+	cut := size - len(marker)
+	// Don't split a multi-byte character
+	for cut > 0 && text[cut]&0xC0 == 0x80 {
+		cut--
+	}
+	return text[:cut] + marker
+}
+
+var (
+	// blobURLPattern matches links to files of the repository
+	blobURLPattern = regexp.MustCompile(`https://github\.com/([A-Za-z0-9_.-]+/[A-Za-z0-9_.-]+)/blob/[^/\s]+/([^\s#?)\]>]+)`)
+	// codePathPattern matches paths in inline code, e.g. `pkg/agent/goose.go:42`
+	codePathPattern = regexp.MustCompile("`([A-Za-z0-9_.-]+(?:/[A-Za-z0-9_.-]+)*\\.[A-Za-z0-9]+)(?::\\d+(?:-\\d+)?)?`")
+)
+
+var sourceExtensions = map[string]bool{
+	".c": true, ".cpp": true, ".cs": true, ".css": true, ".go": true, ".h": true,
+	".html": true, ".java": true, ".js": true, ".json": true, ".jsx": true, ".kt": true,
+	".md": true, ".mod": true, ".php": true, ".py": true, ".rb": true, ".rs": true,
+	".sh": true, ".sql": true, ".toml": true, ".ts": true, ".tsx": true, ".txt": true,
+	".yaml": true, ".yml": true,
+}
+
+// ReferencedPaths returns the paths of files of the repository (owner/name)
+// mentioned in the texts, in order of appearance and at most limit
+func ReferencedPaths(repo string, limit int, texts ...string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		path = strings.TrimPrefix(path, "./")
+		if path == "" || seen[path] || strings.Contains(path, "..") || len(paths) >= limit {
+			return
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+
+	for _, text := range texts {
+		for _, m := range blobURLPattern.FindAllStringSubmatch(text, -1) {
+			if strings.EqualFold(m[1], repo) {
+				add(m[2])
+			}
+		}
+		for _, m := range codePathPattern.FindAllStringSubmatch(text, -1) {
+			// Without a directory, only well-known extensions tell a file
+			// from code like `fmt.Println`
+			if strings.Contains(m[1], "/") || sourceExtensions[strings.ToLower(filepath.Ext(m[1]))] {
+				add(m[1])
+			}
+		}
+	}
+	return paths
+}
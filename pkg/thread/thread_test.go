@@ -0,0 +1,102 @@
+package thread
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testThread() *Thread {
+	t := &Thread{
+		Number:      12,
+		PullRequest: true,
+		Title:       "ログインフォームを直す",
+		Author:      "alice",
+		State:       "open",
+		Body:        "ログインできません。",
+		Reviews: []Comment{
+			{Author: "bob", State: "APPROVED"},
+			{Author: "carol", State: "CHANGES_REQUESTED", Body: "エラーメッセージを日本語にしてください"},
+		},
+		ReviewComments: []Comment{
+			{Author: "carol", Path: "login.go", Line: 42, Body: "nil チェックが必要です"},
+		},
+		Diff:  "--- a/login.go\n+++ b/login.go\n@@ -1 +1 @@\n-a\n+b\n",
+		Files: []File{{Path: "login.go", Content: "package login\n"}},
+	}
+	for i := 1; i <= 30; i++ {
+		t.Comments = append(t.Comments, Comment{
+			Author:    "dave",
+			Body:      fmt.Sprintf("comment %d %s", i, strings.Repeat("x", 200)),
+			CreatedAt: time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC),
+		})
+	}
+	return t
+}
+
+func TestRender(t *testing.T) {
+	text := testThread().Render(100000)
+
+	assert.True(t, strings.HasPrefix(text, "# Pull Request #12: ログインフォームを直す\n\n作成者: @alice / 状態: open\n"))
+	assert.Contains(t, text, "## 説明\n\nログインできません。\n")
+	assert.Contains(t, text, "### @dave 2024-01-01 00:01\n\ncomment 1 ")
+	assert.NotContains(t, text, "古いコメント")
+	assert.Contains(t, text, "### @carol（CHANGES_REQUESTED）\n\nエラーメッセージを日本語にしてください\n")
+	assert.NotContains(t, text, "@bob", "approvals without a body are left out")
+	assert.Contains(t, text, "### @carol（`login.go:42`）\n\nnil チェックが必要です\n")
+	assert.Contains(t, text, "## 差分\n\n```diff\n--- a/login.go")
+	assert.Contains(t, text, "### `login.go`\n\n```\npackage login\n```")
+
+	// Sections follow the order of the shares
+	assert.Less(t, strings.Index(text, "## 説明"), strings.Index(text, "## コメント"))
+	assert.Less(t, strings.Index(text, "## コメント"), strings.Index(text, "## レビュー"))
+	assert.Less(t, strings.Index(text, "## レビューコメント"), strings.Index(text, "## 差分"))
+	assert.Less(t, strings.Index(text, "## 差分"), strings.Index(text, "## 参照されているファイル"))
+}
+
+func TestRenderBudget(t *testing.T) {
+	thread := testThread()
+	thread.Body = strings.Repeat("長い説明", 1000)
+
+	for _, tokens := range []int{200, 1000, 3000} {
+		text := thread.Render(tokens)
+		assert.LessOrEqual(t, EstimateTokens(text), tokens, tokens)
+	}
+
+	text := thread.Render(1000)
+	// The newest comments are kept
+	assert.Contains(t, text, "comment 30 ")
+	assert.NotContains(t, text, "comment 1 ")
+	assert.Regexp(t, `（古いコメント \d+ 件を省略）`, text)
+	assert.Contains(t, text, "...(省略)")
+	// Sections that need less leave room for the others
+	assert.Contains(t, text, "nil チェックが必要です")
+	assert.Contains(t, text, "package login")
+}
+
+func TestRenderIssue(t *testing.T) {
+	text := (&Thread{Number: 3, Title: "Bug", Author: "alice", State: "open"}).Render(0)
+	assert.Equal(t, "# Issue #3: Bug\n\n作成者: @alice / 状態: open\n", text)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 3))
+	assert.Equal(t, "", truncate("abcdef", 3))
+	cut := truncate(strings.Repeat("あ", 20), 30)
+	assert.LessOrEqual(t, len(cut), 30)
+	assert.True(t, strings.HasPrefix(cut, "ああ"))
+	assert.True(t, strings.HasSuffix(cut, "...(省略)"))
+}
+
+func TestReferencedPaths(t *testing.T) {
+	texts := []string{
+		"`pkg/agent/goose.go:42` の処理と `README.md` を見てください。`fmt.Println` は関係ありません",
+		"https://github.com/owner/repo/blob/main/cmd/run.go#L10 と https://github.com/other/repo/blob/main/x.go",
+		"`pkg/agent/goose.go` をもう一度。`../etc/passwd.txt` は無視",
+	}
+	assert.Equal(t, []string{"pkg/agent/goose.go", "README.md", "cmd/run.go"}, ReferencedPaths("Owner/Repo", 10, texts...))
+	assert.Equal(t, []string{"pkg/agent/goose.go"}, ReferencedPaths("owner/repo", 1, texts...))
+}